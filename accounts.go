@@ -0,0 +1,688 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Stored documents for accounts and their sign-in sessions
+const accountsDocument = "accounts.json"
+const sessionsDocument = "sessions.json"
+
+// Cookie holding the session id
+const sessionCookie = "legionsdex_session"
+
+// How long a sign-in lasts
+const sessionLifetime = 30 * 24 * time.Hour
+
+// Account names are also used in URLs
+var accountName = regexp.MustCompile(`^[A-Za-z0-9_-]{2,32}$`)
+
+// Account is a local user account
+type Account struct {
+	Name         string     `json:"name"`
+	PasswordHash string     `json:"password_hash"`
+	Created      time.Time  `json:"created"`
+	Tokens       []APIToken `json:"tokens,omitempty"`
+}
+
+// APIToken lets scripts act as an account. Only a hash of the token is kept.
+type APIToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// Session is a signed in browser. Only a hash of the cookie value is kept.
+type Session struct {
+	Hash    string    `json:"hash"`
+	User    string    `json:"user"`
+	CSRF    string    `json:"csrf"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// authInfo is who a request comes from, set by authenticate
+type authInfo struct {
+	User  string
+	CSRF  string
+	Token bool
+}
+
+type contextKey string
+
+const authKey contextKey = "auth"
+
+// secretHash is how session ids and API tokens are stored
+func secretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// accountKey makes account names case insensitive
+func accountKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// requestAuth is who a request comes from, if anyone
+func requestAuth(r *http.Request) (authInfo, bool) {
+	auth, ok := r.Context().Value(authKey).(authInfo)
+	return auth, ok
+}
+
+// requestUser names the signed in account making a request, or is empty
+func requestUser(r *http.Request) string {
+	auth, _ := requestAuth(r)
+	return auth.User
+}
+
+// requestCSRF is the token forms must send back for the request's session
+func requestCSRF(r *http.Request) string {
+	auth, _ := requestAuth(r)
+	return auth.CSRF
+}
+
+// authIndex holds the sessions and the API token owners by hash, so a
+// request is authenticated without reading the stored documents. The maps
+// are replaced, never changed, so a copy can be read without the lock.
+type authIndex struct {
+	loaded   bool
+	sessions map[string]Session
+	tokens   map[string]string
+}
+
+var authMu sync.Mutex
+var authCache authIndex
+
+// currentAuthIndex reads the accounts and sessions unless they are indexed
+func currentAuthIndex() (authIndex, error) {
+	authMu.Lock()
+	defer authMu.Unlock()
+	if authCache.loaded {
+		return authCache, nil
+	}
+	var accounts map[string]*Account
+	if err := readDocument(accountsDocument, &accounts); err != nil {
+		return authIndex{}, err
+	}
+	var sessions []Session
+	if err := readDocument(sessionsDocument, &sessions); err != nil {
+		return authIndex{}, err
+	}
+	index := authIndex{loaded: true, sessions: make(map[string]Session), tokens: make(map[string]string)}
+	for _, account := range accounts {
+		for _, token := range account.Tokens {
+			index.tokens[token.Hash] = account.Name
+		}
+	}
+	for _, session := range sessions {
+		index.sessions[session.Hash] = session
+	}
+	authCache = index
+	return index, nil
+}
+
+// updateAuthDocument changes the accounts or sessions, and drops the index so
+// the next request reads them afresh
+func updateAuthDocument(name string, v interface{}, change func() error) error {
+	err := updateDocument(name, v, change)
+	authMu.Lock()
+	authCache = authIndex{}
+	authMu.Unlock()
+	return err
+}
+
+// liveSessions drops the expired sessions
+func liveSessions(sessions []Session, now time.Time) []Session {
+	live := sessions[:0]
+	for _, session := range sessions {
+		if now.Before(session.Expires) {
+			live = append(live, session)
+		}
+	}
+	return live
+}
+
+// pruneSessions removes expired sessions from the stored ones
+func pruneSessions() {
+	var sessions []Session
+	err := updateAuthDocument(sessionsDocument, &sessions, func() error {
+		sessions = liveSessions(sessions, time.Now())
+		return nil
+	})
+	if err != nil {
+		log.Printf("sessions: %v", err)
+	}
+}
+
+// lookupAuth finds the account behind a bearer token or session cookie
+func lookupAuth(r *http.Request) (authInfo, bool) {
+	index, err := currentAuthIndex()
+	if err != nil {
+		log.Printf("sessions: %v", err)
+		return authInfo{}, false
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		user, found := index.tokens[secretHash(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))]
+		return authInfo{User: user, Token: true}, found
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return authInfo{}, false
+	}
+	session, found := index.sessions[secretHash(cookie.Value)]
+	if !found {
+		return authInfo{}, false
+	}
+	if !time.Now().Before(session.Expires) {
+		pruneSessions()
+		return authInfo{}, false
+	}
+	return authInfo{User: session.User, CSRF: session.CSRF}, true
+}
+
+// authenticate notes who a request comes from, leaving anonymous requests alone
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth, ok := lookupAuth(r); ok {
+			r = r.WithContext(context.WithValue(r.Context(), authKey, auth))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validCSRF reports whether a request carries its session's CSRF token, in
+// the csrf form field or the X-CSRF-Token header. Token requests need none.
+func validCSRF(r *http.Request) bool {
+	auth, ok := requestAuth(r)
+	if !ok {
+		return false
+	}
+	if auth.Token {
+		return true
+	}
+	sent := r.Header.Get("X-CSRF-Token")
+	if sent == "" {
+		sent = r.FormValue("csrf")
+	}
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(auth.CSRF)) == 1
+}
+
+// Cookie holding the CSRF token of a visitor who is not signed in
+const visitorCSRFCookie = "legionsdex_csrf"
+
+// visitorCSRF is the token a form must send back: the session's for a signed
+// in visitor, else one kept in a cookie, which another site cannot read
+func visitorCSRF(w http.ResponseWriter, r *http.Request) string {
+	if token := requestCSRF(r); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(visitorCSRFCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	token := newID() + newID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCSRFCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// validVisitorCSRF checks a form from visitorCSRF
+func validVisitorCSRF(r *http.Request) bool {
+	if requestUser(r) != "" {
+		return validCSRF(r)
+	}
+	cookie, err := r.Cookie(visitorCSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	sent := r.FormValue("csrf")
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) == 1
+}
+
+// requireLogin sends anonymous requests to the login page, or answers 401 for
+// the API, and refuses changes without the session's CSRF token
+func requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private, no-store")
+		if requestUser(r) == "" {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="LegionsDex"`)
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !validCSRF(r) {
+			http.Error(w, "missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localRedirect keeps a ?next= target on this site, going to fallback otherwise
+func localRedirect(next string, fallback string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return fallback
+	}
+	return next
+}
+
+// startSession signs a browser in as an account
+func startSession(w http.ResponseWriter, r *http.Request, user string) error {
+	id := newID() + newID() + newID() + newID()
+	session := Session{Hash: secretHash(id), User: user, CSRF: newID() + newID(), Created: time.Now(), Expires: time.Now().Add(sessionLifetime)}
+	var sessions []Session
+	err := updateAuthDocument(sessionsDocument, &sessions, func() error {
+		//Drop expired sessions while here
+		sessions = append(liveSessions(sessions, time.Now()), session)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// How many failed sign-ins an address or an account may have in loginWindow
+const maxLoginFailures = 10
+const loginWindow = 15 * time.Minute
+
+// Recent failed sign-ins by remote address and by account, for throttling
+var loginMu sync.Mutex
+var loginFailures = make(map[string][]time.Time)
+
+// loginKeys are what failed sign-ins are counted against: the address, so
+// one client cannot try many accounts, and the account, so many clients
+// cannot try one
+func loginKeys(addr string, name string) []string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return []string{"address " + addr, "account " + accountKey(name)}
+}
+
+// allowLogin reports whether a sign-in may be tried, with none of its keys
+// having too many recent failures
+func allowLogin(keys []string, now time.Time) bool {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+	//Forget keys that have gone quiet, so the map stays small
+	for key, times := range loginFailures {
+		if len(times) > 0 && now.Sub(times[len(times)-1]) >= loginWindow {
+			delete(loginFailures, key)
+		}
+	}
+	for _, key := range keys {
+		recent := 0
+		for _, t := range loginFailures[key] {
+			if now.Sub(t) < loginWindow {
+				recent += 1
+			}
+		}
+		if recent >= maxLoginFailures {
+			return false
+		}
+	}
+	return true
+}
+
+// loginFailed counts a failed sign-in against its keys
+func loginFailed(keys []string, now time.Time) {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+	for _, key := range keys {
+		var recent []time.Time
+		for _, t := range loginFailures[key] {
+			if now.Sub(t) < loginWindow {
+				recent = append(recent, t)
+			}
+		}
+		loginFailures[key] = append(recent, now)
+	}
+}
+
+// Data for the login and registration page
+type LoginPageData struct {
+	Title        string
+	Next         string
+	Name         string
+	Register     bool
+	Registration bool
+	Problems     []string
+}
+
+// Data for the account page
+type AccountPageData struct {
+	Title    string
+	User     string
+	CSRF     string
+	Tokens   []APIToken
+	NewToken string
+	Problems []string
+	Message  string
+}
+
+// renderLogin shows the login or registration form
+func renderLogin(w http.ResponseWriter, r *http.Request, register bool, problems []string) {
+	var pagedata LoginPageData
+	pagedata.Title = "Sign In"
+	if register {
+		pagedata.Title = "Create an Account"
+	}
+	pagedata.Next = r.FormValue("next")
+	pagedata.Name = r.FormValue("name")
+	pagedata.Register = register
+	pagedata.Registration = config.Features.Registration
+	pagedata.Problems = problems
+	w.Header().Set("Cache-Control", "no-store")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTemplate(w, logintpl, pagedata)
+}
+
+// Login form
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	renderLogin(w, r, false, nil)
+}
+
+// Signs in with a name and password
+func loginSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return
+	}
+	keys := loginKeys(r.RemoteAddr, r.FormValue("name"))
+	if !allowLogin(keys, time.Now()) {
+		http.Error(w, "too many failed sign-ins, try again later", http.StatusTooManyRequests)
+		return
+	}
+	var accounts map[string]*Account
+	if err := readDocument(accountsDocument, &accounts); err != nil {
+		storageError(w, err)
+		return
+	}
+	account, exists := accounts[accountKey(r.FormValue("name"))]
+	if !exists || bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(r.FormValue("password"))) != nil {
+		loginFailed(keys, time.Now())
+		renderLogin(w, r, false, []string{"wrong name or password"})
+		return
+	}
+	if err := startSession(w, r, account.Name); err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, r, localRedirect(r.FormValue("next"), "/account"), http.StatusSeeOther)
+}
+
+// Registration form
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	renderLogin(w, r, true, nil)
+}
+
+// Creates an account and signs in as it
+func registerSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	password := r.FormValue("password")
+	var problems []string
+	if !accountName.MatchString(name) {
+		problems = append(problems, "names are 2 to 32 letters, digits, - or _")
+	}
+	if len(password) < 8 {
+		problems = append(problems, "passwords need at least 8 characters")
+	}
+	if password != r.FormValue("confirm") {
+		problems = append(problems, "the passwords differ")
+	}
+	if len(problems) > 0 {
+		renderLogin(w, r, true, problems)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var accounts map[string]*Account
+	taken := false
+	err = updateAuthDocument(accountsDocument, &accounts, func() error {
+		if accounts == nil {
+			accounts = make(map[string]*Account)
+		}
+		if _, taken = accounts[accountKey(name)]; !taken {
+			accounts[accountKey(name)] = &Account{Name: name, PasswordHash: string(hash), Created: time.Now()}
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if taken {
+		renderLogin(w, r, true, []string{"that name is taken"})
+		return
+	}
+	if err := startSession(w, r, name); err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, r, localRedirect(r.FormValue("next"), "/account"), http.StatusSeeOther)
+}
+
+// Signs the browser out
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		hash := secretHash(cookie.Value)
+		var sessions []Session
+		err := updateAuthDocument(sessionsDocument, &sessions, func() error {
+			for i := range sessions {
+				if sessions[i].Hash == hash {
+					sessions = append(sessions[:i], sessions[i+1:]...)
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// updateAccount changes the signed in account
+func updateAccount(r *http.Request, change func(account *Account) error) error {
+	var accounts map[string]*Account
+	return updateAuthDocument(accountsDocument, &accounts, func() error {
+		account, exists := accounts[accountKey(requestUser(r))]
+		if !exists {
+			return ErrNotFound
+		}
+		return change(account)
+	})
+}
+
+// renderAccount shows the account page
+func renderAccount(w http.ResponseWriter, r *http.Request, pagedata AccountPageData) {
+	var accounts map[string]*Account
+	if err := readDocument(accountsDocument, &accounts); err != nil {
+		storageError(w, err)
+		return
+	}
+	pagedata.Title = "Your Account"
+	pagedata.User = requestUser(r)
+	pagedata.CSRF = requestCSRF(r)
+	if account, exists := accounts[accountKey(pagedata.User)]; exists {
+		pagedata.Tokens = account.Tokens
+	}
+	if len(pagedata.Problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTemplate(w, accounttpl, pagedata)
+}
+
+// Account page with API tokens and password change
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	renderAccount(w, r, AccountPageData{})
+}
+
+// Creates an API token, shown once
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	secret := "ldx_" + newID() + newID() + newID() + newID()
+	token := APIToken{ID: newID(), Name: strings.TrimSpace(r.FormValue("name")), Hash: secretHash(secret), Created: time.Now()}
+	if token.Name == "" {
+		token.Name = "token " + token.Created.Format("2006-01-02")
+	}
+	err := updateAccount(r, func(account *Account) error {
+		account.Tokens = append(account.Tokens, token)
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	renderAccount(w, r, AccountPageData{NewToken: secret})
+}
+
+// Revokes an API token
+func deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := updateAccount(r, func(account *Account) error {
+		for i, token := range account.Tokens {
+			if token.ID == id {
+				account.Tokens = append(account.Tokens[:i], account.Tokens[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// endOtherSessions signs the request's account out of every browser but the
+// one making the request
+func endOtherSessions(r *http.Request) error {
+	user := accountKey(requestUser(r))
+	current := ""
+	if auth, _ := requestAuth(r); !auth.Token {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			current = secretHash(cookie.Value)
+		}
+	}
+	var sessions []Session
+	return updateAuthDocument(sessionsDocument, &sessions, func() error {
+		kept := sessions[:0]
+		for _, session := range sessions {
+			if accountKey(session.User) != user || session.Hash == current {
+				kept = append(kept, session)
+			}
+		}
+		sessions = kept
+		return nil
+	})
+}
+
+// Changes the account password after checking the current one
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	password := r.FormValue("password")
+	if len(password) < 8 || password != r.FormValue("confirm") {
+		renderAccount(w, r, AccountPageData{Problems: []string{"the new password needs at least 8 characters, typed the same twice"}})
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	wrong := fmt.Errorf("wrong password")
+	err = updateAccount(r, func(account *Account) error {
+		if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(r.FormValue("current"))) != nil {
+			return wrong
+		}
+		account.PasswordHash = string(hash)
+		//Whoever had the old password may have made tokens with it
+		account.Tokens = nil
+		return nil
+	})
+	if err == wrong {
+		renderAccount(w, r, AccountPageData{Problems: []string{"the current password is wrong"}})
+		return
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := endOtherSessions(r); err != nil {
+		storageError(w, err)
+		return
+	}
+	renderAccount(w, r, AccountPageData{Message: "Password changed. You are signed out everywhere else, and your API tokens are revoked."})
+}
+
+// API answering who a token or session belongs to
+func whoamiAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"user": requestUser(r)})
+}
+
+// registerAccounts adds sign in pages to router and account pages to personal,
+// a subrouter that requires login
+func registerAccounts(router *mux.Router, personal *mux.Router) {
+	router.HandleFunc("/login", loginHandler).Methods("GET")
+	router.HandleFunc("/login", loginSubmitHandler).Methods("POST")
+	if config.Features.Registration {
+		router.HandleFunc("/register", registerHandler).Methods("GET")
+		router.HandleFunc("/register", registerSubmitHandler).Methods("POST")
+	}
+	personal.HandleFunc("/logout", logoutHandler).Methods("POST")
+	personal.HandleFunc("/account", accountHandler).Methods("GET")
+	personal.HandleFunc("/account/tokens", createTokenHandler).Methods("POST")
+	personal.HandleFunc("/account/tokens/{id}/delete", deleteTokenHandler).Methods("POST")
+	personal.HandleFunc("/account/password", changePasswordHandler).Methods("POST")
+	personal.HandleFunc("/api/whoami", whoamiAPIHandler).Methods("GET")
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// signIn stores an account with an API token and two sessions, one expired
+func signIn(t *testing.T) {
+	useTestRepository(t)
+	accounts := map[string]*Account{
+		"boss": {Name: "boss", Tokens: []APIToken{{ID: "t1", Hash: secretHash("ldx_token")}}},
+	}
+	if err := updateAuthDocument(accountsDocument, &accounts, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	sessions := []Session{
+		{Hash: secretHash("live"), User: "boss", CSRF: "csrf-live", Expires: time.Now().Add(time.Hour)},
+		{Hash: secretHash("old"), User: "boss", CSRF: "csrf-old", Expires: time.Now().Add(-time.Hour)},
+	}
+	if err := updateAuthDocument(sessionsDocument, &sessions, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookupAuth(t *testing.T) {
+	signIn(t)
+	tests := []struct {
+		name   string
+		bearer string
+		cookie string
+		user   string
+		csrf   string
+	}{
+		{"anonymous", "", "", "", ""},
+		{"token", "ldx_token", "", "boss", ""},
+		{"unknown token", "ldx_other", "", "", ""},
+		{"token wins over cookie", "ldx_other", "live", "", ""},
+		{"session", "", "live", "boss", "csrf-live"},
+		{"expired session", "", "old", "", ""},
+		{"unknown session", "", "other", "", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/account", nil)
+		if test.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: test.cookie})
+		}
+		auth, ok := lookupAuth(r)
+		if ok != (test.user != "") || auth.User != test.user || auth.CSRF != test.csrf {
+			t.Errorf("%s: got %+v, %v", test.name, auth, ok)
+		}
+	}
+
+	//The expired session was pruned when it was looked up
+	var sessions []Session
+	if err := readDocument(sessionsDocument, &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Hash != secretHash("live") {
+		t.Errorf("stored sessions %+v, want only the live one", sessions)
+	}
+}
+
+func TestLookupAuthAfterWrite(t *testing.T) {
+	signIn(t)
+	r := httptest.NewRequest("GET", "/account", nil)
+	r.Header.Set("Authorization", "Bearer ldx_token")
+	if _, ok := lookupAuth(r); !ok {
+		t.Fatal("token not found")
+	}
+	var accounts map[string]*Account
+	err := updateAuthDocument(accountsDocument, &accounts, func() error {
+		accounts["boss"].Tokens = nil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lookupAuth(r); ok {
+		t.Error("revoked token still accepted")
+	}
+}
+
+func TestRequireLogin(t *testing.T) {
+	signIn(t)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		bearer string
+		cookie string
+		header string
+		form   string
+		want   int
+	}{
+		{"anonymous page", "GET", "/account", "", "", "", "", http.StatusSeeOther},
+		{"anonymous API", "GET", "/api/whoami", "", "", "", "", http.StatusUnauthorized},
+		{"session read", "GET", "/account", "", "live", "", "", http.StatusOK},
+		{"post without token", "POST", "/account", "", "live", "", "", http.StatusForbidden},
+		{"post with wrong token", "POST", "/account", "", "live", "", "csrf=csrf-old", http.StatusForbidden},
+		{"post with form token", "POST", "/account", "", "live", "", "csrf=csrf-live", http.StatusOK},
+		{"post with header token", "POST", "/account", "", "live", "csrf-live", "", http.StatusOK},
+		{"API token needs no CSRF", "POST", "/api/collection", "ldx_token", "", "", "", http.StatusOK},
+		{"expired session", "GET", "/account", "", "old", "", "", http.StatusSeeOther},
+	}
+	handler := authenticate(requireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.form))
+		if test.form != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if test.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: test.cookie})
+		}
+		if test.header != "" {
+			r.Header.Set("X-CSRF-Token", test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"/collection", "/collection"},
+		{"", "/"},
+		{"https://example.com/", "/"},
+		{"//example.com/", "/"},
+		{"/\\example.com", "/"},
+	}
+	for _, test := range tests {
+		if got := localRedirect(test.next, "/"); got != test.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", test.next, got, test.want)
+		}
+	}
+}
+
+func TestValidVisitorCSRF(t *testing.T) {
+	signIn(t)
+	tests := []struct {
+		name    string
+		session string
+		cookie  string
+		form    string
+		want    bool
+	}{
+		{"no token", "", "", "", false},
+		{"form without cookie", "", "", "csrf=abc", false},
+		{"cookie without form", "", "abc", "", false},
+		{"matching cookie", "", "abc", "csrf=abc", true},
+		{"other cookie", "", "abd", "csrf=abc", false},
+		{"signed in uses the session token", "live", "", "csrf=csrf-live", true},
+		{"signed in ignores the visitor cookie", "live", "abc", "csrf=abc", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/unreleased", strings.NewReader(test.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.session != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: test.session})
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: visitorCSRFCookie, Value: test.cookie})
+		}
+		var got bool
+		authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = validVisitorCSRF(r)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// setPassword gives an account a password, creating the account if need be
+func setPassword(t *testing.T, name string, password string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accounts map[string]*Account
+	if err := updateAuthDocument(accountsDocument, &accounts, func() error {
+		if accounts[accountKey(name)] == nil {
+			accounts[accountKey(name)] = &Account{Name: name}
+		}
+		accounts[accountKey(name)].PasswordHash = string(hash)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangePasswordEndsOtherSessions(t *testing.T) {
+	signIn(t)
+	if err := loadTemplates(""); err != nil {
+		t.Fatal(err)
+	}
+	setPassword(t, "boss", "old password")
+	var sessions []Session
+	if err := updateAuthDocument(sessionsDocument, &sessions, func() error {
+		sessions = append(sessions,
+			Session{Hash: secretHash("phone"), User: "boss", Expires: time.Now().Add(time.Hour)},
+			Session{Hash: secretHash("guest"), User: "guest", Expires: time.Now().Add(time.Hour)})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"current": {"old password"}, "password": {"new password"}, "confirm": {"new password"}}
+	r := httptest.NewRequest("POST", "/account/password", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "live"})
+	w := httptest.NewRecorder()
+	authenticate(http.HandlerFunc(changePasswordHandler)).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Password changed.") {
+		t.Fatalf("got %d, %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name   string
+		bearer string
+		cookie string
+		user   string
+	}{
+		{"the session changing it", "", "live", "boss"},
+		{"another session", "", "phone", ""},
+		{"another account's session", "", "guest", "guest"},
+		{"API token", "ldx_token", "", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/account", nil)
+		if test.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: test.cookie})
+		}
+		if auth, _ := lookupAuth(r); auth.User != test.user {
+			t.Errorf("%s: signed in as %q, want %q", test.name, auth.User, test.user)
+		}
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	signIn(t)
+	if err := loadTemplates(""); err != nil {
+		t.Fatal(err)
+	}
+	setPassword(t, "boss", "right password")
+	setPassword(t, "guest", "guest password")
+	loginMu.Lock()
+	saved := loginFailures
+	loginFailures = make(map[string][]time.Time)
+	loginMu.Unlock()
+	defer func() {
+		loginMu.Lock()
+		loginFailures = saved
+		loginMu.Unlock()
+	}()
+
+	login := func(addr string, name string, password string) int {
+		form := url.Values{"name": {name}, "password": {password}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		loginSubmitHandler(w, r)
+		return w.Code
+	}
+	for i := 0; i < maxLoginFailures; i++ {
+		if code := login("192.0.2.1:1000", "boss", "guess"); code != http.StatusBadRequest {
+			t.Fatalf("failure %d: got %d", i+1, code)
+		}
+	}
+	tests := []struct {
+		name     string
+		addr     string
+		account  string
+		password string
+		want     int
+	}{
+		{"same address and account", "192.0.2.1:1001", "boss", "right password", http.StatusTooManyRequests},
+		{"same account from elsewhere", "198.51.100.1:1000", "BOSS", "right password", http.StatusTooManyRequests},
+		{"another account from the same address", "192.0.2.1:1002", "guest", "guest password", http.StatusTooManyRequests},
+		{"another account from elsewhere", "198.51.100.1:1001", "guest", "guest password", http.StatusSeeOther},
+	}
+	for _, test := range tests {
+		if code := login(test.addr, test.account, test.password); code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, code, test.want)
+		}
+	}
+	if !allowLogin(loginKeys("192.0.2.1:1000", "boss"), time.Now().Add(loginWindow)) {
+		t.Error("still throttled once the failures are old")
+	}
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Stored audit log of every change made through /admin
+const auditDocument = "audit.json"
+
+// AdminUsers maps who may use /admin to a bcrypt hash of their password
+type AdminUsers map[string]string
+
+// Set applies a comma separated list like "kim:$2a$10$..."
+func (users AdminUsers) Set(list string) error {
+	for _, item := range splitList(list) {
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("%q is not name:hash", item)
+		}
+		users[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+// hashPasswordCommand implements "legionsdex hash-password", printing the
+// bcrypt hash of a password read from standard input for use in admin_users
+func hashPasswordCommand(args []string) int {
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() || scanner.Text() == "" {
+		fmt.Fprintln(os.Stderr, "usage: echo password | legionsdex hash-password")
+		return exitConfig
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(scanner.Text()), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConfig
+	}
+	fmt.Println(string(hash))
+	return exitOK
+}
+
+// requireAdmin lets through only requests with the basic auth password of an
+// admin user. Forms posted from another site are refused, since the browser
+// would send the password along with them.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, password, ok := r.BasicAuth()
+		hash, known := config.AdminUsers[name]
+		if !ok || !known || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="LegionsDex admin", charset="UTF-8"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+			http.Error(w, "cross-site request refused", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether a request came from a page of this site, going by
+// its Origin or else its Referer. Requests with neither are not from a browser form.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	return err == nil && u.Host == r.Host
+}
+
+// adminUser is the admin making a request, already checked by requireAdmin
+func adminUser(r *http.Request) string {
+	name, _, _ := r.BasicAuth()
+	return name
+}
+
+// AuditEntry is one recorded change to the figures, which may touch several
+type AuditEntry struct {
+	ID      string        `json:"id"`
+	Author  string        `json:"author"`
+	Time    time.Time     `json:"time"`
+	Action  string        `json:"action"`
+	Summary string        `json:"summary"`
+	Changes []AuditChange `json:"changes"`
+	Reverts string        `json:"reverts,omitempty"`
+
+	//Who suggested a change an admin approved
+	Submitter string `json:"submitter,omitempty"`
+	Proposal  string `json:"proposal,omitempty"`
+
+	//Set while the changes are being applied, and left set if that failed
+	Pending bool `json:"pending,omitempty"`
+
+	//A release lifecycle edit, which has no figure changes
+	Release *ReleaseChange `json:"release,omitempty"`
+}
+
+// AuditChange is one figure before and after a change; Before is nil for a
+// created figure and After is nil for a deleted one
+type AuditChange struct {
+	Before *Figure `json:"before"`
+	After  *Figure `json:"after"`
+}
+
+// Name of the figure changed
+func (change AuditChange) Name() string {
+	if change.After != nil {
+		return change.After.Name
+	}
+	return change.Before.Name
+}
+
+// Kind is added, removed or changed, as on the changes page
+func (change AuditChange) Kind() string {
+	if change.Before == nil {
+		return "added"
+	}
+	if change.After == nil {
+		return "removed"
+	}
+	return "changed"
+}
+
+// Fields lists what an edit changed, the name included
+func (change AuditChange) Fields() []FieldChange {
+	if change.Before == nil || change.After == nil {
+		return nil
+	}
+	var fields []FieldChange
+	if change.Before.Name != change.After.Name {
+		fields = append(fields, FieldChange{Field: "name", Before: change.Before.Name, After: change.After.Name})
+	}
+	was, is := figureFields(*change.Before), figureFields(*change.After)
+	for _, field := range figureFieldOrder {
+		if was[field] != is[field] {
+			fields = append(fields, FieldChange{Field: field, Before: was[field], After: is[field]})
+		}
+	}
+	return fields
+}
+
+// sameFigure reports whether two figures, either possibly missing, are alike
+func sameFigure(a *Figure, b *Figure) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Name == b.Name && len(AuditChange{Before: a, After: b}.Fields()) == 0
+}
+
+// validationError lists what is wrong with a change, to show with the form
+type validationError []string
+
+func (problems validationError) Error() string {
+	return strings.Join(problems, "; ")
+}
+
+// validateFigure checks a figure about to be saved alongside others, which
+// must not take the address its slug gives it
+func validateFigure(figure Figure, others []Figure) []string {
+	problems := validateChecklist(Checklist{Figures: []Figure{figure}})
+	if figure.Url != "" {
+		if u, err := url.Parse(figure.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, figure.Name+": url must be an http or https address")
+		}
+	}
+	slug := figure.Slug()
+	if slug == "" {
+		problems = append(problems, figure.Name+": the name needs a letter or digit to make its address")
+	}
+	for _, other := range others {
+		if slug != "" && other.Name != figure.Name && other.Slug() == slug {
+			problems = append(problems, fmt.Sprintf("%s: %s already has the address /figure/%s", figure.Name, other.Name, slug))
+		}
+	}
+	return problems
+}
+
+// figuresAfter lists the figures there will be once changes are applied
+func figuresAfter(checklist Checklist, changes []AuditChange) []Figure {
+	replaced := make(map[string]bool)
+	for _, change := range changes {
+		if change.Before != nil {
+			replaced[change.Before.Name] = true
+		}
+	}
+	var figures []Figure
+	for _, figure := range checklist.Figures {
+		if !replaced[figure.Name] {
+			figures = append(figures, figure)
+		}
+	}
+	for _, change := range changes {
+		if change.After != nil {
+			figures = append(figures, *change.After)
+		}
+	}
+	return figures
+}
+
+// Serialises admin changes, so each is checked against the figures it replaces
+var adminMu sync.Mutex
+
+// commitChanges validates an entry's changes and checks every figure is still
+// as the change expects. The entry goes in the audit log as pending before any
+// figure changes, so no change goes unrecorded, and is marked applied after.
+func commitChanges(entry AuditEntry) (AuditEntry, error) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	entry.ID = newID()
+	entry.Time = time.Now()
+	var problems validationError
+	var effective []AuditChange
+	for _, change := range entry.Changes {
+		if !sameFigure(change.Before, change.After) {
+			effective = append(effective, change)
+		}
+	}
+	changes := effective
+	entry.Changes = changes
+	if len(changes) == 0 {
+		problems = append(problems, "nothing to change")
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		return entry, err
+	}
+	after := figuresAfter(checklist, changes)
+	for _, change := range changes {
+		if change.After != nil {
+			problems = append(problems, validateFigure(*change.After, after)...)
+		}
+		if change.Before != nil {
+			current, err := repo.Figure(change.Before.Name)
+			if err == ErrNotFound || (err == nil && !sameFigure(&current, change.Before)) {
+				problems = append(problems, change.Before.Name+": changed since, reload and try again")
+			} else if err != nil {
+				return entry, err
+			}
+		}
+		if change.After != nil && (change.Before == nil || change.Before.Name != change.After.Name) {
+			if _, err := repo.Figure(change.After.Name); err == nil {
+				problems = append(problems, change.After.Name+": a figure of that name exists")
+			} else if err != ErrNotFound {
+				return entry, err
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return entry, problems
+	}
+	err = recordAudit(&entry, func() error {
+		err := applyChanges(changes)
+		figuresEdited()
+		return err
+	})
+	return entry, err
+}
+
+// recordAudit appends an entry to the audit log as pending, makes its changes
+// with apply and then marks it applied. Nothing is applied if the entry cannot
+// be recorded, and a failed apply leaves it pending.
+func recordAudit(entry *AuditEntry, apply func() error) error {
+	var entries []AuditEntry
+	entry.Pending = true
+	err := updateDocument(auditDocument, &entries, func() error {
+		entries = append(entries, *entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return fmt.Errorf("%v, the audit log has the change as pending", err)
+	}
+	entry.Pending = false
+	return updateDocument(auditDocument, &entries, func() error {
+		for i := range entries {
+			if entries[i].ID == entry.ID {
+				entries[i].Pending = false
+			}
+		}
+		return nil
+	})
+}
+
+// applyChanges saves and deletes the figures of validated changes
+func applyChanges(changes []AuditChange) error {
+	for _, change := range changes {
+		if change.Before != nil && (change.After == nil || change.After.Name != change.Before.Name) {
+			if err := repo.DeleteFigure(change.Before.Name); err != nil {
+				return err
+			}
+		}
+		if change.After != nil {
+			if err := repo.SaveFigure(*change.After); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// auditEntries lists the audit log, newest first
+func auditEntries() ([]AuditEntry, error) {
+	var entries []AuditEntry
+	if err := readDocument(auditDocument, &entries); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// figureFromForm reads the figure form, one release and one part per line
+func figureFromForm(r *http.Request) Figure {
+	figure := Figure{
+		Name:    strings.TrimSpace(r.FormValue("name")),
+		Faction: strings.TrimSpace(r.FormValue("faction")),
+		Race:    strings.TrimSpace(r.FormValue("race")),
+		Role:    strings.TrimSpace(r.FormValue("role")),
+		Scale:   strings.TrimSpace(r.FormValue("scale")),
+		Url:     strings.TrimSpace(r.FormValue("url")),
+		Image:   strings.TrimSpace(r.FormValue("image")),
+	}
+	for _, release := range strings.Split(r.FormValue("released"), "\n") {
+		if release = strings.TrimSpace(release); release != "" {
+			figure.Release = append(figure.Release, release)
+		}
+	}
+	for _, line := range strings.Split(r.FormValue("parts"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			figure.Parts = append(figure.Parts, parsePart(line))
+		}
+	}
+	return figure
+}
+
+// mergeFigures folds one figure into another: releases and parts are combined and
+// fields the kept figure lacks are taken from the other
+func mergeFigures(keep Figure, other Figure) Figure {
+	merged := keep
+	merged.Release = append([]string{}, keep.Release...)
+	for _, release := range other.Release {
+		found := false
+		for _, existing := range merged.Release {
+			if existing == release {
+				found = true
+			}
+		}
+		if !found {
+			merged.Release = append(merged.Release, release)
+		}
+	}
+	merged.Parts = append([]Part{}, keep.Parts...)
+	for _, part := range other.Parts {
+		found := false
+		for _, existing := range merged.Parts {
+			if partKey(existing) == partKey(part) {
+				found = true
+			}
+		}
+		if !found {
+			merged.Parts = append(merged.Parts, part)
+		}
+	}
+	for _, field := range []struct{ into, from *string }{
+		{&merged.Faction, &other.Faction}, {&merged.Race, &other.Race}, {&merged.Role, &other.Role},
+		{&merged.Scale, &other.Scale}, {&merged.Url, &other.Url}, {&merged.Image, &other.Image},
+	} {
+		if *field.into == "" {
+			*field.into = *field.from
+		}
+	}
+	return merged
+}
+
+// renameValue replaces a facet value of a figure, reporting whether it had it
+func renameValue(figure Figure, searchType string, from string, to string) (Figure, bool) {
+	renamed := figure
+	switch searchType {
+	case "faction":
+		renamed.Faction = to
+		return renamed, figure.Faction == from
+	case "race":
+		renamed.Race = to
+		return renamed, figure.Race == from
+	case "role":
+		renamed.Role = to
+		return renamed, figure.Role == from
+	case "scale":
+		renamed.Scale = to
+		return renamed, figure.Scale == from
+	case "release":
+		renamed.Release = nil
+		found := false
+		for _, release := range figure.Release {
+			if release == from {
+				found = true
+				release = to
+			}
+			duplicate := false
+			for _, existing := range renamed.Release {
+				if existing == release {
+					duplicate = true
+				}
+			}
+			if !duplicate {
+				renamed.Release = append(renamed.Release, release)
+			}
+		}
+		return renamed, found
+	}
+	return figure, false
+}
+
+// Data for the admin dashboard and audit log
+type AdminPageData struct {
+	Title      string
+	User       string
+	Query      string
+	Figures    Checklist
+	Names      []string
+	Audit      []AuditEntry
+	FullAudit  bool
+	FacetTypes []string
+	Problems   []string
+}
+
+// Data for the admin figure form
+type AdminFigurePageData struct {
+	Title    string
+	User     string
+	Action   string
+	Figure   Figure
+	Released string
+	Parts    string
+	Existing bool
+	Problems []string
+}
+
+// renderAdmin shows the dashboard, or the full audit log, with any problems to report
+func renderAdmin(w http.ResponseWriter, r *http.Request, fullAudit bool, problems []string) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	audit, err := auditEntries()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata AdminPageData
+	pagedata.Title = "Admin"
+	pagedata.User = adminUser(r)
+	pagedata.Query = r.FormValue("q")
+	pagedata.FullAudit = fullAudit
+	pagedata.FacetTypes = facetTypes
+	pagedata.Problems = problems
+	pagedata.Names = figureNames(checklist)
+	if fullAudit {
+		pagedata.Title = "Audit Log"
+		pagedata.Audit = audit
+	} else {
+		if len(audit) > 10 {
+			audit = audit[:10]
+		}
+		pagedata.Audit = audit
+		query := strings.ToLower(pagedata.Query)
+		for _, figure := range checklist.Figures {
+			if strings.Contains(strings.ToLower(figure.Name), query) {
+				pagedata.Figures.AddItem(figure)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTemplate(w, admintpl, pagedata)
+}
+
+// Admin dashboard listing figures, bulk tools and recent changes
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	renderAdmin(w, r, false, nil)
+}
+
+// Admin page listing every recorded change
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	renderAdmin(w, r, true, nil)
+}
+
+// renderFigureForm shows the create or edit form
+func renderFigureForm(w http.ResponseWriter, r *http.Request, figure Figure, existing bool, problems []string) {
+	var pagedata AdminFigurePageData
+	pagedata.User = adminUser(r)
+	pagedata.Figure = figure
+	pagedata.Released = strings.Join(figure.Release, "\n")
+	pagedata.Parts = partsText(figure.Parts)
+	pagedata.Existing = existing
+	pagedata.Problems = problems
+	if existing {
+		pagedata.Title = "Edit " + figure.Name
+		pagedata.Action = r.URL.EscapedPath()
+	} else {
+		pagedata.Title = "New Figure"
+		pagedata.Action = "/admin/figures/new"
+	}
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTemplate(w, adminfiguretpl, pagedata)
+}
+
+// adminFigure finds the figure named by the route's slug
+func adminFigure(w http.ResponseWriter, r *http.Request) (Figure, bool) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return Figure{}, false
+	}
+	figure, found := figureBySlug(checklist, mux.Vars(r)["figure"])
+	if !found {
+		http.NotFound(w, r)
+	}
+	return figure, found
+}
+
+// Form creating a figure
+func adminNewFigureHandler(w http.ResponseWriter, r *http.Request) {
+	renderFigureForm(w, r, Figure{}, false, nil)
+}
+
+// Form editing a figure
+func adminFigureHandler(w http.ResponseWriter, r *http.Request) {
+	figure, found := adminFigure(w, r)
+	if found {
+		renderFigureForm(w, r, figure, true, nil)
+	}
+}
+
+// commitOrReport commits an admin's changes and redirects to the audit log, or
+// reports problems through the given function
+func commitOrReport(w http.ResponseWriter, r *http.Request, entry AuditEntry, report func([]string)) {
+	entry.Author = adminUser(r)
+	entry, err := commitChanges(entry)
+	var problems validationError
+	if errors.As(err, &problems) {
+		report(problems)
+		return
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/audit#"+entry.ID, http.StatusSeeOther)
+}
+
+// Creates a figure from the form
+func adminCreateFigureHandler(w http.ResponseWriter, r *http.Request) {
+	figure := figureFromForm(r)
+	entry := AuditEntry{Action: "create", Summary: "Created " + figure.Name, Changes: []AuditChange{{After: &figure}}}
+	commitOrReport(w, r, entry, func(problems []string) {
+		renderFigureForm(w, r, figure, false, problems)
+	})
+}
+
+// Saves the edit form
+func adminSaveFigureHandler(w http.ResponseWriter, r *http.Request) {
+	before, found := adminFigure(w, r)
+	if !found {
+		return
+	}
+	after := figureFromForm(r)
+	entry := AuditEntry{Action: "edit", Summary: "Edited " + before.Name, Changes: []AuditChange{{Before: &before, After: &after}}}
+	commitOrReport(w, r, entry, func(problems []string) {
+		renderFigureForm(w, r, after, true, problems)
+	})
+}
+
+// Deletes a figure
+func adminDeleteFigureHandler(w http.ResponseWriter, r *http.Request) {
+	before, found := adminFigure(w, r)
+	if !found {
+		return
+	}
+	entry := AuditEntry{Action: "delete", Summary: "Deleted " + before.Name, Changes: []AuditChange{{Before: &before}}}
+	commitOrReport(w, r, entry, func(problems []string) {
+		renderAdmin(w, r, false, problems)
+	})
+}
+
+// Merges a duplicate figure into another
+func adminMergeHandler(w http.ResponseWriter, r *http.Request) {
+	keep, err1 := repo.Figure(r.FormValue("keep"))
+	other, err2 := repo.Figure(r.FormValue("remove"))
+	if err1 != nil || err2 != nil || keep.Name == other.Name {
+		renderAdmin(w, r, false, []string{"pick two different existing figures to merge"})
+		return
+	}
+	merged := mergeFigures(keep, other)
+	entry := AuditEntry{Action: "merge", Summary: "Merged " + other.Name + " into " + keep.Name}
+	entry.Changes = []AuditChange{{Before: &keep, After: &merged}, {Before: &other}}
+	commitOrReport(w, r, entry, func(problems []string) {
+		renderAdmin(w, r, false, problems)
+	})
+}
+
+// Renames a facet value on every figure having it
+func adminRenameHandler(w http.ResponseWriter, r *http.Request) {
+	searchType := r.FormValue("type")
+	from := strings.TrimSpace(r.FormValue("from"))
+	to := strings.TrimSpace(r.FormValue("to"))
+	if checkFilter(Filter{searchType: from}) != nil || from == "" || to == "" || from == to {
+		renderAdmin(w, r, false, []string{"rename needs a facet, a value and a different new value"})
+		return
+	}
+	checklist, err := repo.Figures(Filter{searchType: from})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var changes []AuditChange
+	for i := range checklist.Figures {
+		before := checklist.Figures[i]
+		if after, found := renameValue(before, searchType, from, to); found {
+			changes = append(changes, AuditChange{Before: &before, After: &after})
+		}
+	}
+	summary := fmt.Sprintf("Renamed %s %q to %q on %d figures", searchType, from, to, len(changes))
+	commitOrReport(w, r, AuditEntry{Action: "rename", Summary: summary, Changes: changes}, func(problems []string) {
+		renderAdmin(w, r, false, problems)
+	})
+}
+
+// Undoes a recorded change by recording its opposite
+func adminRevertHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := auditEntries()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	for _, entry := range entries {
+		if entry.ID != id {
+			continue
+		}
+		if entry.Release != nil {
+			revert := AuditEntry{Action: "revert", Summary: "Reverted: " + entry.Summary, Reverts: entry.ID}
+			revert.Release = &ReleaseChange{Before: entry.Release.After, After: entry.Release.Before}
+			revert.Author = adminUser(r)
+			if _, err := commitRelease(revert); err != nil {
+				var problems validationError
+				if errors.As(err, &problems) {
+					renderAdmin(w, r, true, problems)
+					return
+				}
+				storageError(w, err)
+				return
+			}
+			http.Redirect(w, r, "/admin/audit", http.StatusSeeOther)
+			return
+		}
+		var changes []AuditChange
+		for i := len(entry.Changes) - 1; i >= 0; i-- {
+			changes = append(changes, AuditChange{Before: entry.Changes[i].After, After: entry.Changes[i].Before})
+		}
+		revert := AuditEntry{Action: "revert", Summary: "Reverted: " + entry.Summary, Changes: changes, Reverts: entry.ID}
+		commitOrReport(w, r, revert, func(problems []string) {
+			renderAdmin(w, r, true, problems)
+		})
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// registerAdmin adds the /admin pages behind admin authentication
+func registerAdmin(router *mux.Router) {
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("", adminHandler).Methods("GET")
+	admin.HandleFunc("/audit", adminAuditHandler).Methods("GET")
+	admin.HandleFunc("/audit/{id}/revert", adminRevertHandler).Methods("POST")
+	admin.HandleFunc("/figures/new", adminNewFigureHandler).Methods("GET")
+	admin.HandleFunc("/figures/new", adminCreateFigureHandler).Methods("POST")
+	admin.HandleFunc("/figure/{figure}", adminFigureHandler).Methods("GET")
+	admin.HandleFunc("/figure/{figure}", adminSaveFigureHandler).Methods("POST")
+	admin.HandleFunc("/figure/{figure}/delete", adminDeleteFigureHandler).Methods("POST")
+	admin.HandleFunc("/merge", adminMergeHandler).Methods("POST")
+	admin.HandleFunc("/rename", adminRenameHandler).Methods("POST")
+	admin.HandleFunc("/proposals", proposalsHandler).Methods("GET")
+	admin.HandleFunc("/proposals/{id}/approve", approveProposalHandler).Methods("POST")
+	admin.HandleFunc("/proposals/{id}/reject", rejectProposalHandler).Methods("POST")
+	admin.HandleFunc("/releases", adminReleasesHandler).Methods("GET")
+	admin.HandleFunc("/release/{release}", adminReleaseHandler).Methods("GET")
+	admin.HandleFunc("/release/{release}", saveReleaseHandler).Methods("POST")
+}
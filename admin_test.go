@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommitChanges(t *testing.T) {
+	knight := Figure{Name: "Knight", Faction: "ORDER", Race: "HUMAN", Role: "KNIGHT", Scale: "1:12", Release: []string{"WAVE 1"}}
+	edited := knight
+	edited.Faction = "CHAOS"
+
+	r := useTestRepository(t, knight)
+	entry, err := commitChanges(AuditEntry{Author: "boss", Changes: []AuditChange{{Before: &knight, After: &edited}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if figure, _ := repo.Figure("Knight"); figure.Faction != "CHAOS" {
+		t.Errorf("change not applied: %+v", figure)
+	}
+	entries, err := auditEntries()
+	if err != nil || len(entries) != 1 || entries[0].ID != entry.ID || entries[0].Pending {
+		t.Errorf("audit log %+v, %v, want the entry applied", entries, err)
+	}
+
+	//An audit log that cannot be written stops the change
+	r = useTestRepository(t, knight)
+	if err := os.Mkdir(filepath.Join(r.dir, auditDocument), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commitChanges(AuditEntry{Author: "boss", Changes: []AuditChange{{Before: &knight, After: &edited}}}); err == nil {
+		t.Error("no error when the audit log cannot be written")
+	}
+	if figure, _ := repo.Figure("Knight"); figure.Faction != "ORDER" {
+		t.Errorf("change applied without an audit entry: %+v", figure)
+	}
+}
+
+func TestCommitChangesSlugs(t *testing.T) {
+	knight := Figure{Name: "Knight", Faction: "ORDER", Race: "HUMAN", Role: "KNIGHT", Scale: "1:12", Release: []string{"WAVE 1"}}
+	squire := knight
+	squire.Name = "Squire"
+	named := func(figure Figure, name string) *Figure {
+		figure.Name = name
+		return &figure
+	}
+	tests := []struct {
+		name    string
+		changes []AuditChange
+		ok      bool
+	}{
+		{"new slug", []AuditChange{{After: named(knight, "Dark Knight")}}, true},
+		{"no slug", []AuditChange{{After: named(knight, "???")}}, false},
+		{"slug taken", []AuditChange{{After: named(knight, "Knight!")}}, false},
+		{"renamed onto a taken slug", []AuditChange{{Before: &squire, After: named(squire, "KNIGHT")}}, false},
+		{"renamed, keeping its slug", []AuditChange{{Before: &knight, After: named(knight, "Knight!")}}, true},
+		{"slug freed by the same change", []AuditChange{{Before: &knight}, {After: named(knight, "knight")}}, true},
+		{"two new figures on one slug", []AuditChange{{After: named(knight, "Page")}, {After: named(knight, "Page!")}}, false},
+	}
+	for _, test := range tests {
+		useTestRepository(t, knight, squire)
+		_, err := commitChanges(AuditEntry{Author: "boss", Changes: test.changes})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+	}
+}
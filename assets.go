@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Embedded copies of the templates, static assets and default dataset, so the
+// binary can run from any working directory. Each can be overridden by a path
+// on disk, which is handy while developing templates or the data file.
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+//go:embed figurechecklist.json
+var embeddedDatabase []byte
+
+//go:embed taxonomy.json
+var embeddedTaxonomy []byte
+
+// staticFS returns the static asset filesystem, from dir when one is given
+func staticFS(dir string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// Functions available to every page template
+var templateFuncs = template.FuncMap{
+	"asset": assetURL,
+	"image": imageURL,
+	"inc":   func(i int) int { return i + 1 },
+	//segment escapes a value for one path segment, slashes included
+	"segment": url.PathEscape,
+	"feature": func(name string) bool {
+		toggle, ok := config.Features.featureToggles()[name]
+		return ok && *toggle
+	},
+}
+
+// loadTemplates parses the page templates, from dir when one is given
+func loadTemplates(dir string) error {
+	fsys := staticFS(dir)
+	hash := sha256.New()
+	parse := func(name string) (*template.Template, error) {
+		raw, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		hash.Write(raw)
+		return template.New(name).Funcs(templateFuncs).Parse(string(raw))
+	}
+	var err error
+	if tpl, err = parse("index.html"); err != nil {
+		return err
+	}
+	if hometpl, err = parse("home.html"); err != nil {
+		return err
+	}
+	if detailtpl, err = parse("detail.html"); err != nil {
+		return err
+	}
+	if drilldowntpl, err = parse("drilldown.html"); err != nil {
+		return err
+	}
+	if comparetpl, err = parse("compare.html"); err != nil {
+		return err
+	}
+	if figuretpl, err = parse("figure.html"); err != nil {
+		return err
+	}
+	if searchestpl, err = parse("searches.html"); err != nil {
+		return err
+	}
+	if logintpl, err = parse("login.html"); err != nil {
+		return err
+	}
+	if accounttpl, err = parse("account.html"); err != nil {
+		return err
+	}
+	if collectiontpl, err = parse("collection.html"); err != nil {
+		return err
+	}
+	if profiletpl, err = parse("profile.html"); err != nil {
+		return err
+	}
+	if tradestpl, err = parse("trades.html"); err != nil {
+		return err
+	}
+	if ledgertpl, err = parse("ledger.html"); err != nil {
+		return err
+	}
+	if locationstpl, err = parse("locations.html"); err != nil {
+		return err
+	}
+	if labelstpl, err = parse("labels.html"); err != nil {
+		return err
+	}
+	if pledgestpl, err = parse("pledges.html"); err != nil {
+		return err
+	}
+	if pledgetpl, err = parse("pledge.html"); err != nil {
+		return err
+	}
+	if upcomingtpl, err = parse("upcoming.html"); err != nil {
+		return err
+	}
+	if unreleasedtpl, err = parse("unreleased.html"); err != nil {
+		return err
+	}
+	if adminreleasestpl, err = parse("adminreleases.html"); err != nil {
+		return err
+	}
+	if partstpl, err = parse("parts.html"); err != nil {
+		return err
+	}
+	if kitbashtpl, err = parse("kitbash.html"); err != nil {
+		return err
+	}
+	if recipetpl, err = parse("recipe.html"); err != nil {
+		return err
+	}
+	if changestpl, err = parse("changes.html"); err != nil {
+		return err
+	}
+	if admintpl, err = parse("admin.html"); err != nil {
+		return err
+	}
+	if adminfiguretpl, err = parse("adminfigure.html"); err != nil {
+		return err
+	}
+	if suggesttpl, err = parse("suggest.html"); err != nil {
+		return err
+	}
+	if proposalstpl, err = parse("proposals.html"); err != nil {
+		return err
+	}
+	if version := hex.EncodeToString(hash.Sum(nil)); version != templateVersion {
+		templateVersion = version
+		templatesChanged = time.Now()
+	}
+	return nil
+}
+
+// readDatabase returns the raw figure data, from path when one is given
+func readDatabase(path string) ([]byte, error) {
+	if path == "" {
+		return embeddedDatabase, nil
+	}
+	return ioutil.ReadFile(path)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gorilla/mux"
+)
+
+// Matches the variables in a route template, e.g. {race}
+var routeVar = regexp.MustCompile(`\{(\w+)\}`)
+
+// buildValues lists the values a route variable can take when crawling.
+// Facet variables are narrowed by the variables before them, so only
+// combinations that have figures are generated.
+var buildValues = map[string]func(chk Checklist) []string{
+	"races":    func(chk Checklist) []string { return groupNames(taxonomy["race"]) },
+	"factions": func(chk Checklist) []string { return groupNames(taxonomy["faction"]) },
+	"parttype": listedPartTypes,
+	"part":     partNames,
+	"figure": func(chk Checklist) []string {
+		var slugs []string
+		for _, figure := range chk.Figures {
+			slugs = append(slugs, figure.Slug())
+		}
+		return slugs
+	},
+}
+
+// buildNarrows narrows the figures by the value of a route variable that is
+// not a facet, for the variables after it
+var buildNarrows = map[string]func(chk Checklist, value string) Checklist{
+	"parttype": figuresWithPartType,
+}
+
+// groupNames lists the names of taxonomy groups in order
+func groupNames(groups map[string][]string) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// siteBuilder renders every page into a directory for static hosting
+type siteBuilder struct {
+	out     string
+	handler http.Handler
+	pages   []string
+	skipped []string
+	failed  []string
+}
+
+// buildCommand implements "legionsdex build"
+func buildCommand(args []string) int {
+	fs := flag.NewFlagSet("legionsdex build", flag.ContinueOnError)
+	out := fs.String("o", "dist", "directory to write the site to")
+	strict := fs.Bool("strict", false, "fail when the link check finds dead internal links")
+	startup(fs, args)
+	//A static site cannot take suggestions
+	config.Features.Suggest = false
+
+	router := mux.NewRouter().UseEncodedPath()
+	router.Use(decodeVars)
+	registerPages(router)
+	b := &siteBuilder{out: *out, handler: router}
+	if err := os.MkdirAll(b.out, 0755); err != nil {
+		fatal(exitConfig, "%v", err)
+	}
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		for _, page := range b.expand(tmpl) {
+			b.render(page)
+		}
+		return nil
+	})
+	if err == nil {
+		err = b.copyStatic()
+	}
+	if err == nil {
+		err = b.writeImages()
+	}
+	if err == nil {
+		err = b.writeData()
+	}
+	if err == nil {
+		err = b.writeSitemap(config.BaseURL)
+	}
+	if err != nil {
+		log.Printf("build failed: %v", err)
+		return exitServe
+	}
+	log.Printf("wrote %d pages to %s", len(b.pages), b.out)
+	for _, skipped := range b.skipped {
+		log.Printf("skipped %s", skipped)
+	}
+	for _, failed := range b.failed {
+		log.Printf("failed %s", failed)
+	}
+
+	dead, err := b.checkLinks()
+	if err != nil {
+		log.Printf("link check failed: %v", err)
+		return exitServe
+	}
+	for _, link := range SortMapByKeys(dead) {
+		log.Printf("dead link %s (on %d pages)", link, dead[link])
+	}
+	if len(b.failed) > 0 || (*strict && len(dead) > 0) {
+		return exitServe
+	}
+	return exitOK
+}
+
+// expand fills in a route template with every valid combination of values.
+// Pages are escaped paths, as pages link to them.
+func (b *siteBuilder) expand(tmpl string) []string {
+	names := routeVar.FindAllStringSubmatch(tmpl, -1)
+	var pages []string
+	var walk func(page string, chk Checklist, i int)
+	walk = func(page string, chk Checklist, i int) {
+		if i == len(names) {
+			pages = append(pages, page)
+			return
+		}
+		name := names[i][1]
+		values, narrows := b.values(name, chk)
+		if values == nil {
+			b.skipped = append(b.skipped, tmpl+": no values for {"+name+"}")
+			return
+		}
+		for _, value := range values {
+			next := chk
+			if narrows {
+				next = checklistByFacet(chk, name, value)
+			} else if narrow, exists := buildNarrows[name]; exists {
+				next = narrow(chk, value)
+			}
+			walk(strings.Replace(page, names[i][0], url.PathEscape(value), 1), next, i+1)
+		}
+	}
+	walk(tmpl, currentChecklist(), 0)
+	return pages
+}
+
+// values lists what a route variable can be, and whether it narrows the figures
+func (b *siteBuilder) values(name string, chk Checklist) ([]string, bool) {
+	for _, facet := range facetTypes {
+		if name == facet {
+			return SortMapByKeys(facetData(chk, name)), true
+		}
+	}
+	if list, exists := buildValues[name]; exists {
+		return list(chk), false
+	}
+	return nil, false
+}
+
+// render requests one page and writes the response under the output directory
+func (b *siteBuilder) render(page string) {
+	req := httptest.NewRequest(http.MethodGet, page, nil)
+	rec := httptest.NewRecorder()
+	b.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		b.failed = append(b.failed, fmt.Sprintf("%s: status %d", page, rec.Code))
+		return
+	}
+	file := outputFile(pagePath(page), rec.Header().Get("Content-Type"))
+	if err := b.write(file, rec.Body.Bytes()); err != nil {
+		b.failed = append(b.failed, fmt.Sprintf("%s: %v", page, err))
+		return
+	}
+	if strings.HasSuffix(file, ".html") {
+		b.pages = append(b.pages, page)
+	}
+}
+
+// pagePath unescapes a page to where its file goes. A value with a slash,
+// e.g. /role/PALADIN%2FCLERIC, ends up a directory deeper, which is where a
+// static host that decodes the link looks for it.
+func pagePath(page string) string {
+	if unescaped, err := url.PathUnescape(page); err == nil {
+		return unescaped
+	}
+	return page
+}
+
+// outputFile maps a page path to a file, e.g. /race/ELF to race/ELF/index.html
+func outputFile(page string, contentType string) string {
+	if strings.HasPrefix(contentType, "application/json") {
+		if strings.HasSuffix(page, "/") {
+			return page + "index.json"
+		}
+		if path.Ext(page) == "" {
+			return page + ".json"
+		}
+		return page
+	}
+	if path.Ext(page) != "" && !strings.HasPrefix(contentType, "text/html") {
+		return page
+	}
+	return path.Join(page, "index.html")
+}
+
+// write stores a file relative to the output directory
+func (b *siteBuilder) write(name string, data []byte) error {
+	file := filepath.Join(b.out, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// copyStatic copies the /static assets
+func (b *siteBuilder) copyStatic() error {
+	fsys := staticFS(config.StaticDir)
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		return b.write(path.Join("static", name), data)
+	})
+}
+
+// writeImages generates and copies every size of the figure pictures
+func (b *siteBuilder) writeImages() error {
+	for _, figure := range currentChecklist().Figures {
+		if !hasImage(figure) {
+			continue
+		}
+		for _, size := range imageSizes {
+			file, err := ensureImage(size, figure)
+			if err != nil {
+				b.failed = append(b.failed, fmt.Sprintf("image %s %s: %v", figure.Name, size.Name, err))
+				continue
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if err := b.write(imageURL(size.Name, figure), data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeData saves the merged figure data next to the pages
+func (b *siteBuilder) writeData() error {
+	data, err := json.MarshalIndent(currentChecklist(), "", "    ")
+	if err != nil {
+		return err
+	}
+	return b.write("figures.json", data)
+}
+
+// Sitemap format, see sitemaps.org
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// writeSitemap lists every HTML page in sitemap.xml
+func (b *siteBuilder) writeSitemap(baseURL string) error {
+	if baseURL == "" {
+		log.Printf("sitemap.xml uses relative URLs, set -base-url for absolute ones")
+	}
+	lastMod := pageLastModified(currentDatasetInfo()).Format("2006-01-02")
+	set := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	sort.Strings(b.pages)
+	for _, page := range b.pages {
+		loc := strings.TrimRight(baseURL, "/") + page
+		set.URLs = append(set.URLs, sitemapURL{Loc: loc, LastMod: lastMod})
+	}
+	data, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.write("sitemap.xml", append([]byte(xml.Header), data...))
+}
+
+// checkLinks finds internal links in the written pages that have no file behind them
+func (b *siteBuilder) checkLinks() (map[string]int, error) {
+	dead := make(map[string]int)
+	for _, page := range b.pages {
+		f, err := os.Open(filepath.Join(b.out, filepath.FromSlash(outputFile(pagePath(page), "text/html"))))
+		if err != nil {
+			return nil, err
+		}
+		doc, err := goquery.NewDocumentFromReader(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		doc.Find("a[href], link[href], img[src], script[src]").Each(func(i int, s *goquery.Selection) {
+			link, exists := s.Attr("href")
+			if !exists {
+				link, _ = s.Attr("src")
+			}
+			if !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") {
+				return
+			}
+			u, err := url.Parse(link)
+			if err != nil || !b.exists(u.Path) {
+				dead[link] += 1
+			}
+		})
+	}
+	return dead, nil
+}
+
+// exists reports whether a static host would find something at the path
+func (b *siteBuilder) exists(page string) bool {
+	file := filepath.Join(b.out, filepath.FromSlash(page))
+	info, err := os.Stat(file)
+	if err == nil && !info.IsDir() {
+		return true
+	}
+	_, err = os.Stat(filepath.Join(file, "index.html"))
+	return err == nil
+}
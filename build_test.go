@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSiteBuilderExpand(t *testing.T) {
+	useTestRepository(t,
+		Figure{Name: "Knight", Faction: "ORDER", Race: "HUMAN", Role: "KNIGHT", Parts: []Part{{Name: "Lion", Type: "shield"}}},
+		Figure{Name: "Cleric", Faction: "ORDER", Race: "HUMAN", Role: "PALADIN/CLERIC"},
+		Figure{Name: "Archer", Faction: "CHAOS", Race: "ELF", Role: "ARCHER", Parts: []Part{{Name: "Hood", Type: "helmet"}}},
+	)
+	tests := []struct {
+		tmpl    string
+		pages   []string
+		skipped bool
+	}{
+		{"/race/{race}", []string{"/race/ELF", "/race/HUMAN"}, false},
+		{"/faction/{faction}/role/{role}", []string{"/faction/CHAOS/role/ARCHER", "/faction/ORDER/role/KNIGHT", "/faction/ORDER/role/PALADIN%2FCLERIC"}, false},
+		{"/part/{parttype}/{part}", []string{"/part/helmet/Hood", "/part/shield/Lion"}, false},
+		{"/figure/{figure}", []string{"/figure/archer", "/figure/cleric", "/figure/knight"}, false},
+		{"/about", []string{"/about"}, false},
+		{"/thing/{thing}", nil, true},
+	}
+	for _, test := range tests {
+		b := &siteBuilder{}
+		if pages := b.expand(test.tmpl); !reflect.DeepEqual(pages, test.pages) {
+			t.Errorf("%s: got %v, want %v", test.tmpl, pages, test.pages)
+		}
+		if skipped := len(b.skipped) > 0; skipped != test.skipped {
+			t.Errorf("%s: skipped %v", test.tmpl, b.skipped)
+		}
+	}
+}
+
+func TestSiteBuilderCheckLinks(t *testing.T) {
+	b := &siteBuilder{out: t.TempDir()}
+	files := map[string]string{
+		"static/style.css":               "",
+		"role/PALADIN/CLERIC/index.html": "",
+		"race/ELF/index.html": `<link href="/static/style.css"><script src="/static/missing.js"></script>
+<a href="/race/ELF?sort=name">here</a> <a href="/role/PALADIN%2FCLERIC">escaped</a>
+<a href="/race/DWARF">gone</a> <a href="/race/DWARF">again</a> <img src="/images/none.png">
+<a href="https://example.com/">away</a> <a href="//example.com/x">away</a> <a href="relative">near</a>`,
+	}
+	for name, data := range files {
+		if err := b.write(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.pages = []string{"/race/ELF"}
+	dead, err := b.checkLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"/static/missing.js": 1, "/race/DWARF": 2, "/images/none.png": 1}
+	if !reflect.DeepEqual(dead, want) {
+		t.Errorf("dead links %v, want %v", dead, want)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long browsers may keep a fingerprinted /static asset
+const immutableMaxAge = "public, max-age=31536000, immutable"
+
+// Fallback for /static requests without a current fingerprint
+const staticMaxAge = "public, max-age=300"
+
+// Hash of the parsed page templates, part of every page ETag, and when it
+// last changed, which pages count as modified at
+var templateVersion string
+var templatesChanged time.Time
+
+// pageETag identifies a rendering of a page for the current data and templates
+func pageETag(info DatasetInfo, r *http.Request) string {
+	unreleased := "hide"
+	if showUnreleased(r) {
+		unreleased = "show"
+	}
+	sum := sha256.Sum256([]byte(info.Checksum + "\x00" + info.ReleasesChecksum + "\x00" + templateVersion + "\x00" + unreleased + "\x00" + r.URL.RequestURI()))
+	return `W/"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// pageLastModified is when the data or templates behind every page last
+// changed, so If-Modified-Since sees every change the ETag does
+func pageLastModified(info DatasetInfo) time.Time {
+	modified := info.ModTime
+	if modified.IsZero() {
+		modified = info.LoadedAt
+	}
+	if templatesChanged.After(modified) {
+		modified = templatesChanged
+	}
+	return modified.UTC().Truncate(time.Second)
+}
+
+// etagMatches reports whether an If-None-Match header lists the etag
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionalGet is mux middleware for pages rendered from the dataset. It sets
+// ETag and Last-Modified and answers conditional requests with 304.
+func conditionalGet(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info := currentDatasetInfo()
+		etag := pageETag(info, r)
+		modified := pageLastModified(info)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "public, no-cache")
+		//Pages leave out unreleased figures unless a cookie asks for them
+		w.Header().Add("Vary", "Cookie")
+
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			if etagMatches(inm, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Content types worth compressing
+var compressibleTypes = []string{"text/html", "application/json", "text/css", "text/plain", "text/xml", "application/xml", "application/atom+xml", "application/rss+xml", "image/svg+xml"}
+
+// gzipWriter compresses the response once it knows the content type allows it
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+// decide picks compression on the first header or body write
+func (g *gzipWriter) decide(status int, body []byte) {
+	if g.decided {
+		return
+	}
+	g.decided = true
+	h := g.Header()
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent || h.Get("Content-Encoding") != "" {
+		return
+	}
+	ctype := h.Get("Content-Type")
+	if ctype == "" && body != nil {
+		ctype = http.DetectContentType(body)
+		h.Set("Content-Type", ctype)
+	}
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(ctype, t) {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			g.gz = gzipPool.Get().(*gzip.Writer)
+			g.gz.Reset(g.ResponseWriter)
+			return
+		}
+	}
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	g.decide(status, nil)
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	g.decide(http.StatusOK, b)
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// close flushes the compressed stream
+func (g *gzipWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+		gzipPool.Put(g.gz)
+		g.gz = nil
+	}
+}
+
+// Reused compressors
+var gzipPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+
+// compress is mux middleware that gzips HTML, JSON and other text responses
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !config.Features.Gzip || r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether Accept-Encoding allows gzip, either by name or
+// through "*". A q value of 0 refuses it.
+func acceptsGzip(r *http.Request) bool {
+	star := false
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(enc, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				weight, err := strconv.ParseFloat(strings.TrimSpace(param[2:]), 64)
+				if err != nil {
+					weight = 0
+				}
+				q = weight
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "gzip":
+			return q > 0
+		case "*":
+			star = q > 0
+		}
+	}
+	return star
+}
+
+// Fingerprints of static assets, by file name
+var assetHashes = make(map[string]string)
+var assetHashesMu sync.Mutex
+
+// assetHash returns a short content hash of a static file, empty if missing.
+// Hashes of files on disk are not remembered, so edits show up at once.
+func assetHash(name string) string {
+	assetHashesMu.Lock()
+	defer assetHashesMu.Unlock()
+	if hash, exists := assetHashes[name]; exists && config.StaticDir == "" {
+		return hash
+	}
+	raw, err := fs.ReadFile(staticFS(config.StaticDir), name)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:6])
+	assetHashes[name] = hash
+	return hash
+}
+
+// assetURL is the template function giving the fingerprinted URL of a static file
+func assetURL(name string) string {
+	if hash := assetHash(name); hash != "" {
+		return "/static/" + name + "?v=" + hash
+	}
+	return "/static/" + name
+}
+
+// staticHandler serves /static, caching fingerprinted requests for a year
+func staticHandler() http.Handler {
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(staticFS(config.StaticDir))))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/static/")
+		if v := r.URL.Query().Get("v"); v != "" && v == assetHash(name) {
+			w.Header().Set("Cache-Control", immutableMaxAge)
+		} else {
+			w.Header().Set("Cache-Control", staticMaxAge)
+		}
+		files.ServeHTTP(w, r)
+	})
+}
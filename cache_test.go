@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip", true},
+		{"GZIP", true},
+		{"gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"gzip;q=bogus", false},
+		{"br, deflate", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"*, gzip;q=0", false},
+		{"gzip;q=0, *", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", test.header)
+		if got := acceptsGzip(r); got != test.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		etag   string
+		want   bool
+	}{
+		{`W/"abc"`, `W/"abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`"x", W/"abc"`, `W/"abc"`, true},
+		{`*`, `W/"abc"`, true},
+		{`"abd"`, `W/"abc"`, false},
+		{``, `W/"abc"`, false},
+	}
+	for _, test := range tests {
+		if got := etagMatches(test.header, test.etag); got != test.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", test.header, test.etag, got, test.want)
+		}
+	}
+}
+
+func TestConditionalGetIfModifiedSince(t *testing.T) {
+	datasetMu.Lock()
+	savedInfo := datasetInfo
+	datasetMu.Unlock()
+	savedChanged := templatesChanged
+	defer func() {
+		datasetMu.Lock()
+		datasetInfo = savedInfo
+		datasetMu.Unlock()
+		templatesChanged = savedChanged
+	}()
+
+	data := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		templates time.Time
+		since     time.Time
+		want      int
+	}{
+		{"unchanged", data.Add(-time.Hour), data, http.StatusNotModified},
+		{"data changed", data.Add(-time.Hour), data.Add(-time.Minute), http.StatusOK},
+		{"templates changed since", data.Add(time.Hour), data, http.StatusOK},
+		{"seen after the template change", data.Add(time.Hour), data.Add(2 * time.Hour), http.StatusNotModified},
+	}
+	handler := conditionalGet(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, test := range tests {
+		datasetMu.Lock()
+		datasetInfo = DatasetInfo{Loaded: true, Checksum: "a", ModTime: data}
+		datasetMu.Unlock()
+		templatesChanged = test.templates
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-Modified-Since", test.since.Format(http.TimeFormat))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestReloadKeepsLastModified(t *testing.T) {
+	datasetMu.Lock()
+	savedInfo := datasetInfo
+	datasetMu.Unlock()
+	defer func() {
+		datasetMu.Lock()
+		datasetInfo = savedInfo
+		datasetMu.Unlock()
+	}()
+	useTestRepository(t)
+	if err := loadDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	//A release edit moves Last-Modified on, and reloading the same data keeps it
+	release := Release{Name: "WAVE 1", Status: "pre-order"}
+	if err := repo.SaveRelease(release); err != nil {
+		t.Fatal(err)
+	}
+	releasesEdited()
+	edited := currentDatasetInfo().ModTime
+	if err := loadDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if modified := currentDatasetInfo().ModTime; modified.Before(edited) {
+		t.Errorf("reload took Last-Modified back from %v to %v", edited, modified)
+	}
+}
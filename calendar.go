@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Right hand side of every event UID, so events keep their identity
+// wherever and however often the calendar is generated
+const calendarDomain = "legionsdex"
+
+// Releases named like this are convention exclusives
+const conPrefix = "LEGIONSCON"
+
+// calendarEvent is one all-day VEVENT, before it is written out
+type calendarEvent struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	URL         string
+	Categories  []string
+	Status      string
+}
+
+// calendarDate reads a release date, which looks like 2006-01-02
+func calendarDate(value string) (time.Time, bool) {
+	date, err := time.Parse("2006-01-02", value)
+	return date, value != "" && err == nil
+}
+
+// releaseEvents lists the dated events of a release: its pre-order window,
+// its expected and actual ship dates, or for a con exclusive the day it is
+// available at the con
+func releaseEvents(base string, release Release, figures []string) []calendarEvent {
+	id := url.PathEscape(release.Name)
+	link := base + "/release/" + url.PathEscape(release.Name)
+	description := strings.Join(figures, "\n")
+	categories := []string{release.CampaignName()}
+	con := strings.HasPrefix(strings.ToUpper(release.Name), conPrefix)
+	if con {
+		categories = append(categories, "Con exclusive")
+	}
+	event := func(kind string, start time.Time, end time.Time, summary string, status string) calendarEvent {
+		return calendarEvent{
+			UID:         kind + "-" + id + "@" + calendarDomain,
+			Start:       start,
+			End:         end.AddDate(0, 0, 1),
+			Summary:     summary,
+			Description: description,
+			URL:         link,
+			Categories:  categories,
+			Status:      status,
+		}
+	}
+
+	var events []calendarEvent
+	if start, ok := calendarDate(release.PreorderStart); ok {
+		end, ok := calendarDate(release.PreorderEnd)
+		if !ok {
+			end = start
+		}
+		events = append(events, event("preorder", start, end, "Pre-order: "+release.Name, "CONFIRMED"))
+	}
+	if con {
+		//The con is where exclusives turn up, so that is the ship date
+		if day, ok := calendarDate(release.Shipped); ok {
+			events = append(events, event("con", day, day, "Con exclusive: "+release.Name, "CONFIRMED"))
+		} else if day, ok := calendarDate(release.ExpectedShip); ok {
+			events = append(events, event("con", day, day, "Con exclusive: "+release.Name, "TENTATIVE"))
+		}
+		return events
+	}
+	if day, ok := calendarDate(release.ExpectedShip); ok {
+		events = append(events, event("expected", day, day, "Expected to ship: "+release.Name, "TENTATIVE"))
+	}
+	if day, ok := calendarDate(release.Shipped); ok {
+		events = append(events, event("shipped", day, day, "Shipped: "+release.Name, "CONFIRMED"))
+	}
+	return events
+}
+
+// icsText escapes a TEXT value, see RFC 5545 section 3.3.11
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsLine folds a content line to 75 octets per line without splitting a
+// character, and ends it with CRLF, see RFC 5545 section 3.1
+func icsLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		//The leading space counts against the next line
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// writeCalendar renders events as an iCalendar object
+func writeCalendar(name string, stamp time.Time, events []calendarEvent) string {
+	var b strings.Builder
+	icsLine(&b, "BEGIN:VCALENDAR")
+	icsLine(&b, "VERSION:2.0")
+	icsLine(&b, "PRODID:-//LegionsDex//Release Calendar//EN")
+	icsLine(&b, "CALSCALE:GREGORIAN")
+	icsLine(&b, "METHOD:PUBLISH")
+	icsLine(&b, "X-WR-CALNAME:"+icsText(name))
+	for _, event := range events {
+		var categories []string
+		for _, category := range event.Categories {
+			categories = append(categories, icsText(category))
+		}
+		icsLine(&b, "BEGIN:VEVENT")
+		icsLine(&b, "UID:"+event.UID)
+		icsLine(&b, "DTSTAMP:"+stamp.UTC().Format("20060102T150405Z"))
+		icsLine(&b, "DTSTART;VALUE=DATE:"+event.Start.Format("20060102"))
+		icsLine(&b, "DTEND;VALUE=DATE:"+event.End.Format("20060102"))
+		icsLine(&b, "SUMMARY:"+icsText(event.Summary))
+		if event.Description != "" {
+			icsLine(&b, "DESCRIPTION:"+icsText(event.Description))
+		}
+		icsLine(&b, "URL:"+event.URL)
+		icsLine(&b, "CATEGORIES:"+strings.Join(categories, ","))
+		icsLine(&b, "STATUS:"+event.Status)
+		icsLine(&b, "TRANSP:TRANSPARENT")
+		icsLine(&b, "END:VEVENT")
+	}
+	icsLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// savedSearch finds a saved search by its id
+func savedSearch(id string) (SavedSearch, bool, error) {
+	var searches []SavedSearch
+	if err := readDocument(searchesDocument, &searches); err != nil {
+		return SavedSearch{}, false, err
+	}
+	for _, search := range searches {
+		if search.ID == id {
+			return search, true, nil
+		}
+	}
+	return SavedSearch{}, false, nil
+}
+
+// Calendar of release dates, optionally for one faction, one release or the
+// figures of a saved search. Saved search ids are unguessable, so a calendar
+// app can subscribe to one without signing in. Upcoming dates are the point
+// of a calendar, so it always has unreleased figures.
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	filter := Filter{}
+	name := "LegionsDex releases"
+	for _, searchType := range []string{"faction", "release"} {
+		if value := r.FormValue(searchType); value != "" {
+			filter[searchType] = value
+			name += ": " + value
+		}
+	}
+	checklist, err := repo.Figures(filter)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if id := r.FormValue("search"); id != "" {
+		search, found, err := savedSearch(id)
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		checklist = checklistBySearch(checklist, search)
+		name += ": " + search.Name
+	}
+	//Which of the wanted figures each release has
+	figures := make(map[string][]string)
+	for _, figure := range checklist.Figures {
+		for _, release := range figure.Release {
+			figures[release] = append(figures[release], figure.Name)
+		}
+	}
+	releases, err := repo.Releases()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	base := siteURL(r)
+	var events []calendarEvent
+	for _, release := range releases {
+		if len(figures[release.Name]) == 0 {
+			continue
+		}
+		sort.Strings(figures[release.Name])
+		events = append(events, releaseEvents(base, release, figures[release.Name])...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	fmt.Fprint(w, writeCalendar(name, pageLastModified(currentDatasetInfo()), events))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestICSText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Wave 1", "Wave 1"},
+		{"Knight, Squire; Page", `Knight\, Squire\; Page`},
+		{`C:\figures`, `C:\\figures`},
+		{"Knight\nSquire", `Knight\nSquire`},
+		{"Knight\r\nSquire", `Knight\nSquire`},
+	}
+	for _, test := range tests {
+		if got := icsText(test.in); got != test.want {
+			t.Errorf("icsText(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestICSLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		lines int
+	}{
+		{"short", "SUMMARY:Wave 1", 1},
+		{"exactly 75 octets", strings.Repeat("a", 75), 1},
+		{"76 octets", strings.Repeat("a", 76), 2},
+		{"continuations hold 74 octets", strings.Repeat("a", 75+74), 2},
+		{"one more octet", strings.Repeat("a", 75+74+1), 3},
+		{"multibyte runes", "SUMMARY:" + strings.Repeat("é", 60), 2},
+		{"rune across the limit", strings.Repeat("a", 74) + "€" + strings.Repeat("a", 10), 2},
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		icsLine(&b, test.line)
+		out := b.String()
+		if !strings.HasSuffix(out, "\r\n") {
+			t.Errorf("%s: %q does not end with CRLF", test.name, out)
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+		if len(lines) != test.lines {
+			t.Errorf("%s: folded into %d lines, want %d", test.name, len(lines), test.lines)
+		}
+		var unfolded strings.Builder
+		for i, line := range lines {
+			if len(line) > 75 {
+				t.Errorf("%s: line %d is %d octets", test.name, i, len(line))
+			}
+			if !utf8.ValidString(line) {
+				t.Errorf("%s: line %d splits a character", test.name, i)
+			}
+			if i > 0 {
+				if !strings.HasPrefix(line, " ") {
+					t.Errorf("%s: continuation line %d does not start with a space", test.name, i)
+				}
+				line = line[1:]
+			}
+			unfolded.WriteString(line)
+		}
+		if unfolded.String() != test.line {
+			t.Errorf("%s: unfolds to %q", test.name, unfolded.String())
+		}
+	}
+}
+
+func TestWriteCalendar(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	events := []calendarEvent{{
+		UID:         "preorder-Wave%201@legionsdex",
+		Start:       start,
+		End:         start.AddDate(0, 0, 1),
+		Summary:     "Pre-order: Wave 1",
+		Description: "Knight\nSquire",
+		URL:         "https://example.com/release/Wave%201",
+		Categories:  []string{"Wave, one", "Con exclusive"},
+		Status:      "CONFIRMED",
+	}}
+	got := writeCalendar("Releases", time.Date(2024, 2, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600)), events)
+	want := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//LegionsDex//Release Calendar//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:Releases",
+		"BEGIN:VEVENT",
+		"UID:preorder-Wave%201@legionsdex",
+		"DTSTAMP:20240201T113000Z",
+		"DTSTART;VALUE=DATE:20240301",
+		"DTEND;VALUE=DATE:20240302",
+		"SUMMARY:Pre-order: Wave 1",
+		`DESCRIPTION:Knight\nSquire`,
+		"URL:https://example.com/release/Wave%201",
+		`CATEGORIES:Wave\, one,Con exclusive`,
+		"STATUS:CONFIRMED",
+		"TRANSP:TRANSPARENT",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n") + "\r\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCalendarHandler(t *testing.T) {
+	useTestRepository(t, Figure{Name: "Knight", Faction: "ORDER", Release: []string{"WAVE 9"}})
+	release, err := repo.Release("WAVE 9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release.Status = "pre-order"
+	release.PreorderStart = "2026-11-01"
+	release.ExpectedShip = "2027-03-01"
+	if err := repo.SaveRelease(release); err != nil {
+		t.Fatal(err)
+	}
+	//Calendar apps send no cookie and no flag, and still get unreleased figures
+	for _, target := range []string{"/calendar.ics", "/calendar.ics?release=WAVE+9", "/calendar.ics?faction=ORDER"} {
+		w := httptest.NewRecorder()
+		calendarHandler(w, httptest.NewRequest("GET", target, nil))
+		body := w.Body.String()
+		if !strings.Contains(body, "SUMMARY:Pre-order: WAVE 9") || !strings.Contains(body, "SUMMARY:Expected to ship: WAVE 9") {
+			t.Errorf("%s: events missing from\n%s", target, body)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Stored history of dataset versions; each version's figures are kept in snapshots/
+const changesDocument = "changes.json"
+
+// Most entries in a feed
+const feedLength = 50
+
+// DatasetVersion is one loaded dataset and how it differs from the one before it
+type DatasetVersion struct {
+	Checksum string         `json:"checksum"`
+	Recorded time.Time      `json:"recorded"`
+	Figures  int            `json:"figures"`
+	Initial  bool           `json:"initial,omitempty"`
+	Changes  []FigureChange `json:"changes,omitempty"`
+	Releases []string       `json:"new_releases,omitempty"`
+}
+
+// FigureChange is a figure added, removed or edited between two versions
+type FigureChange struct {
+	Figure Figure        `json:"figure"`
+	Kind   string        `json:"kind"`
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange is one edited field of a figure
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// Data for the changes page
+type ChangesPageData struct {
+	Title    string
+	Versions []DatasetVersion
+}
+
+// Short form of a version checksum, used in anchors and feed ids
+func (version DatasetVersion) ID() string {
+	if len(version.Checksum) > 12 {
+		return version.Checksum[:12]
+	}
+	return version.Checksum
+}
+
+// Count of changes of one kind
+func (version DatasetVersion) Count(kind string) int {
+	count := 0
+	for _, change := range version.Changes {
+		if change.Kind == kind {
+			count += 1
+		}
+	}
+	return count
+}
+
+// snapshotDocument is where the figures of a version are kept
+func snapshotDocument(checksum string) string {
+	return path.Join("snapshots", checksum+".json")
+}
+
+// figureFields lists the fields compared between versions
+func figureFields(figure Figure) map[string]string {
+	return map[string]string{
+		"faction":  figure.Faction,
+		"race":     figure.Race,
+		"role":     figure.Role,
+		"released": strings.Join(figure.Release, ", "),
+		"url":      figure.Url,
+		"scale":    figure.Scale,
+		"image":    figure.Image,
+		"parts":    strings.Replace(partsText(figure.Parts), "\n", "; ", -1),
+	}
+}
+
+// Field order for edited figures
+var figureFieldOrder = []string{"faction", "race", "role", "released", "scale", "url", "image", "parts"}
+
+// diffChecklists lists the figures added, removed and edited from one version to the next
+func diffChecklists(before Checklist, after Checklist) []FigureChange {
+	var changes []FigureChange
+	old := make(map[string]Figure)
+	for _, figure := range before.Figures {
+		old[figure.Name] = figure
+	}
+	current := make(map[string]bool)
+	for _, figure := range sortChecklist(after).Figures {
+		current[figure.Name] = true
+		previous, exists := old[figure.Name]
+		if !exists {
+			changes = append(changes, FigureChange{Figure: figure, Kind: "added"})
+			continue
+		}
+		was, is := figureFields(previous), figureFields(figure)
+		var fields []FieldChange
+		for _, field := range figureFieldOrder {
+			if was[field] != is[field] {
+				fields = append(fields, FieldChange{Field: field, Before: was[field], After: is[field]})
+			}
+		}
+		if len(fields) > 0 {
+			changes = append(changes, FigureChange{Figure: figure, Kind: "changed", Fields: fields})
+		}
+	}
+	for _, figure := range sortChecklist(before).Figures {
+		if !current[figure.Name] {
+			changes = append(changes, FigureChange{Figure: figure, Kind: "removed"})
+		}
+	}
+	return changes
+}
+
+// newReleases lists the release values found in one version but not the one before
+func newReleases(before Checklist, after Checklist) []string {
+	old := releaseData(before)
+	found := make(map[string]int)
+	for value, count := range releaseData(after) {
+		if _, exists := old[value]; !exists {
+			found[value] = count
+		}
+	}
+	return SortMapByKeys(found)
+}
+
+// recordChanges keeps a snapshot of newly loaded figures and, when they differ
+// from the last recorded version, adds the differences to the history
+func recordChanges(lst Checklist, info DatasetInfo) {
+	if !config.Features.Changes {
+		return
+	}
+	var versions []DatasetVersion
+	err := updateDocument(changesDocument, &versions, func() error {
+		version := DatasetVersion{Checksum: info.Checksum, Recorded: time.Now(), Figures: len(lst.Figures)}
+		if len(versions) == 0 {
+			version.Initial = true
+		} else {
+			last := versions[len(versions)-1]
+			if last.Checksum == info.Checksum {
+				return nil
+			}
+			var previous Checklist
+			if err := repo.LoadDocument(snapshotDocument(last.Checksum), &previous); err != nil {
+				return err
+			}
+			version.Changes = diffChecklists(previous, lst)
+			version.Releases = newReleases(previous, lst)
+		}
+		if err := repo.SaveDocument(snapshotDocument(info.Checksum), lst); err != nil {
+			return err
+		}
+		versions = append(versions, version)
+		log.Printf("recorded dataset version %s with %d changes", version.ID(), len(version.Changes))
+		return nil
+	})
+	if err != nil {
+		log.Printf("changes: %v", err)
+	}
+}
+
+// datasetVersions lists the recorded versions, newest first
+func datasetVersions() []DatasetVersion {
+	var versions []DatasetVersion
+	if err := readDocument(changesDocument, &versions); err != nil {
+		log.Printf("changes: %v", err)
+	}
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions
+}
+
+// Page listing what changed in each dataset version
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	var pagedata ChangesPageData
+	pagedata.Title = "What's New"
+	pagedata.Versions = datasetVersions()
+	renderTemplate(w, changestpl, pagedata)
+}
+
+// siteURL is the public address of the site, from the config or else the request
+func siteURL(r *http.Request) string {
+	if config.BaseURL != "" {
+		return strings.TrimRight(config.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// feedEntry is one item of a feed, before it is written as Atom or RSS
+type feedEntry struct {
+	Title   string
+	Link    string
+	ID      string
+	Updated time.Time
+	Summary string
+}
+
+// figureFeedEntries lists the figures added in recent versions, newest first
+func figureFeedEntries(base string) []feedEntry {
+	var entries []feedEntry
+	for _, version := range datasetVersions() {
+		for _, change := range version.Changes {
+			if change.Kind != "added" {
+				continue
+			}
+			figure := change.Figure
+			entries = append(entries, feedEntry{
+				Title:   figure.Name,
+				Link:    base + "/figure/" + figure.Slug(),
+				ID:      base + "/changes#" + version.ID() + "-" + figure.Slug(),
+				Updated: version.Recorded,
+				Summary: figure.Race + " " + figure.Role + ", " + figure.Faction + ". Released in " + strings.Join(figure.Release, ", ") + ".",
+			})
+		}
+	}
+	if len(entries) > feedLength {
+		entries = entries[:feedLength]
+	}
+	return entries
+}
+
+// releaseFeedEntries lists the releases first seen in recent versions, newest first
+func releaseFeedEntries(base string) []feedEntry {
+	var entries []feedEntry
+	for _, version := range datasetVersions() {
+		for _, release := range version.Releases {
+			var names []string
+			for _, change := range version.Changes {
+				for _, value := range change.Figure.Release {
+					if value == release && change.Kind != "removed" {
+						names = append(names, change.Figure.Name)
+					}
+				}
+			}
+			entries = append(entries, feedEntry{
+				Title:   release,
+				Link:    base + "/release/" + url.PathEscape(release),
+				ID:      base + "/changes#" + version.ID() + "-release-" + url.PathEscape(release),
+				Updated: version.Recorded,
+				Summary: strings.Join(names, ", "),
+			})
+		}
+	}
+	if len(entries) > feedLength {
+		entries = entries[:feedLength]
+	}
+	return entries
+}
+
+// Atom feed format, see RFC 4287
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Link    atomLink   `xml:"link"`
+	Summary string     `xml:"summary,omitempty"`
+	Author  atomAuthor `xml:"author"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// RSS 2.0 feed format
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// writeFeed sends entries as an Atom or RSS feed, depending on the requested extension
+func writeFeed(w http.ResponseWriter, r *http.Request, title string, entries []feedEntry) {
+	base := siteURL(r)
+	updated := currentDatasetInfo().LoadedAt
+	if len(entries) > 0 {
+		updated = entries[0].Updated
+	}
+	var doc interface{}
+	if path.Ext(r.URL.Path) == ".rss" {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		feed := rssFeed{Version: "2.0", Channel: rssChannel{
+			Title:         "LegionsDex: " + title,
+			Link:          base + "/changes",
+			Description:   title + " in the LegionsDex checklist",
+			LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+		}}
+		for _, entry := range entries {
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:       entry.Title,
+				Link:        entry.Link,
+				GUID:        rssGUID{Value: entry.ID},
+				PubDate:     entry.Updated.UTC().Format(time.RFC1123Z),
+				Description: entry.Summary,
+			})
+		}
+		doc = feed
+	} else {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		feed := atomFeed{
+			Xmlns:   "http://www.w3.org/2005/Atom",
+			Title:   "LegionsDex: " + title,
+			ID:      base + r.URL.Path,
+			Updated: updated.UTC().Format(time.RFC3339),
+			Links:   []atomLink{{Rel: "self", Href: base + r.URL.Path}, {Rel: "alternate", Href: base + "/changes"}},
+		}
+		for _, entry := range entries {
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:   entry.Title,
+				ID:      entry.ID,
+				Updated: entry.Updated.UTC().Format(time.RFC3339),
+				Link:    atomLink{Rel: "alternate", Href: entry.Link},
+				Summary: entry.Summary,
+				Author:  atomAuthor{Name: "LegionsDex"},
+			})
+		}
+		doc = feed
+	}
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Printf("feed: %v", err)
+	}
+}
+
+// Feed of newly added figures
+func figureFeedHandler(w http.ResponseWriter, r *http.Request) {
+	writeFeed(w, r, "New Figures", figureFeedEntries(siteURL(r)))
+}
+
+// Feed of newly seen releases
+func releaseFeedHandler(w http.ResponseWriter, r *http.Request) {
+	writeFeed(w, r, "New Releases", releaseFeedEntries(siteURL(r)))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffChecklists(t *testing.T) {
+	knight := Figure{Name: "Knight", Faction: "Order", Race: "Human", Release: []string{"Wave 1"}}
+	squire := Figure{Name: "Squire", Faction: "Order", Race: "Human"}
+	moved := knight
+	moved.Faction = "Chaos"
+	moved.Release = []string{"Wave 1", "Wave 2"}
+	tests := []struct {
+		name    string
+		before  []Figure
+		after   []Figure
+		changes []FigureChange
+	}{
+		{"unchanged", []Figure{knight}, []Figure{knight}, nil},
+		{"added", []Figure{knight}, []Figure{squire, knight}, []FigureChange{{Figure: squire, Kind: "added"}}},
+		{"removed", []Figure{knight, squire}, []Figure{knight}, []FigureChange{{Figure: squire, Kind: "removed"}}},
+		{"edited fields in order", []Figure{knight}, []Figure{moved}, []FigureChange{{Figure: moved, Kind: "changed", Fields: []FieldChange{
+			{Field: "faction", Before: "Order", After: "Chaos"},
+			{Field: "released", Before: "Wave 1", After: "Wave 1, Wave 2"},
+		}}}},
+		{"renamed is removed and added", []Figure{squire}, []Figure{{Name: "Page", Faction: "Order", Race: "Human"}}, []FigureChange{
+			{Figure: Figure{Name: "Page", Faction: "Order", Race: "Human"}, Kind: "added"},
+			{Figure: squire, Kind: "removed"},
+		}},
+	}
+	for _, test := range tests {
+		changes := diffChecklists(Checklist{Figures: test.before}, Checklist{Figures: test.after})
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: got %+v", test.name, changes)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Stored document of every account's collection
+const collectionsDocument = "collections.json"
+
+// Statuses a figure can have in a collection
+var collectionStatuses = []string{"owned", "wanted", "for_trade"}
+
+// Collection is the figures an account owns, wants and has spare to trade.
+// A spare is owned as well, so it counts towards completion while it is
+// offered for trade.
+type Collection struct {
+	User     string   `json:"user"`
+	Public   bool     `json:"public"`
+	Owned    []string `json:"owned"`
+	Wanted   []string `json:"wanted"`
+	ForTrade []string `json:"for_trade"`
+	//What the owner reckons figures are worth, for balancing trades
+	Values map[string]float64 `json:"values,omitempty"`
+	//Which bin or shelf owned figures are kept in
+	Locations map[string]string `json:"locations,omitempty"`
+	Updated   time.Time         `json:"updated"`
+}
+
+// Status says whether figure is owned with a spare for trade, owned, wanted
+// or neither
+func (collection Collection) Status(figure string) string {
+	if containsString(collection.ForTrade, figure) {
+		return "for_trade"
+	}
+	if containsString(collection.Owned, figure) {
+		return "owned"
+	}
+	if containsString(collection.Wanted, figure) {
+		return "wanted"
+	}
+	return ""
+}
+
+// addString adds s to a sorted list unless it is there
+func addString(list []string, s string) []string {
+	if containsString(list, s) {
+		return list
+	}
+	list = append(list, s)
+	sort.Strings(list)
+	return list
+}
+
+// setStatus puts figure on the lists for status: "for_trade" keeps it owned
+// and offers a spare, "owned" withdraws the spare, and "" takes it off them all
+func (collection *Collection) setStatus(figure string, status string) {
+	collection.Wanted = removeString(collection.Wanted, figure)
+	if status != "for_trade" {
+		collection.ForTrade = removeString(collection.ForTrade, figure)
+	}
+	if status != "owned" && status != "for_trade" {
+		collection.Owned = removeString(collection.Owned, figure)
+	}
+	switch status {
+	case "owned":
+		collection.Owned = addString(collection.Owned, figure)
+	case "wanted":
+		collection.Wanted = addString(collection.Wanted, figure)
+	case "for_trade":
+		collection.Owned = addString(collection.Owned, figure)
+		collection.ForTrade = addString(collection.ForTrade, figure)
+	case "":
+		delete(collection.Values, figure)
+	}
+	//Only figures on hand are stored anywhere
+	if status != "owned" && status != "for_trade" {
+		delete(collection.Locations, figure)
+	}
+	collection.Updated = time.Now()
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	kept := list[:0]
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// userCollection loads an account's collection, empty if it has none yet
+func userCollection(user string) (Collection, error) {
+	var collections map[string]*Collection
+	if err := readDocument(collectionsDocument, &collections); err != nil {
+		return Collection{}, err
+	}
+	if collection, exists := collections[accountKey(user)]; exists {
+		collection.ownSpares()
+		return *collection, nil
+	}
+	return Collection{User: user}, nil
+}
+
+// ownSpares adds figures for trade to the owned ones, which collections saved
+// before spares counted as owned left out
+func (collection *Collection) ownSpares() {
+	for _, figure := range collection.ForTrade {
+		collection.Owned = addString(collection.Owned, figure)
+	}
+}
+
+// updateCollection changes an account's collection
+func updateCollection(user string, change func(collection *Collection) error) error {
+	var collections map[string]*Collection
+	return updateDocument(collectionsDocument, &collections, func() error {
+		if collections == nil {
+			collections = make(map[string]*Collection)
+		}
+		collection, exists := collections[accountKey(user)]
+		if !exists {
+			collection = &Collection{User: user}
+			collections[accountKey(user)] = collection
+		}
+		collection.ownSpares()
+		return change(collection)
+	})
+}
+
+// collectionChecklist picks the figures named in list out of lst
+func collectionChecklist(lst Checklist, list []string) Checklist {
+	var chk Checklist
+	for _, figure := range lst.Figures {
+		if containsString(list, figure.Name) {
+			chk.AddItem(figure)
+		}
+	}
+	return chk
+}
+
+// FacetBreakdown counts a checklist's figures by one facet type
+type FacetBreakdown struct {
+	Type   string
+	Counts map[string]int
+	Sorted []string
+}
+
+// Completion is how much of a release or faction a collection owns
+type Completion struct {
+	Type    string
+	Value   string
+	Owned   int
+	Total   int
+	Percent int
+	Missing []Figure
+}
+
+// facetBreakdowns counts lst by every facet type, as the detail pages do
+func facetBreakdowns(lst Checklist) []FacetBreakdown {
+	var breakdowns []FacetBreakdown
+	for _, searchType := range facetTypes {
+		counts := facetData(lst, searchType)
+		breakdowns = append(breakdowns, FacetBreakdown{searchType, counts, SortMapByValueThenKey(counts)})
+	}
+	return breakdowns
+}
+
+// completions works out, for every value of searchType the owned figures have,
+// how many of its figures are owned and which are missing
+func completions(checklist Checklist, owned Checklist, searchType string) []Completion {
+	totals := facetData(checklist, searchType)
+	ownedCounts := facetData(owned, searchType)
+	ownedNames := figureNames(owned)
+	var result []Completion
+	for _, value := range SortMapByValueThenKey(ownedCounts) {
+		completion := Completion{Type: searchType, Value: value, Owned: ownedCounts[value], Total: totals[value]}
+		if completion.Total > 0 {
+			completion.Percent = completion.Owned * 100 / completion.Total
+		}
+		for _, figure := range checklist.Figures {
+			if containsString(facetValues(figure, searchType), value) && !containsString(ownedNames, figure.Name) {
+				completion.Missing = append(completion.Missing, figure)
+			}
+		}
+		result = append(result, completion)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Percent > result[j].Percent
+	})
+	return result
+}
+
+// Data for the page managing the caller's collection
+type CollectionPageData struct {
+	Title     string
+	User      string
+	CSRF      string
+	Public    bool
+	Owned     Checklist
+	Wanted    Checklist
+	ForTrade  Checklist
+	Values    map[string]float64
+	Checklist Checklist
+}
+
+// Data for a public profile
+type ProfilePageData struct {
+	Title      string
+	User       string
+	Owned      Checklist
+	Wanted     Checklist
+	ForTrade   Checklist
+	Breakdowns []FacetBreakdown
+	Releases   []Completion
+	Factions   []Completion
+}
+
+// Page managing the caller's collection
+func collectionHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	collection, err := userCollection(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata CollectionPageData
+	pagedata.Title = "Your Collection"
+	pagedata.User = requestUser(r)
+	pagedata.CSRF = requestCSRF(r)
+	pagedata.Public = collection.Public
+	pagedata.Owned = collectionChecklist(checklist, collection.Owned)
+	pagedata.Wanted = collectionChecklist(checklist, collection.Wanted)
+	pagedata.ForTrade = collectionChecklist(checklist, collection.ForTrade)
+	pagedata.Values = collection.Values
+	pagedata.Checklist = checklist
+	renderTemplate(w, collectiontpl, pagedata)
+}
+
+// CollectionChange sets the status, and optionally the value, of one figure in a collection
+type CollectionChange struct {
+	Figure string   `json:"figure"`
+	Status string   `json:"status"`
+	Value  *float64 `json:"value,omitempty"`
+}
+
+// Sets a figure owned, wanted or neither, from the page form or a JSON body
+func setCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	var change CollectionChange
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		change.Figure = strings.TrimSpace(r.FormValue("figure"))
+		change.Status = r.FormValue("status")
+		if value := strings.TrimSpace(r.FormValue("value")); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				http.Error(w, "value must be a number", http.StatusBadRequest)
+				return
+			}
+			change.Value = &parsed
+		}
+	}
+	if change.Value != nil && (*change.Value < 0 || math.IsNaN(*change.Value) || math.IsInf(*change.Value, 0)) {
+		http.Error(w, "value cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if change.Status != "" && !containsString(collectionStatuses, change.Status) {
+		http.Error(w, fmt.Sprintf("status must be one of %s or empty", strings.Join(collectionStatuses, ", ")), http.StatusBadRequest)
+		return
+	}
+	if _, err := repo.Figure(change.Figure); err != nil {
+		if err == ErrNotFound {
+			http.Error(w, "no figure named "+change.Figure, http.StatusBadRequest)
+			return
+		}
+		storageError(w, err)
+		return
+	}
+	var updated Collection
+	err := updateCollection(requestUser(r), func(collection *Collection) error {
+		collection.setStatus(change.Figure, change.Status)
+		if change.Value != nil && change.Status != "" {
+			if collection.Values == nil {
+				collection.Values = make(map[string]float64)
+			}
+			collection.Values[change.Figure] = *change.Value
+		}
+		updated = *collection
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, updated)
+		return
+	}
+	http.Redirect(w, r, "/collection", http.StatusSeeOther)
+}
+
+// Shows or hides the caller's public profile
+func collectionVisibilityHandler(w http.ResponseWriter, r *http.Request) {
+	err := updateCollection(requestUser(r), func(collection *Collection) error {
+		collection.Public = r.FormValue("public") == "on"
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/collection", http.StatusSeeOther)
+}
+
+// API returning the caller's collection
+func collectionAPIHandler(w http.ResponseWriter, r *http.Request) {
+	collection, err := userCollection(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	writeJSON(w, collection)
+}
+
+// Public profile of a collection its owner chose to share
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	collection, err := userCollection(mux.Vars(r)["name"])
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	//Unshared collections look just like missing accounts
+	if !collection.Public {
+		http.NotFound(w, r)
+		return
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata ProfilePageData
+	pagedata.Title = collection.User + "'s Collection"
+	pagedata.User = collection.User
+	pagedata.Owned = collectionChecklist(checklist, collection.Owned)
+	pagedata.Wanted = collectionChecklist(checklist, collection.Wanted)
+	pagedata.ForTrade = collectionChecklist(checklist, collection.ForTrade)
+	pagedata.Breakdowns = facetBreakdowns(pagedata.Owned)
+	pagedata.Releases = completions(checklist, pagedata.Owned, "release")
+	pagedata.Factions = completions(checklist, pagedata.Owned, "faction")
+	w.Header().Set("Cache-Control", "no-cache")
+	renderTemplate(w, profiletpl, pagedata)
+}
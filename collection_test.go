@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    Collection
+		status   string
+		owned    []string
+		wanted   []string
+		forTrade []string
+	}{
+		{"own", Collection{}, "owned", []string{"Knight"}, nil, nil},
+		{"want", Collection{Owned: []string{"Knight"}}, "wanted", nil, []string{"Knight"}, nil},
+		{"spare stays owned", Collection{Owned: []string{"Knight"}}, "for_trade", []string{"Knight"}, nil, []string{"Knight"}},
+		{"spare of a wanted figure", Collection{Wanted: []string{"Knight"}}, "for_trade", []string{"Knight"}, nil, []string{"Knight"}},
+		{"withdraw the spare", Collection{Owned: []string{"Knight"}, ForTrade: []string{"Knight"}}, "owned", []string{"Knight"}, nil, nil},
+		{"remove", Collection{Owned: []string{"Knight"}, ForTrade: []string{"Knight"}}, "", nil, nil, nil},
+		{"others untouched", Collection{Owned: []string{"Squire"}, ForTrade: []string{"Squire"}}, "wanted", []string{"Squire"}, []string{"Knight"}, []string{"Squire"}},
+	}
+	for _, test := range tests {
+		collection := test.start
+		collection.setStatus("Knight", test.status)
+		if len(collection.Owned) == 0 {
+			collection.Owned = nil
+		}
+		if len(collection.Wanted) == 0 {
+			collection.Wanted = nil
+		}
+		if len(collection.ForTrade) == 0 {
+			collection.ForTrade = nil
+		}
+		if !reflect.DeepEqual(collection.Owned, test.owned) || !reflect.DeepEqual(collection.Wanted, test.wanted) || !reflect.DeepEqual(collection.ForTrade, test.forTrade) {
+			t.Errorf("%s: owned %v, wanted %v, for trade %v", test.name, collection.Owned, collection.Wanted, collection.ForTrade)
+		}
+		if status := collection.Status("Knight"); status != test.status {
+			t.Errorf("%s: status %q, want %q", test.name, status, test.status)
+		}
+	}
+}
+
+func TestCompletionsCountSpares(t *testing.T) {
+	checklist := Checklist{Figures: []Figure{
+		{Name: "Knight", Release: []string{"WAVE 1"}},
+		{Name: "Squire", Release: []string{"WAVE 1"}},
+	}}
+	collection := Collection{ForTrade: []string{"Knight"}}
+	collection.ownSpares()
+	result := completions(checklist, collectionChecklist(checklist, collection.Owned), "release")
+	if len(result) != 1 || result[0].Owned != 1 || result[0].Percent != 50 || len(result[0].Missing) != 1 || result[0].Missing[0].Name != "Squire" {
+		t.Errorf("completions = %+v, want the spare counted as owned", result)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CompareColumn is one facet value being compared
+type CompareColumn struct {
+	Type      string    `json:"type"`
+	Value     string    `json:"value"`
+	Total     int       `json:"total"`
+	Checklist Checklist `json:"-"`
+}
+
+// CompareRow is one value of a breakdown, with its count in each column
+type CompareRow struct {
+	Value  string `json:"value"`
+	Counts []int  `json:"counts"`
+	Shared bool   `json:"shared"`
+	Unique bool   `json:"unique"`
+}
+
+// CompareSection aligns one breakdown, e.g. roles, across the columns
+type CompareSection struct {
+	Type string       `json:"type"`
+	Rows []CompareRow `json:"rows"`
+}
+
+// CompareOverlap is a figure found in more than one column
+type CompareOverlap struct {
+	Figure  Figure `json:"figure"`
+	Columns []int  `json:"columns"`
+}
+
+// Data for the comparison page and API
+type ComparePageData struct {
+	Title      string           `json:"title"`
+	Columns    []CompareColumn  `json:"columns"`
+	Sections   []CompareSection `json:"sections"`
+	Overlaps   []CompareOverlap `json:"overlaps"`
+	FacetTypes []string         `json:"-"`
+	Values     []string         `json:"-"`
+}
+
+// Breakdowns shown side by side, in page order
+var compareSections = []string{"role", "race", "scale", "release", "faction"}
+
+// compareSelections reads facet=value pairs from a query string, keeping their order.
+// A type=facet&value=... pair, as sent by the page's add form, works too.
+func compareSelections(rawQuery string) []CompareColumn {
+	var columns []CompareColumn
+	pendingType := ""
+	for _, pair := range strings.Split(rawQuery, "&") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, err1 := url.QueryUnescape(kv[0])
+		value, err2 := url.QueryUnescape(kv[1])
+		if err1 != nil || err2 != nil || value == "" {
+			continue
+		}
+		switch key {
+		case "type":
+			pendingType = value
+			continue
+		case "value":
+			key = pendingType
+		}
+		for _, facet := range facetTypes {
+			if key == facet {
+				columns = append(columns, CompareColumn{Type: key, Value: value})
+			}
+		}
+	}
+	return columns
+}
+
+// compareChecklists lines up the breakdowns of several facet values
+func compareChecklists(lst Checklist, columns []CompareColumn) ComparePageData {
+	var data ComparePageData
+	var titles []string
+	for i := range columns {
+		columns[i].Checklist = checklistByFacet(lst, columns[i].Type, columns[i].Value)
+		columns[i].Total = len(columns[i].Checklist.Figures)
+		titles = append(titles, strings.ToTitle(columns[i].Value)+" "+strings.ToUpper(columns[i].Type[:1])+columns[i].Type[1:])
+	}
+	data.Title = "Compare"
+	if len(titles) > 0 {
+		data.Title += ": " + strings.Join(titles, " vs ")
+	}
+	data.Columns = columns
+
+	for _, searchType := range compareSections {
+		section := CompareSection{Type: searchType}
+		totals := make(map[string]int)
+		perColumn := make([]map[string]int, len(columns))
+		for i, column := range columns {
+			perColumn[i] = facetData(column.Checklist, searchType)
+			for value, count := range perColumn[i] {
+				totals[value] += count
+			}
+		}
+		for _, value := range SortMapByValueThenKey(totals) {
+			row := CompareRow{Value: value, Counts: make([]int, len(columns))}
+			present := 0
+			for i := range columns {
+				row.Counts[i] = perColumn[i][value]
+				if row.Counts[i] > 0 {
+					present += 1
+				}
+			}
+			row.Shared = len(columns) > 1 && present == len(columns)
+			row.Unique = len(columns) > 1 && present == 1
+			section.Rows = append(section.Rows, row)
+		}
+		data.Sections = append(data.Sections, section)
+	}
+
+	//Figures in more than one column, in name order
+	seen := make(map[string][]int)
+	for i, column := range columns {
+		for _, figure := range column.Checklist.Figures {
+			seen[figure.Name] = append(seen[figure.Name], i)
+		}
+	}
+	for _, figure := range sortChecklist(lst).Figures {
+		if in := seen[figure.Name]; len(in) > 1 {
+			data.Overlaps = append(data.Overlaps, CompareOverlap{Figure: figure, Columns: in})
+		}
+	}
+	return data
+}
+
+// Page comparing the breakdowns of two or more facet values
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	pagedata := compareChecklists(checklist, compareSelections(r.URL.RawQuery))
+	pagedata.FacetTypes = facetTypes
+	//Every value of every facet, for the picker
+	all := make(map[string]int)
+	for _, searchType := range facetTypes {
+		for value := range facetData(checklist, searchType) {
+			all[value] = 1
+		}
+	}
+	pagedata.Values = SortMapByKeys(all)
+	renderTemplate(w, comparetpl, pagedata)
+}
+
+// API returning the same comparison as JSON
+func compareAPIHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	writeJSON(w, compareChecklists(checklist, compareSelections(r.URL.RawQuery)))
+}
+
+// writeJSON sends a value as an indented JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("json: %v", err)
+	}
+}
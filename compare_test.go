@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareSelections(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []CompareColumn
+	}{
+		{"race=ELF&race=DWARF", []CompareColumn{{Type: "race", Value: "ELF"}, {Type: "race", Value: "DWARF"}}},
+		{"faction=ORDER%20OF%20ARKYS&type=race&value=ELF", []CompareColumn{{Type: "faction", Value: "ORDER OF ARKYS"}, {Type: "race", Value: "ELF"}}},
+		{"color=RED&race=&race", nil},
+		{"release=WAVE%2F1", []CompareColumn{{Type: "release", Value: "WAVE/1"}}},
+	}
+	for _, test := range tests {
+		if got := compareSelections(test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("compareSelections(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestCompareChecklists(t *testing.T) {
+	checklist := Checklist{Figures: []Figure{
+		{Name: "Elf Knight", Race: "ELF", Role: "KNIGHT", Faction: "ORDER"},
+		{Name: "Elf Archer", Race: "ELF", Role: "ARCHER", Faction: "ORDER"},
+		{Name: "Dwarf Knight", Race: "DWARF", Role: "KNIGHT", Faction: "ORDER"},
+		{Name: "Dwarf Smith", Race: "DWARF", Role: "SMITH", Faction: "CHAOS"},
+	}}
+	data := compareChecklists(checklist, []CompareColumn{{Type: "race", Value: "ELF"}, {Type: "faction", Value: "ORDER"}})
+
+	if data.Title != "Compare: ELF Race vs ORDER Faction" {
+		t.Errorf("title %q", data.Title)
+	}
+	if data.Columns[0].Total != 2 || data.Columns[1].Total != 3 {
+		t.Errorf("totals %d and %d, want 2 and 3", data.Columns[0].Total, data.Columns[1].Total)
+	}
+	roles := data.Sections[0]
+	if roles.Type != "role" {
+		t.Fatalf("first section is %s, want role", roles.Type)
+	}
+	want := []CompareRow{
+		{Value: "KNIGHT", Counts: []int{1, 2}, Shared: true},
+		{Value: "ARCHER", Counts: []int{1, 1}, Shared: true},
+	}
+	if !reflect.DeepEqual(roles.Rows, want) {
+		t.Errorf("role rows %+v, want %+v", roles.Rows, want)
+	}
+	races := data.Sections[1]
+	want = []CompareRow{
+		{Value: "ELF", Counts: []int{2, 2}, Shared: true},
+		{Value: "DWARF", Counts: []int{0, 1}, Unique: true},
+	}
+	if !reflect.DeepEqual(races.Rows, want) {
+		t.Errorf("race rows %+v, want %+v", races.Rows, want)
+	}
+	var overlaps []string
+	for _, overlap := range data.Overlaps {
+		overlaps = append(overlaps, overlap.Figure.Name)
+		if !reflect.DeepEqual(overlap.Columns, []int{0, 1}) {
+			t.Errorf("%s is in columns %v, want both", overlap.Figure.Name, overlap.Columns)
+		}
+	}
+	if want := []string{"Elf Archer", "Elf Knight"}; !reflect.DeepEqual(overlaps, want) {
+		t.Errorf("overlaps %v, want %v", overlaps, want)
+	}
+
+	//A single column has nothing to share with
+	single := compareChecklists(checklist, []CompareColumn{{Type: "race", Value: "DWARF"}})
+	for _, row := range single.Sections[0].Rows {
+		if row.Shared || row.Unique {
+			t.Errorf("single column row %+v is marked", row)
+		}
+	}
+}
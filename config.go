@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every runtime setting of the server.
+//
+// Settings are resolved in this order, each step overriding the one before:
+//  1. built-in defaults (see defaultConfig)
+//  2. the JSON config file named by -config or LEGIONSDEX_CONFIG
+//  3. environment variables (LEGIONSDEX_*, plus the legacy PORT)
+//  4. command line flags
+type Config struct {
+	Addr          string   `json:"addr"`
+	Socket        string   `json:"socket"`
+	TLSCert       string   `json:"tls_cert"`
+	TLSKey        string   `json:"tls_key"`
+	ReadTimeout   Duration `json:"read_timeout"`
+	WriteTimeout  Duration `json:"write_timeout"`
+	IdleTimeout   Duration `json:"idle_timeout"`
+	DrainTimeout  Duration `json:"drain_timeout"`
+	DataFiles     []string `json:"data_files"`
+	TemplateDir   string   `json:"template_dir"`
+	StaticDir     string   `json:"static_dir"`
+	TaxonomyFile  string   `json:"taxonomy_file"`
+	DataDir       string   `json:"data_dir"`
+	Storage       string   `json:"storage"`
+	ImageDir      string   `json:"image_dir"`
+	ImageCacheDir string   `json:"image_cache_dir"`
+	Features      Features `json:"features"`
+
+	SimilarityWeights SimilarityWeights `json:"similarity_weights"`
+	SimilarCount      int               `json:"similar_count"`
+
+	WebhookURL string `json:"webhook_url"`
+	BaseURL    string `json:"base_url"`
+
+	AdminUsers AdminUsers `json:"admin_users"`
+}
+
+// Duration is a time.Duration written as "15s" in config files
+type Duration struct {
+	time.Duration
+}
+
+// MarshalText writes the duration in time.ParseDuration form
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText reads a duration like "15s" or "2m"
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Features are optional parts of the site that can be switched off
+type Features struct {
+	Drilldown bool `json:"drilldown"`
+	Groups    bool `json:"groups"`
+	Metrics   bool `json:"metrics"`
+	AccessLog bool `json:"access_log"`
+	Gzip      bool `json:"gzip"`
+	Changes   bool `json:"changes"`
+	Suggest   bool `json:"suggest"`
+
+	SavedSearches   bool `json:"saved_searches"`
+	WebhookReceiver bool `json:"webhook_receiver"`
+	Registration    bool `json:"registration"`
+}
+
+// featureToggles maps feature names, as used in -features, to their switch
+func (f *Features) featureToggles() map[string]*bool {
+	return map[string]*bool{
+		"drilldown":  &f.Drilldown,
+		"groups":     &f.Groups,
+		"metrics":    &f.Metrics,
+		"access_log": &f.AccessLog,
+		"gzip":       &f.Gzip,
+		"changes":    &f.Changes,
+		"suggest":    &f.Suggest,
+
+		"saved_searches":   &f.SavedSearches,
+		"webhook_receiver": &f.WebhookReceiver,
+		"registration":     &f.Registration,
+	}
+}
+
+// Set applies a comma separated list like "groups,-drilldown"
+func (f *Features) Set(list string) error {
+	toggles := f.featureToggles()
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		enabled := !strings.HasPrefix(name, "-")
+		name = strings.TrimLeft(name, "+-")
+		toggle, ok := toggles[name]
+		if !ok {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+		*toggle = enabled
+	}
+	return nil
+}
+
+// Effective configuration, filled in by loadConfig
+var config Config
+
+// defaultConfig is used for anything not set elsewhere. Empty paths mean the
+// copy embedded in the binary is used.
+func defaultConfig() Config {
+	return Config{
+		Addr:         ":8080",
+		ReadTimeout:  Duration{10 * time.Second},
+		WriteTimeout: Duration{30 * time.Second},
+		IdleTimeout:  Duration{2 * time.Minute},
+		DrainTimeout: Duration{15 * time.Second},
+		DataDir:      "data",
+		Storage:      "json",
+		SimilarityWeights: SimilarityWeights{
+			"faction": 1,
+			"race":    1.5,
+			"role":    1,
+			"scale":   0.5,
+			"release": 1,
+		},
+		SimilarCount: 8,
+		AdminUsers:   AdminUsers{},
+		Features: Features{
+			Drilldown: true,
+			Groups:    true,
+			Metrics:   true,
+			AccessLog: true,
+			Gzip:      true,
+			Changes:   true,
+			Suggest:   true,
+
+			SavedSearches: true,
+			Registration:  true,
+		},
+	}
+}
+
+// loadConfig resolves the configuration from defaults, file, environment and flags.
+// Commands can add their own flags to fs before calling it.
+func loadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	configFile := fs.String("config", os.Getenv("LEGIONSDEX_CONFIG"), "JSON config file (env LEGIONSDEX_CONFIG)")
+	addr := fs.String("addr", "", "listen address, e.g. :8080 (env LEGIONSDEX_ADDR or PORT)")
+	socket := fs.String("socket", "", "listen on this Unix socket instead of -addr (env LEGIONSDEX_SOCKET)")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file, enables HTTPS with -tls-key (env LEGIONSDEX_TLS_CERT)")
+	tlsKey := fs.String("tls-key", "", "TLS private key file (env LEGIONSDEX_TLS_KEY)")
+	readTimeout := fs.Duration("read-timeout", 0, "maximum time to read a request (env LEGIONSDEX_READ_TIMEOUT)")
+	writeTimeout := fs.Duration("write-timeout", 0, "maximum time to write a response (env LEGIONSDEX_WRITE_TIMEOUT)")
+	idleTimeout := fs.Duration("idle-timeout", 0, "how long to keep idle connections open (env LEGIONSDEX_IDLE_TIMEOUT)")
+	drainTimeout := fs.Duration("drain-timeout", 0, "how long to wait for requests to finish on shutdown (env LEGIONSDEX_DRAIN_TIMEOUT)")
+	data := fs.String("data", "", "comma separated figure checklist JSON files (env LEGIONSDEX_DATA)")
+	templates := fs.String("templates", "", "directory to load page templates from (env LEGIONSDEX_TEMPLATES)")
+	static := fs.String("static", "", "directory to serve /static assets from (env LEGIONSDEX_STATIC)")
+	taxonomyFile := fs.String("taxonomy", "", "JSON file of faction and race groups (env LEGIONSDEX_TAXONOMY)")
+	imageDir := fs.String("images", "", "directory of figure pictures named in the data (env LEGIONSDEX_IMAGES)")
+	imageCacheDir := fs.String("image-cache", "", "directory for generated picture sizes, default <data-dir>/image-cache (env LEGIONSDEX_IMAGE_CACHE)")
+	dataDir := fs.String("data-dir", "", "directory for collections and other stored data (env LEGIONSDEX_DATA_DIR)")
+	storage := fs.String("storage", "", "where figures and user data are kept: json or sqlite (env LEGIONSDEX_STORAGE)")
+	similarityWeights := fs.String("similarity-weights", "", "facet=weight list for similar figures, e.g. race=2,scale=0.5 (env LEGIONSDEX_SIMILARITY_WEIGHTS)")
+	similarCount := fs.Int("similar-count", 0, "similar figures shown on figure pages (env LEGIONSDEX_SIMILAR_COUNT)")
+	webhookURL := fs.String("webhook-url", "", "URL that new saved search matches are posted to (env LEGIONSDEX_WEBHOOK_URL)")
+	baseURL := fs.String("base-url", "", "public site URL, used for absolute links in feeds and sitemap.xml (env LEGIONSDEX_BASE_URL)")
+	adminUsers := fs.String("admin-users", "", "name:bcrypt-hash list of who may use /admin, see hash-password (env LEGIONSDEX_ADMIN_USERS)")
+	features := fs.String("features", "", "features to enable or, prefixed with -, disable (env LEGIONSDEX_FEATURES)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nSettings are taken from defaults, then the config file, then the environment, then flags; later sources win.\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	//Config file
+	if *configFile != "" {
+		raw, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %v", *configFile, err)
+		}
+		if cfg.SimilarityWeights == nil {
+			cfg.SimilarityWeights = SimilarityWeights{}
+		}
+		if err := cfg.SimilarityWeights.check(); err != nil {
+			return cfg, fmt.Errorf("%s: similarity_weights: %v", *configFile, err)
+		}
+		if cfg.AdminUsers == nil {
+			cfg.AdminUsers = AdminUsers{}
+		}
+	}
+
+	//Environment
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Addr = ":" + port
+	}
+	if v := os.Getenv("LEGIONSDEX_ADDR"); v != "" {
+		cfg.Addr = v
+	}
+	if v := os.Getenv("LEGIONSDEX_SOCKET"); v != "" {
+		cfg.Socket = v
+	}
+	if v := os.Getenv("LEGIONSDEX_TLS_CERT"); v != "" {
+		cfg.TLSCert = v
+	}
+	if v := os.Getenv("LEGIONSDEX_TLS_KEY"); v != "" {
+		cfg.TLSKey = v
+	}
+	for env, d := range map[string]*Duration{
+		"LEGIONSDEX_READ_TIMEOUT":  &cfg.ReadTimeout,
+		"LEGIONSDEX_WRITE_TIMEOUT": &cfg.WriteTimeout,
+		"LEGIONSDEX_IDLE_TIMEOUT":  &cfg.IdleTimeout,
+		"LEGIONSDEX_DRAIN_TIMEOUT": &cfg.DrainTimeout,
+	} {
+		if v := os.Getenv(env); v != "" {
+			if err := d.UnmarshalText([]byte(v)); err != nil {
+				return cfg, fmt.Errorf("%s: %v", env, err)
+			}
+		}
+	}
+	if v := os.Getenv("LEGIONSDEX_DATA"); v != "" {
+		cfg.DataFiles = splitList(v)
+	}
+	if v := os.Getenv("LEGIONSDEX_TEMPLATES"); v != "" {
+		cfg.TemplateDir = v
+	}
+	if v := os.Getenv("LEGIONSDEX_STATIC"); v != "" {
+		cfg.StaticDir = v
+	}
+	if v := os.Getenv("LEGIONSDEX_TAXONOMY"); v != "" {
+		cfg.TaxonomyFile = v
+	}
+	if v := os.Getenv("LEGIONSDEX_DATA_DIR"); v != "" {
+		cfg.DataDir = v
+	}
+	if v := os.Getenv("LEGIONSDEX_STORAGE"); v != "" {
+		cfg.Storage = v
+	}
+	if v := os.Getenv("LEGIONSDEX_IMAGES"); v != "" {
+		cfg.ImageDir = v
+	}
+	if v := os.Getenv("LEGIONSDEX_IMAGE_CACHE"); v != "" {
+		cfg.ImageCacheDir = v
+	}
+	if v := os.Getenv("LEGIONSDEX_SIMILARITY_WEIGHTS"); v != "" {
+		if err := cfg.SimilarityWeights.Set(v); err != nil {
+			return cfg, fmt.Errorf("LEGIONSDEX_SIMILARITY_WEIGHTS: %v", err)
+		}
+	}
+	if v := os.Getenv("LEGIONSDEX_SIMILAR_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, fmt.Errorf("LEGIONSDEX_SIMILAR_COUNT: %v", err)
+		}
+		cfg.SimilarCount = n
+	}
+	if v := os.Getenv("LEGIONSDEX_WEBHOOK_URL"); v != "" {
+		cfg.WebhookURL = v
+	}
+	if v := os.Getenv("LEGIONSDEX_BASE_URL"); v != "" {
+		cfg.BaseURL = v
+	}
+	if v := os.Getenv("LEGIONSDEX_ADMIN_USERS"); v != "" {
+		if err := cfg.AdminUsers.Set(v); err != nil {
+			return cfg, fmt.Errorf("LEGIONSDEX_ADMIN_USERS: %v", err)
+		}
+	}
+	if v := os.Getenv("LEGIONSDEX_FEATURES"); v != "" {
+		if err := cfg.Features.Set(v); err != nil {
+			return cfg, fmt.Errorf("LEGIONSDEX_FEATURES: %v", err)
+		}
+	}
+
+	//Flags, only those given on the command line
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *addr
+		case "socket":
+			cfg.Socket = *socket
+		case "tls-cert":
+			cfg.TLSCert = *tlsCert
+		case "tls-key":
+			cfg.TLSKey = *tlsKey
+		case "read-timeout":
+			cfg.ReadTimeout.Duration = *readTimeout
+		case "write-timeout":
+			cfg.WriteTimeout.Duration = *writeTimeout
+		case "idle-timeout":
+			cfg.IdleTimeout.Duration = *idleTimeout
+		case "drain-timeout":
+			cfg.DrainTimeout.Duration = *drainTimeout
+		case "data":
+			cfg.DataFiles = splitList(*data)
+		case "templates":
+			cfg.TemplateDir = *templates
+		case "static":
+			cfg.StaticDir = *static
+		case "taxonomy":
+			cfg.TaxonomyFile = *taxonomyFile
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "storage":
+			cfg.Storage = *storage
+		case "images":
+			cfg.ImageDir = *imageDir
+		case "image-cache":
+			cfg.ImageCacheDir = *imageCacheDir
+		case "similarity-weights":
+			if werr := cfg.SimilarityWeights.Set(*similarityWeights); werr != nil {
+				err = fmt.Errorf("-similarity-weights: %v", werr)
+			}
+		case "similar-count":
+			cfg.SimilarCount = *similarCount
+		case "webhook-url":
+			cfg.WebhookURL = *webhookURL
+		case "base-url":
+			cfg.BaseURL = *baseURL
+		case "admin-users":
+			if aerr := cfg.AdminUsers.Set(*adminUsers); aerr != nil {
+				err = fmt.Errorf("-admin-users: %v", aerr)
+			}
+		case "features":
+			if ferr := cfg.Features.Set(*features); ferr != nil {
+				err = fmt.Errorf("-features: %v", ferr)
+			}
+		}
+	})
+	if err == nil && (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		err = fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	return cfg, err
+}
+
+// splitList splits a comma separated setting, dropping empty entries
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// formatConfig renders the effective configuration for the startup log
+func formatConfig(cfg Config) string {
+	//Password hashes stay out of the log
+	admins := AdminUsers{}
+	for name := range cfg.AdminUsers {
+		admins[name] = "<hidden>"
+	}
+	cfg.AdminUsers = admins
+	out, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// Taxonomy names groups of facet values, e.g. the "light" factions or all "goblin" races
+type Taxonomy map[string]map[string][]string
+
+// Group definitions, filled in by loadTaxonomy
+var taxonomy Taxonomy
+
+// loadTaxonomy reads the group definitions, from path when one is given
+func loadTaxonomy(path string) error {
+	raw := embeddedTaxonomy
+	if path != "" {
+		var err error
+		if raw, err = ioutil.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	var t Taxonomy
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return err
+	}
+	taxonomy = t
+	return nil
+}
+
+// Group returns the members of a named group for a facet type
+func (t Taxonomy) Group(searchType string, name string) []string {
+	return t[searchType][name]
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	raw := `{"addr": ":7000", "storage": "sqlite", "read_timeout": "20s", "similar_count": 4}`
+	if err := ioutil.WriteFile(file, []byte(raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		addr    string
+		storage string
+		read    time.Duration
+		similar int
+	}{
+		{"defaults", nil, nil, ":8080", "json", 10 * time.Second, 8},
+		{"file", nil, []string{"-config", file}, ":7000", "sqlite", 20 * time.Second, 4},
+		{"file named by the environment", map[string]string{"LEGIONSDEX_CONFIG": file}, nil, ":7000", "sqlite", 20 * time.Second, 4},
+		{"legacy PORT", map[string]string{"PORT": "9000"}, nil, ":9000", "json", 10 * time.Second, 8},
+		{"environment over PORT", map[string]string{"PORT": "9000", "LEGIONSDEX_ADDR": ":9100"}, nil, ":9100", "json", 10 * time.Second, 8},
+		{"environment over file", map[string]string{"LEGIONSDEX_ADDR": ":9100", "LEGIONSDEX_READ_TIMEOUT": "5s"}, []string{"-config", file}, ":9100", "sqlite", 5 * time.Second, 4},
+		{"flag over environment", map[string]string{"LEGIONSDEX_ADDR": ":9100", "LEGIONSDEX_SIMILAR_COUNT": "2"}, []string{"-config", file, "-addr", ":9200", "-similar-count", "6"}, ":9200", "sqlite", 20 * time.Second, 6},
+		{"flag set to the default still wins", map[string]string{"LEGIONSDEX_STORAGE": "sqlite"}, []string{"-storage", "json"}, ":8080", "json", 10 * time.Second, 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, env := range []string{"LEGIONSDEX_CONFIG", "PORT", "LEGIONSDEX_ADDR", "LEGIONSDEX_STORAGE", "LEGIONSDEX_READ_TIMEOUT", "LEGIONSDEX_SIMILAR_COUNT"} {
+				t.Setenv(env, test.env[env])
+			}
+			cfg, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Addr != test.addr || cfg.Storage != test.storage || cfg.ReadTimeout.Duration != test.read || cfg.SimilarCount != test.similar {
+				t.Errorf("got addr %s, storage %s, read timeout %v, similar count %d", cfg.Addr, cfg.Storage, cfg.ReadTimeout.Duration, cfg.SimilarCount)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{"bad duration", map[string]string{"LEGIONSDEX_READ_TIMEOUT": "soon"}, nil},
+		{"bad count", map[string]string{"LEGIONSDEX_SIMILAR_COUNT": "many"}, nil},
+		{"missing file", nil, []string{"-config", filepath.Join(t.TempDir(), "none.json")}},
+		{"certificate without key", nil, []string{"-tls-cert", "cert.pem"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, env := range []string{"LEGIONSDEX_CONFIG", "LEGIONSDEX_READ_TIMEOUT", "LEGIONSDEX_SIMILAR_COUNT"} {
+				t.Setenv(env, test.env[env])
+			}
+			if _, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), test.args); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
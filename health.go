@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Version of the figure checklist JSON format this build understands
+const schemaVersion = 1
+
+// DatasetInfo describes the currently loaded figure data
+type DatasetInfo struct {
+	Loaded    bool   `json:"loaded"`
+	Valid     bool   `json:"valid"`
+	Reloading bool   `json:"reloading"`
+	Figures   int    `json:"figures"`
+	Checksum  string `json:"checksum"`
+	//Release records change which figures pages show, apart from the figures
+	ReleasesChecksum string    `json:"releases_checksum"`
+	ModTime          time.Time `json:"modified"`
+	LoadedAt         time.Time `json:"loaded_at"`
+	SchemaVersion    int       `json:"schema_version"`
+	Sources          []string  `json:"sources"`
+	Errors           []string  `json:"errors,omitempty"`
+}
+
+// What is known about the loaded figures, guarded by datasetMu
+var datasetMu sync.RWMutex
+var datasetInfo DatasetInfo
+
+// currentChecklist returns every stored figure for background jobs, which
+// have no request to fail and carry on with none when storage fails
+func currentChecklist() Checklist {
+	lst, err := repo.Figures(nil)
+	if err != nil {
+		log.Printf("storage: %v", err)
+	}
+	return lst
+}
+
+// currentDatasetInfo returns a copy of the dataset status
+func currentDatasetInfo() DatasetInfo {
+	datasetMu.RLock()
+	defer datasetMu.RUnlock()
+	return datasetInfo
+}
+
+// datasetChecksum identifies figures by their content
+func datasetChecksum(lst Checklist) string {
+	raw, _ := json.Marshal(lst)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// figuresEdited updates the dataset status after figures were changed through
+// the repository, and does what a reload would do with the new figures
+func figuresEdited() {
+	lst := currentChecklist()
+	datasetMu.Lock()
+	datasetInfo.Figures = len(lst.Figures)
+	datasetInfo.Checksum = datasetChecksum(lst)
+	datasetInfo.ModTime = time.Now()
+	info := datasetInfo
+	datasetMu.Unlock()
+	recordChanges(lst, info)
+	go checkSavedSearches(lst)
+}
+
+// setReloading flags a reload in progress, so readiness fails until it ends
+func setReloading(reloading bool) {
+	datasetMu.Lock()
+	datasetInfo.Reloading = reloading
+	datasetMu.Unlock()
+}
+
+// validateChecklist reports figures missing required data or sharing a name
+func validateChecklist(lst Checklist) []string {
+	var problems []string
+	if lst.SchemaVersion > schemaVersion {
+		problems = append(problems, fmt.Sprintf("schema version %d is newer than supported version %d", lst.SchemaVersion, schemaVersion))
+	}
+	names := make(map[string]bool)
+	for i, figure := range lst.Figures {
+		if figure.Name == "" {
+			problems = append(problems, fmt.Sprintf("figure %d has no name", i))
+			continue
+		}
+		if names[figure.Name] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate name", figure.Name))
+		}
+		names[figure.Name] = true
+		for field, value := range map[string]string{"faction": figure.Faction, "race": figure.Race, "role": figure.Role, "scale": figure.Scale} {
+			if value == "" {
+				problems = append(problems, fmt.Sprintf("%s: missing %s", figure.Name, field))
+			}
+		}
+		if len(figure.Release) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: missing release", figure.Name))
+		}
+		problems = append(problems, validateParts(figure)...)
+	}
+	return problems
+}
+
+// reloadDatabase loads the data files again, keeping the old figures on failure
+func reloadDatabase() {
+	setReloading(true)
+	defer setReloading(false)
+	if err := loadDatabase(); err != nil {
+		log.Printf("reload failed, keeping previous data: %v", err)
+		return
+	}
+	info := currentDatasetInfo()
+	log.Printf("reloaded %d figures, checksum %s", info.Figures, info.Checksum)
+	recordChanges(currentChecklist(), info)
+	go generateImages(currentChecklist())
+	go checkSavedSearches(currentChecklist())
+}
+
+// reloadOnHangup reloads the data files whenever the process receives SIGHUP
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadDatabase()
+		}
+	}()
+}
+
+// BuildInfo identifies the running binary
+type BuildInfo struct {
+	GoVersion string `json:"go_version"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified"`
+}
+
+// buildInfo reads the module and VCS details stamped in by the Go toolchain
+func buildInfo() BuildInfo {
+	var info BuildInfo
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.GoVersion = bi.GoVersion
+	info.Version = bi.Main.Version
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// HealthStatus is the body of /healthz and /readyz
+type HealthStatus struct {
+	Status  string      `json:"status"`
+	Dataset DatasetInfo `json:"dataset"`
+	Build   BuildInfo   `json:"build"`
+}
+
+// writeHealth sends the health status as JSON, with 503 when not ok
+func writeHealth(w http.ResponseWriter, ok bool) {
+	status := HealthStatus{Status: "ok", Dataset: currentDatasetInfo(), Build: buildInfo()}
+	code := http.StatusOK
+	if !ok {
+		status.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("health: %v", err)
+	}
+}
+
+// Liveness: the process is up and has figures to serve
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, currentDatasetInfo().Loaded)
+}
+
+// Readiness: the dataset is loaded, valid and not being reloaded
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	info := currentDatasetInfo()
+	writeHealth(w, info.Loaded && info.Valid && !info.Reloading)
+}
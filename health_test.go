@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	datasetMu.Lock()
+	savedInfo := datasetInfo
+	datasetMu.Unlock()
+	savedFiles := config.DataFiles
+	defer func() {
+		datasetMu.Lock()
+		datasetInfo = savedInfo
+		datasetMu.Unlock()
+		config.DataFiles = savedFiles
+	}()
+	useTestRepository(t)
+	config.DataFiles = nil
+	if err := loadDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, handler http.HandlerFunc, want int) HealthStatus {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", name, w.Code, want)
+		}
+		var status HealthStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return status
+	}
+	check("loaded", readyzHandler, http.StatusOK)
+
+	setReloading(true)
+	if status := check("reloading", readyzHandler, http.StatusServiceUnavailable); !status.Dataset.Reloading || status.Status != "unavailable" {
+		t.Errorf("reloading: status %+v", status)
+	}
+	check("live while reloading", healthzHandler, http.StatusOK)
+	setReloading(false)
+	check("reloaded", readyzHandler, http.StatusOK)
+
+	//A figure missing its role loads, but the dataset is not ready
+	path := filepath.Join(t.TempDir(), "figures.json")
+	if err := os.WriteFile(path, []byte(`{"figures": [{"name": "Knight", "faction": "ORDER", "race": "HUMAN", "scale": "HEROIC", "released": ["WAVE 1"]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.DataFiles = []string{path}
+	if err := loadDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if status := check("invalid", readyzHandler, http.StatusServiceUnavailable); status.Dataset.Valid || len(status.Dataset.Errors) != 1 {
+		t.Errorf("invalid: dataset %+v", status.Dataset)
+	}
+	check("live with invalid data", healthzHandler, http.StatusOK)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+)
+
+// imageSize is a generated variant of each figure picture, fitting in Max×Max pixels
+type imageSize struct {
+	Name string
+	Max  int
+}
+
+// Sizes generated for every figure picture
+var imageSizes = []imageSize{
+	{"thumb", 96},
+	{"medium", 360},
+}
+
+// Serialises generation so two requests don't write the same file
+var imageMu sync.Mutex
+
+// findImageSize looks up a size by name
+func findImageSize(name string) (imageSize, bool) {
+	for _, size := range imageSizes {
+		if size.Name == name {
+			return size, true
+		}
+	}
+	return imageSize{}, false
+}
+
+// hasImage reports whether a figure has a picture that can be shown
+func hasImage(figure Figure) bool {
+	return figure.Image != "" && config.ImageDir != ""
+}
+
+// imageCacheDir is where generated sizes are kept
+func imageCacheDir() string {
+	if config.ImageCacheDir != "" {
+		return config.ImageCacheDir
+	}
+	return filepath.Join(config.DataDir, "image-cache")
+}
+
+// cachedImagePath is the generated file for a figure at a size
+func cachedImagePath(size imageSize, figure Figure) string {
+	return filepath.Join(imageCacheDir(), size.Name, figure.Slug()+".jpg")
+}
+
+// imageSource is a figure's picture under the image directory. The path comes
+// from the dataset or an edit, so one that climbs out with ".." is refused.
+func imageSource(figure Figure) (string, error) {
+	dir, err := filepath.Abs(config.ImageDir)
+	if err != nil {
+		return "", err
+	}
+	src := filepath.Join(dir, filepath.FromSlash(figure.Image))
+	rel, err := filepath.Rel(dir, src)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the image directory", figure.Image)
+	}
+	return src, nil
+}
+
+// ensureImage generates a size of a figure's picture unless an up to date copy exists
+func ensureImage(size imageSize, figure Figure) (string, error) {
+	if !hasImage(figure) {
+		return "", os.ErrNotExist
+	}
+	src, err := imageSource(figure)
+	if err != nil {
+		return "", err
+	}
+	dst := cachedImagePath(size, figure)
+	imageMu.Lock()
+	defer imageMu.Unlock()
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && !dstInfo.ModTime().Before(srcInfo.ModTime()) {
+		return dst, nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", src, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*.jpg")
+	if err != nil {
+		return "", err
+	}
+	err = jpeg.Encode(out, resize(img, size.Max), &jpeg.Options{Quality: 85})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return dst, os.Rename(out.Name(), dst)
+}
+
+// resize scales an image down to fit in max×max, keeping its aspect ratio
+func resize(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		max = w
+		if h > w {
+			max = h
+		}
+	}
+	if w >= h {
+		w, h = max, h*max/w
+	} else {
+		w, h = w*max/h, max
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	//JPEG has no transparency, so draw onto white
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// generateImages makes every size of every figure picture ahead of the first request
+func generateImages(lst Checklist) {
+	if config.ImageDir == "" {
+		return
+	}
+	made, failed := 0, 0
+	for _, figure := range lst.Figures {
+		if figure.Image == "" {
+			continue
+		}
+		for _, size := range imageSizes {
+			if _, err := ensureImage(size, figure); err != nil {
+				log.Printf("image %s %s: %v", figure.Name, size.Name, err)
+				failed += 1
+			} else {
+				made += 1
+			}
+		}
+	}
+	log.Printf("images ready: %d, failed: %d", made, failed)
+}
+
+// imageURL is the template function giving a figure picture, or the placeholder
+func imageURL(sizeName string, figure Figure) string {
+	if !hasImage(figure) {
+		return assetURL("placeholder.svg")
+	}
+	return "/images/" + sizeName + "/" + figure.Slug() + ".jpg"
+}
+
+// Serves a generated size of a figure picture
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	reqvars := mux.Vars(r)
+	size, ok := findImageSize(reqvars["size"])
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	figure, found := figureBySlug(checklist, reqvars["figure"])
+	if !ok || !found || !hasImage(figure) {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := ensureImage(size, figure)
+	if err != nil {
+		log.Printf("image %s %s: %v", figure.Name, size.Name, err)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, file)
+}
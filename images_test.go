@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestImageSource(t *testing.T) {
+	dir := t.TempDir()
+	saved := config.ImageDir
+	config.ImageDir = dir
+	defer func() { config.ImageDir = saved }()
+
+	tests := []struct {
+		image string
+		want  string
+		ok    bool
+	}{
+		{"knight.png", filepath.Join(dir, "knight.png"), true},
+		{"wave1/knight.png", filepath.Join(dir, "wave1", "knight.png"), true},
+		{"wave1/../knight.png", filepath.Join(dir, "knight.png"), true},
+		{"/knight.png", filepath.Join(dir, "knight.png"), true},
+		{"../knight.png", "", false},
+		{"wave1/../../etc/passwd", "", false},
+		{"..", "", false},
+		{".", "", false},
+	}
+	for _, test := range tests {
+		got, err := imageSource(Figure{Image: test.image})
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("imageSource(%q) = %q, %v, want %q", test.image, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Stored document of every account's kitbash recipes
+const kitbashesDocument = "kitbashes.json"
+
+// Slots a kitbash is put together from, in order
+var kitbashSlots = []string{"head", "torso", "arms", "legs", "cape", "weapon"}
+
+// Catalog part types that fit a slot, every slot has at least one
+var slotPartTypes = map[string][]string{
+	"head":   {"helmet"},
+	"torso":  {"torso"},
+	"arms":   {"arms"},
+	"legs":   {"legs"},
+	"cape":   {"cape"},
+	"weapon": {"weapon", "shield"},
+}
+
+// KitbashPick is what fills one slot: a figure, and which of its parts when
+// the catalog knows them
+type KitbashPick struct {
+	Slot   string `json:"slot"`
+	Figure string `json:"figure"`
+	Part   string `json:"part,omitempty"`
+}
+
+// Kitbash is a recipe for a custom figure made from parts of several figures
+type Kitbash struct {
+	ID      string        `json:"id"`
+	User    string        `json:"user"`
+	Name    string        `json:"name"`
+	Notes   string        `json:"notes,omitempty"`
+	Picks   []KitbashPick `json:"picks"`
+	Shared  bool          `json:"shared,omitempty"`
+	Created time.Time     `json:"created"`
+	Updated time.Time     `json:"updated"`
+}
+
+// Pick is what fills a slot, empty if nothing does
+func (kitbash Kitbash) Pick(slot string) KitbashPick {
+	for _, pick := range kitbash.Picks {
+		if pick.Slot == slot {
+			return pick
+		}
+	}
+	return KitbashPick{Slot: slot}
+}
+
+// Donors lists the figures parts are taken from, in slot order
+func (kitbash Kitbash) Donors() []string {
+	var donors []string
+	for _, pick := range kitbash.Picks {
+		if !containsString(donors, pick.Figure) {
+			donors = append(donors, pick.Figure)
+		}
+	}
+	return donors
+}
+
+// missingDonors lists the donor figures a collection does not have on hand
+func missingDonors(kitbash Kitbash, collection Collection) []string {
+	var missing []string
+	for _, donor := range kitbash.Donors() {
+		if status := collection.Status(donor); status != "owned" && status != "for_trade" {
+			missing = append(missing, donor)
+		}
+	}
+	return missing
+}
+
+// checkPicks checks every pick against the figures and their parts, putting
+// names in their stored spelling and the picks in slot order
+func checkPicks(picks []KitbashPick, checklist Checklist) ([]KitbashPick, error) {
+	figures := make(map[string]Figure)
+	for _, figure := range checklist.Figures {
+		figures[strings.ToLower(figure.Name)] = figure
+	}
+	bySlot := make(map[string]KitbashPick)
+	for _, pick := range picks {
+		pick.Slot = strings.ToLower(strings.TrimSpace(pick.Slot))
+		pick.Figure = strings.TrimSpace(pick.Figure)
+		pick.Part = strings.TrimSpace(pick.Part)
+		if !containsString(kitbashSlots, pick.Slot) {
+			return nil, fmt.Errorf("%s is not a slot, use one of %s", pick.Slot, strings.Join(kitbashSlots, ", "))
+		}
+		if _, exists := bySlot[pick.Slot]; exists {
+			return nil, fmt.Errorf("the %s slot is picked twice", pick.Slot)
+		}
+		if pick.Figure == "" {
+			if pick.Part != "" {
+				return nil, fmt.Errorf("%s: say which figure the part comes from", pick.Slot)
+			}
+			continue
+		}
+		figure, exists := figures[strings.ToLower(pick.Figure)]
+		if !exists {
+			return nil, fmt.Errorf("%s: no figure named %s", pick.Slot, pick.Figure)
+		}
+		pick.Figure = figure.Name
+		if pick.Part != "" {
+			found := false
+			for _, part := range figure.Parts {
+				if strings.EqualFold(part.Name, pick.Part) && containsString(slotPartTypes[pick.Slot], part.Type) {
+					pick.Part = part.Name
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("%s: %s does not come with a %s part named %s", pick.Slot, figure.Name, pick.Slot, pick.Part)
+			}
+		}
+		bySlot[pick.Slot] = pick
+	}
+	var checked []KitbashPick
+	for _, slot := range kitbashSlots {
+		if pick, exists := bySlot[slot]; exists {
+			checked = append(checked, pick)
+		}
+	}
+	if len(checked) == 0 {
+		return nil, fmt.Errorf("pick a figure for at least one slot")
+	}
+	return checked, nil
+}
+
+// kitbashFromRequest reads and checks a recipe from the builder form, with
+// figure_<slot> and part_<slot> fields, or a JSON body
+func kitbashFromRequest(r *http.Request) (Kitbash, error) {
+	var kitbash Kitbash
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&kitbash); err != nil {
+			return kitbash, err
+		}
+	} else {
+		kitbash.Name = r.FormValue("name")
+		kitbash.Notes = r.FormValue("notes")
+		kitbash.Shared = r.FormValue("shared") != ""
+		for _, slot := range kitbashSlots {
+			kitbash.Picks = append(kitbash.Picks, KitbashPick{Slot: slot, Figure: r.FormValue("figure_" + slot), Part: r.FormValue("part_" + slot)})
+		}
+	}
+	kitbash.Name = strings.TrimSpace(kitbash.Name)
+	kitbash.Notes = strings.TrimSpace(kitbash.Notes)
+	if kitbash.Name == "" || len(kitbash.Name) > 100 {
+		return kitbash, fmt.Errorf("a recipe needs a name of up to 100 characters")
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		return kitbash, err
+	}
+	picks, err := checkPicks(kitbash.Picks, checklist)
+	if err != nil {
+		return kitbash, err
+	}
+	kitbash.Picks = picks
+	return kitbash, nil
+}
+
+// findKitbash finds a recipe by id, whoever it belongs to
+func findKitbash(id string) (Kitbash, bool, error) {
+	var kitbashes []Kitbash
+	if err := readDocument(kitbashesDocument, &kitbashes); err != nil {
+		return Kitbash{}, false, err
+	}
+	for _, kitbash := range kitbashes {
+		if kitbash.ID == id {
+			return kitbash, true, nil
+		}
+	}
+	return Kitbash{}, false, nil
+}
+
+// userKitbashes lists an account's recipes by name
+func userKitbashes(user string) ([]Kitbash, error) {
+	var kitbashes, mine []Kitbash
+	if err := readDocument(kitbashesDocument, &kitbashes); err != nil {
+		return nil, err
+	}
+	for _, kitbash := range kitbashes {
+		if kitbash.User == user {
+			mine = append(mine, kitbash)
+		}
+	}
+	sort.SliceStable(mine, func(i, j int) bool {
+		return strings.ToLower(mine[i].Name) < strings.ToLower(mine[j].Name)
+	})
+	return mine, nil
+}
+
+// Data for the kitbash pages
+type KitbashPageData struct {
+	Title     string
+	User      string
+	CSRF      string
+	Kitbashes []Kitbash
+	Kitbash   Kitbash
+	Slots     []string
+	Figures   []string
+	Parts     map[string][]string
+	Missing   map[string][]string
+	Slugs     map[string]string
+	Share     string
+	Problems  []string
+}
+
+// renderKitbash fills in what every kitbash page needs and shows one of them
+func renderKitbash(w http.ResponseWriter, r *http.Request, pagedata KitbashPageData) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	collection, err := userCollection(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	pagedata.User = requestUser(r)
+	pagedata.CSRF = requestCSRF(r)
+	pagedata.Slots = kitbashSlots
+	pagedata.Figures = figureNames(checklist)
+	pagedata.Parts = make(map[string][]string)
+	for slot, partTypes := range slotPartTypes {
+		for _, partType := range partTypes {
+			for _, entry := range partsCatalog(checklist, PartQuery{Type: partType}) {
+				pagedata.Parts[slot] = append(pagedata.Parts[slot], entry.Part.Name)
+			}
+		}
+	}
+	pagedata.Slugs = make(map[string]string)
+	for _, figure := range checklist.Figures {
+		pagedata.Slugs[figure.Name] = figure.Slug()
+	}
+	pagedata.Missing = make(map[string][]string)
+	for _, kitbash := range append(pagedata.Kitbashes, pagedata.Kitbash) {
+		pagedata.Missing[kitbash.ID] = missingDonors(kitbash, collection)
+	}
+	if len(pagedata.Problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTemplate(w, kitbashtpl, pagedata)
+}
+
+// Page listing the caller's recipes, with the builder for a new one
+func kitbashesHandler(w http.ResponseWriter, r *http.Request) {
+	kitbashes, err := userKitbashes(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	renderKitbash(w, r, KitbashPageData{Title: "Kitbash Planner", Kitbashes: kitbashes})
+}
+
+// Saves a new recipe
+func createKitbashHandler(w http.ResponseWriter, r *http.Request) {
+	kitbash, err := kitbashFromRequest(r)
+	api := strings.HasPrefix(r.URL.Path, "/api/")
+	if err != nil && api {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		kitbashes, _ := userKitbashes(requestUser(r))
+		renderKitbash(w, r, KitbashPageData{Title: "Kitbash Planner", Kitbashes: kitbashes, Kitbash: kitbash, Problems: []string{err.Error()}})
+		return
+	}
+	kitbash.ID = newID()
+	kitbash.User = requestUser(r)
+	kitbash.Created = time.Now()
+	kitbash.Updated = kitbash.Created
+	var kitbashes []Kitbash
+	err = updateDocument(kitbashesDocument, &kitbashes, func() error {
+		kitbashes = append(kitbashes, kitbash)
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if api {
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, kitbash)
+		return
+	}
+	http.Redirect(w, r, "/kitbash/"+kitbash.ID, http.StatusSeeOther)
+}
+
+// userKitbash finds one of the caller's recipes by the route's id
+func userKitbash(w http.ResponseWriter, r *http.Request) (Kitbash, bool) {
+	kitbash, found, err := findKitbash(mux.Vars(r)["id"])
+	if err != nil {
+		storageError(w, err)
+		return Kitbash{}, false
+	}
+	if !found || kitbash.User != requestUser(r) {
+		http.NotFound(w, r)
+		return Kitbash{}, false
+	}
+	return kitbash, true
+}
+
+// Page editing one of the caller's recipes
+func kitbashHandler(w http.ResponseWriter, r *http.Request) {
+	kitbash, found := userKitbash(w, r)
+	if !found {
+		return
+	}
+	renderKitbash(w, r, KitbashPageData{Title: "Kitbash: " + kitbash.Name, Kitbash: kitbash, Share: siteURL(r) + "/recipe/" + kitbash.ID})
+}
+
+// Saves changes to a recipe
+func editKitbashHandler(w http.ResponseWriter, r *http.Request) {
+	current, found := userKitbash(w, r)
+	if !found {
+		return
+	}
+	edited, err := kitbashFromRequest(r)
+	if err != nil {
+		edited.ID = current.ID
+		renderKitbash(w, r, KitbashPageData{Title: "Kitbash: " + current.Name, Kitbash: edited, Share: siteURL(r) + "/recipe/" + current.ID, Problems: []string{err.Error()}})
+		return
+	}
+	var kitbashes []Kitbash
+	err = updateDocument(kitbashesDocument, &kitbashes, func() error {
+		for i := range kitbashes {
+			if kitbashes[i].ID == current.ID {
+				kitbashes[i].Name = edited.Name
+				kitbashes[i].Notes = edited.Notes
+				kitbashes[i].Picks = edited.Picks
+				kitbashes[i].Shared = edited.Shared
+				kitbashes[i].Updated = time.Now()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/kitbash/"+current.ID, http.StatusSeeOther)
+}
+
+// Deletes a recipe
+func deleteKitbashHandler(w http.ResponseWriter, r *http.Request) {
+	var kitbashes []Kitbash
+	found := false
+	err := updateDocument(kitbashesDocument, &kitbashes, func() error {
+		for i := range kitbashes {
+			if kitbashes[i].ID == mux.Vars(r)["id"] && kitbashes[i].User == requestUser(r) {
+				kitbashes = append(kitbashes[:i], kitbashes[i+1:]...)
+				found = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/kitbash", http.StatusSeeOther)
+}
+
+// API listing the caller's recipes
+func kitbashesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	kitbashes, err := userKitbashes(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if kitbashes == nil {
+		kitbashes = []Kitbash{}
+	}
+	writeJSON(w, kitbashes)
+}
+
+// Data for the shared recipe page
+type RecipePageData struct {
+	Title   string
+	User    string
+	Kitbash Kitbash
+	Figures map[string]Figure
+	//The catalog part picked for each slot, for linking to it
+	Parts   map[string]Part
+	Missing []string
+}
+
+// Page for a recipe its owner has shared, found only by people given the
+// link; signed in visitors see which donors they still need. The owner can
+// see it before sharing.
+func recipeHandler(w http.ResponseWriter, r *http.Request) {
+	kitbash, found, err := findKitbash(mux.Vars(r)["id"])
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if !found || !kitbash.Shared && kitbash.User != requestUser(r) {
+		http.NotFound(w, r)
+		return
+	}
+	var pagedata RecipePageData
+	pagedata.Title = "Kitbash: " + kitbash.Name
+	pagedata.User = requestUser(r)
+	pagedata.Kitbash = kitbash
+	pagedata.Figures = make(map[string]Figure)
+	for _, donor := range kitbash.Donors() {
+		if figure, err := repo.Figure(donor); err == nil {
+			pagedata.Figures[donor] = figure
+		}
+	}
+	pagedata.Parts = make(map[string]Part)
+	for _, pick := range kitbash.Picks {
+		for _, part := range pagedata.Figures[pick.Figure].Parts {
+			if pick.Part != "" && part.Name == pick.Part && containsString(slotPartTypes[pick.Slot], part.Type) {
+				pagedata.Parts[pick.Slot] = part
+			}
+		}
+	}
+	if pagedata.User != "" {
+		collection, err := userCollection(pagedata.User)
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		pagedata.Missing = missingDonors(kitbash, collection)
+	}
+	renderTemplate(w, recipetpl, pagedata)
+}
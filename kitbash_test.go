@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSlotPartTypes(t *testing.T) {
+	for _, slot := range kitbashSlots {
+		if len(slotPartTypes[slot]) == 0 {
+			t.Errorf("the %s slot takes no part type", slot)
+		}
+		for _, partType := range slotPartTypes[slot] {
+			if !containsString(partTypes, partType) {
+				t.Errorf("the %s slot takes %s, which is not a part type", slot, partType)
+			}
+		}
+	}
+	for slot := range slotPartTypes {
+		if !containsString(kitbashSlots, slot) {
+			t.Errorf("%s has part types but is not a slot", slot)
+		}
+	}
+}
+
+func TestRecipeShared(t *testing.T) {
+	signIn(t)
+	if err := loadTemplates(""); err != nil {
+		t.Fatal(err)
+	}
+	kitbashes := []Kitbash{
+		{ID: "private", User: "boss", Name: "Private", Picks: []KitbashPick{{Slot: "head", Figure: "Knight"}}},
+		{ID: "shared", User: "boss", Name: "Shared", Picks: []KitbashPick{{Slot: "head", Figure: "Knight"}}, Shared: true},
+	}
+	if err := updateDocument(kitbashesDocument, &kitbashes, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		id     string
+		cookie string
+		want   int
+	}{
+		{"shared", "shared", "", http.StatusOK},
+		{"not shared", "private", "", http.StatusNotFound},
+		{"not shared, seen by its owner", "private", "live", http.StatusOK},
+		{"unknown", "other", "", http.StatusNotFound},
+	}
+	handler := authenticate(http.HandlerFunc(recipeHandler))
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/recipe/"+test.id, nil)
+		r = mux.SetURLVars(r, map[string]string{"id": test.id})
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: test.cookie})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestCheckPicks(t *testing.T) {
+	checklist := Checklist{Figures: []Figure{
+		{Name: "Knight", Parts: []Part{{Name: "Great Helm", Type: "helmet"}, {Name: "Lion", Type: "shield"}}},
+		{Name: "Squire"},
+	}}
+	tests := []struct {
+		name  string
+		picks []KitbashPick
+		want  []KitbashPick
+		ok    bool
+	}{
+		{"slot order and spelling", []KitbashPick{
+			{Slot: " Weapon ", Figure: "knight", Part: "lion"},
+			{Slot: "head", Figure: " KNIGHT ", Part: "great helm"},
+			{Slot: "legs", Figure: "squire"},
+		}, []KitbashPick{
+			{Slot: "head", Figure: "Knight", Part: "Great Helm"},
+			{Slot: "legs", Figure: "Squire"},
+			{Slot: "weapon", Figure: "Knight", Part: "Lion"},
+		}, true},
+		{"empty slots are dropped", []KitbashPick{{Slot: "cape"}, {Slot: "torso", Figure: "Squire"}}, []KitbashPick{{Slot: "torso", Figure: "Squire"}}, true},
+		{"slot picked twice", []KitbashPick{{Slot: "head", Figure: "Knight"}, {Slot: "HEAD", Figure: "Squire"}}, nil, false},
+		{"not a slot", []KitbashPick{{Slot: "tail", Figure: "Knight"}}, nil, false},
+		{"part that does not fit the slot", []KitbashPick{{Slot: "head", Figure: "Knight", Part: "Lion"}}, nil, false},
+		{"part of another figure", []KitbashPick{{Slot: "head", Figure: "Squire", Part: "Great Helm"}}, nil, false},
+		{"part without a figure", []KitbashPick{{Slot: "head", Part: "Great Helm"}}, nil, false},
+		{"unknown figure", []KitbashPick{{Slot: "head", Figure: "Imp"}}, nil, false},
+		{"nothing picked", []KitbashPick{{Slot: "head"}}, nil, false},
+	}
+	for _, test := range tests {
+		picks, err := checkPicks(test.picks, checklist)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(picks, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, picks, test.want)
+		}
+	}
+}
+
+func TestMissingDonors(t *testing.T) {
+	kitbash := Kitbash{Picks: []KitbashPick{
+		{Slot: "head", Figure: "Knight"},
+		{Slot: "torso", Figure: "Squire"},
+		{Slot: "arms", Figure: "Knight"},
+		{Slot: "legs", Figure: "Page"},
+		{Slot: "cape", Figure: "Imp"},
+	}}
+	collection := Collection{Owned: []string{"Knight", "Squire"}, ForTrade: []string{"Squire"}, Wanted: []string{"Page"}}
+	if got, want := missingDonors(kitbash, collection), []string{"Page", "Imp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("missing %v, want %v", got, want)
+	}
+	if got, want := kitbash.Donors(), []string{"Knight", "Squire", "Page", "Imp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("donors %v, want %v", got, want)
+	}
+}
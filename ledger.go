@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Stored document of every account's purchases
+const purchasesDocument = "purchases.json"
+
+// Conditions a figure can be bought in
+var purchaseConditions = []string{"sealed", "loose"}
+
+// ISO 4217 style currency codes
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Purchase is one figure an account acquired
+type Purchase struct {
+	ID        string  `json:"id"`
+	User      string  `json:"user"`
+	Figure    string  `json:"figure"`
+	Price     float64 `json:"price"`
+	Currency  string  `json:"currency"`
+	Date      string  `json:"date"`
+	Vendor    string  `json:"vendor,omitempty"`
+	Condition string  `json:"condition"`
+}
+
+// Month is the year and month of the purchase date
+func (purchase Purchase) Month() string {
+	if len(purchase.Date) < 7 {
+		return purchase.Date
+	}
+	return purchase.Date[:7]
+}
+
+// SpendRow is what was spent on the figures of one facet value or month
+type SpendRow struct {
+	Value   string  `json:"value"`
+	Count   int     `json:"count"`
+	Spend   float64 `json:"spend"`
+	Average float64 `json:"average"`
+}
+
+// SpendReport sums up the purchases made in one currency
+type SpendReport struct {
+	Currency string     `json:"currency"`
+	Count    int        `json:"count"`
+	Total    float64    `json:"total"`
+	Releases []SpendRow `json:"releases"`
+	Factions []SpendRow `json:"factions"`
+	Scales   []SpendRow `json:"scales"`
+	Months   []SpendRow `json:"months"`
+}
+
+// spendRows counts bought by a facet type with facetData and adds up what
+// was paid for each value, largest spend first. A figure in several releases
+// is counted in each, with its price split evenly between them, so the rows
+// add up to what was spent.
+func spendRows(bought Checklist, prices []float64, searchType string) []SpendRow {
+	counts := facetData(bought, searchType)
+	spend := make(map[string]float64)
+	for i, figure := range bought.Figures {
+		values := facetValues(figure, searchType)
+		for _, value := range values {
+			spend[value] += prices[i] / float64(len(values))
+		}
+	}
+	var rows []SpendRow
+	for _, value := range SortMapByValueThenKey(counts) {
+		row := SpendRow{Value: value, Count: counts[value], Spend: spend[value]}
+		row.Average = row.Spend / float64(row.Count)
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Spend > rows[j].Spend
+	})
+	return rows
+}
+
+// spendReports works out one report per currency, as prices in different
+// currencies cannot be added up
+func spendReports(purchases []Purchase, checklist Checklist) []SpendReport {
+	figures := make(map[string]Figure)
+	for _, figure := range checklist.Figures {
+		figures[figure.Name] = figure
+	}
+	byCurrency := make(map[string][]Purchase)
+	for _, purchase := range purchases {
+		byCurrency[purchase.Currency] = append(byCurrency[purchase.Currency], purchase)
+	}
+	var reports []SpendReport
+	for currency, bought := range byCurrency {
+		report := SpendReport{Currency: currency, Count: len(bought)}
+		//One figure per purchase, so figures bought twice count twice
+		var boughtFigures Checklist
+		var prices []float64
+		months := make(map[string]*SpendRow)
+		for _, purchase := range bought {
+			report.Total += purchase.Price
+			if figure, exists := figures[purchase.Figure]; exists {
+				boughtFigures.AddItem(figure)
+				prices = append(prices, purchase.Price)
+			}
+			row, exists := months[purchase.Month()]
+			if !exists {
+				row = &SpendRow{Value: purchase.Month()}
+				months[purchase.Month()] = row
+			}
+			row.Count++
+			row.Spend += purchase.Price
+		}
+		report.Releases = spendRows(boughtFigures, prices, "release")
+		report.Factions = spendRows(boughtFigures, prices, "faction")
+		report.Scales = spendRows(boughtFigures, prices, "scale")
+		for _, row := range months {
+			row.Average = row.Spend / float64(row.Count)
+			report.Months = append(report.Months, *row)
+		}
+		sort.Slice(report.Months, func(i, j int) bool {
+			return report.Months[i].Value > report.Months[j].Value
+		})
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Count != reports[j].Count {
+			return reports[i].Count > reports[j].Count
+		}
+		return reports[i].Currency < reports[j].Currency
+	})
+	return reports
+}
+
+// userPurchases lists an account's purchases, newest first
+func userPurchases(user string) ([]Purchase, error) {
+	var purchases, mine []Purchase
+	if err := readDocument(purchasesDocument, &purchases); err != nil {
+		return nil, err
+	}
+	for _, purchase := range purchases {
+		if purchase.User == user {
+			mine = append(mine, purchase)
+		}
+	}
+	sort.SliceStable(mine, func(i, j int) bool {
+		return mine[i].Date > mine[j].Date
+	})
+	return mine, nil
+}
+
+// purchaseFromRequest reads and checks a purchase from the page form or a JSON body
+func purchaseFromRequest(r *http.Request) (Purchase, error) {
+	var purchase Purchase
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&purchase); err != nil {
+			return purchase, err
+		}
+	} else {
+		purchase.Figure = r.FormValue("figure")
+		purchase.Currency = r.FormValue("currency")
+		purchase.Date = r.FormValue("date")
+		purchase.Vendor = r.FormValue("vendor")
+		purchase.Condition = r.FormValue("condition")
+		price, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("price")), 64)
+		if err != nil {
+			return purchase, fmt.Errorf("the price must be a number")
+		}
+		purchase.Price = price
+	}
+	purchase.Figure = strings.TrimSpace(purchase.Figure)
+	purchase.Currency = strings.ToUpper(strings.TrimSpace(purchase.Currency))
+	purchase.Vendor = strings.TrimSpace(purchase.Vendor)
+	if purchase.Date == "" {
+		purchase.Date = time.Now().Format("2006-01-02")
+	}
+	if _, err := repo.Figure(purchase.Figure); err == ErrNotFound {
+		return purchase, fmt.Errorf("no figure named %s", purchase.Figure)
+	} else if err != nil {
+		return purchase, err
+	}
+	if purchase.Price < 0 || math.IsNaN(purchase.Price) || math.IsInf(purchase.Price, 0) {
+		return purchase, fmt.Errorf("the price cannot be negative")
+	}
+	if !currencyCode.MatchString(purchase.Currency) {
+		return purchase, fmt.Errorf("the currency must be a three letter code like USD")
+	}
+	if _, err := time.Parse("2006-01-02", purchase.Date); err != nil {
+		return purchase, fmt.Errorf("the date must look like 2006-01-02")
+	}
+	if !containsString(purchaseConditions, purchase.Condition) {
+		return purchase, fmt.Errorf("the condition must be one of %s", strings.Join(purchaseConditions, ", "))
+	}
+	return purchase, nil
+}
+
+// Data for the ledger page
+type LedgerPageData struct {
+	Title     string
+	User      string
+	CSRF      string
+	Today     string
+	Currency  string
+	Purchases []Purchase
+	Reports   []SpendReport
+	Slugs     map[string]string
+	Checklist Checklist
+}
+
+// Page listing the caller's purchases with spend reports
+func ledgerHandler(w http.ResponseWriter, r *http.Request) {
+	purchases, err := userPurchases(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata LedgerPageData
+	pagedata.Title = "Purchase Ledger"
+	pagedata.User = requestUser(r)
+	pagedata.CSRF = requestCSRF(r)
+	pagedata.Today = time.Now().Format("2006-01-02")
+	pagedata.Currency = "USD"
+	if len(purchases) > 0 {
+		pagedata.Currency = purchases[0].Currency
+	}
+	pagedata.Purchases = purchases
+	pagedata.Reports = spendReports(purchases, checklist)
+	pagedata.Slugs = make(map[string]string)
+	for _, figure := range checklist.Figures {
+		pagedata.Slugs[figure.Name] = figure.Slug()
+	}
+	pagedata.Checklist = checklist
+	renderTemplate(w, ledgertpl, pagedata)
+}
+
+// Records a purchase, marking the figure owned if it is not in the collection yet
+func createPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	purchase, err := purchaseFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	purchase.ID = newID()
+	purchase.User = requestUser(r)
+	var purchases []Purchase
+	err = updateDocument(purchasesDocument, &purchases, func() error {
+		purchases = append(purchases, purchase)
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	err = updateCollection(purchase.User, func(collection *Collection) error {
+		if collection.Status(purchase.Figure) != "owned" && collection.Status(purchase.Figure) != "for_trade" {
+			collection.setStatus(purchase.Figure, "owned")
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, purchase)
+		return
+	}
+	http.Redirect(w, r, "/ledger", http.StatusSeeOther)
+}
+
+// Deletes one of the caller's purchases
+func deletePurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	user := requestUser(r)
+	var purchases []Purchase
+	found := false
+	err := updateDocument(purchasesDocument, &purchases, func() error {
+		for i, purchase := range purchases {
+			if purchase.ID == id && purchase.User == user {
+				purchases = append(purchases[:i], purchases[i+1:]...)
+				found = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/ledger", http.StatusSeeOther)
+}
+
+// API listing the caller's purchases
+func ledgerAPIHandler(w http.ResponseWriter, r *http.Request) {
+	purchases, err := userPurchases(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if purchases == nil {
+		purchases = []Purchase{}
+	}
+	writeJSON(w, purchases)
+}
+
+// API returning the caller's spend reports
+func ledgerReportAPIHandler(w http.ResponseWriter, r *http.Request) {
+	purchases, err := userPurchases(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	reports := spendReports(purchases, checklist)
+	if reports == nil {
+		reports = []SpendReport{}
+	}
+	writeJSON(w, reports)
+}
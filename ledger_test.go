@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestSpendRowsSplitReleases(t *testing.T) {
+	bought := Checklist{Figures: []Figure{
+		{Name: "Knight", Faction: "ORDER", Release: []string{"WAVE 1", "ALL STARS"}},
+		{Name: "Squire", Faction: "ORDER", Release: []string{"WAVE 1"}},
+	}}
+	prices := []float64{40, 30}
+
+	tests := []struct {
+		searchType string
+		want       map[string]SpendRow
+	}{
+		{"release", map[string]SpendRow{
+			"WAVE 1":    {Value: "WAVE 1", Count: 2, Spend: 50, Average: 25},
+			"ALL STARS": {Value: "ALL STARS", Count: 1, Spend: 20, Average: 20},
+		}},
+		{"faction", map[string]SpendRow{
+			"ORDER": {Value: "ORDER", Count: 2, Spend: 70, Average: 35},
+		}},
+	}
+	for _, test := range tests {
+		rows := spendRows(bought, prices, test.searchType)
+		total := 0.0
+		for _, row := range rows {
+			total += row.Spend
+			if row != test.want[row.Value] {
+				t.Errorf("%s %s: %+v, want %+v", test.searchType, row.Value, row, test.want[row.Value])
+			}
+		}
+		if len(rows) != len(test.want) || total != 70 {
+			t.Errorf("%s: %d rows adding up to %v, want %d adding up to 70", test.searchType, len(rows), total, len(test.want))
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"rsc.io/qr"
+)
+
+// Figures listed on a label before the rest are summed up
+const labelFigures = 8
+
+// StorageLocation is a bin or shelf and the figures kept in it
+type StorageLocation struct {
+	Name    string   `json:"name"`
+	Figures []string `json:"figures"`
+}
+
+// storageLocations groups a collection's stored figures by location, by name
+func storageLocations(collection Collection) []StorageLocation {
+	byName := make(map[string][]string)
+	for figure, location := range collection.Locations {
+		byName[location] = append(byName[location], figure)
+	}
+	var locations []StorageLocation
+	for name, figures := range byName {
+		sort.Strings(figures)
+		locations = append(locations, StorageLocation{name, figures})
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].Name < locations[j].Name
+	})
+	return locations
+}
+
+// locationURL is the address of a location's page
+func locationURL(r *http.Request, name string) string {
+	return siteURL(r) + "/locations/" + url.PathEscape(name)
+}
+
+// qrSVG draws a QR code of text as SVG, one path of black runs per row
+func qrSVG(text string, x, y, size int) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	//Four modules of quiet zone on every side
+	modules := code.Size + 8
+	var path strings.Builder
+	for row := 0; row < code.Size; row++ {
+		for col := 0; col < code.Size; col++ {
+			if !code.Black(col, row) {
+				continue
+			}
+			run := 1
+			for col+run < code.Size && code.Black(col+run, row) {
+				run++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", col+4, row+4, run, run)
+			col += run - 1
+		}
+	}
+	return fmt.Sprintf(`<svg x="%d" y="%d" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		x, y, size, size, modules, modules, modules, modules, path.String()), nil
+}
+
+// labelText shortens s to fit a label line
+func labelText(s string, length int) string {
+	if len([]rune(s)) > length {
+		s = string([]rune(s)[:length-1]) + "…"
+	}
+	return html.EscapeString(s)
+}
+
+// labelSVG draws a printable label for a location: its name, what is in it
+// and a QR code linking to its page
+func labelSVG(location StorageLocation, link string) (string, error) {
+	code, err := qrSVG(link, 236, 16, 168)
+	if err != nil {
+		return "", err
+	}
+	var label strings.Builder
+	label.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 420 200" width="420" height="200" font-family="sans-serif">`)
+	label.WriteString(`<rect x="1" y="1" width="418" height="198" fill="#fff" stroke="#000" stroke-width="2"/>`)
+	fmt.Fprintf(&label, `<text x="16" y="38" font-size="24" font-weight="bold">%s</text>`, labelText(location.Name, 18))
+	count := fmt.Sprintf("%d figures", len(location.Figures))
+	if len(location.Figures) == 1 {
+		count = "1 figure"
+	}
+	fmt.Fprintf(&label, `<text x="16" y="60" font-size="13">%s</text>`, count)
+	for i, figure := range location.Figures {
+		line := labelText(figure, 30)
+		if i == labelFigures-1 && len(location.Figures) > labelFigures {
+			line = fmt.Sprintf("and %d more", len(location.Figures)-i)
+		}
+		fmt.Fprintf(&label, `<text x="16" y="%d" font-size="12">%s</text>`, 82+i*15, line)
+		if i == labelFigures-1 {
+			break
+		}
+	}
+	label.WriteString(code)
+	label.WriteString(`</svg>`)
+	return label.String(), nil
+}
+
+// Data for the storage pages
+type LocationsPageData struct {
+	Title     string
+	User      string
+	CSRF      string
+	Locations []StorageLocation
+	Location  StorageLocation
+	Figure    string
+	Found     string
+	Status    string
+	Stored    Checklist
+	Unstored  Checklist
+	Slugs     map[string]string
+}
+
+// Data for the printable label sheet
+type LabelsPageData struct {
+	Title  string
+	Labels []template.HTML
+}
+
+// locationsPage gathers what the storage pages show for the caller
+func locationsPage(w http.ResponseWriter, r *http.Request) (LocationsPageData, Collection, bool) {
+	var pagedata LocationsPageData
+	collection, err := userCollection(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return pagedata, collection, false
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return pagedata, collection, false
+	}
+	pagedata.User = requestUser(r)
+	pagedata.CSRF = requestCSRF(r)
+	pagedata.Locations = storageLocations(collection)
+	pagedata.Slugs = make(map[string]string)
+	for _, figure := range checklist.Figures {
+		pagedata.Slugs[figure.Name] = figure.Slug()
+		status := collection.Status(figure.Name)
+		if status != "owned" && status != "for_trade" {
+			continue
+		}
+		if _, stored := collection.Locations[figure.Name]; stored {
+			pagedata.Stored.AddItem(figure)
+		} else {
+			pagedata.Unstored.AddItem(figure)
+		}
+	}
+	return pagedata, collection, true
+}
+
+// Page listing the caller's locations, answering where a figure is kept
+func locationsHandler(w http.ResponseWriter, r *http.Request) {
+	pagedata, collection, ok := locationsPage(w, r)
+	if !ok {
+		return
+	}
+	pagedata.Title = "Storage"
+	pagedata.Figure = strings.TrimSpace(r.FormValue("figure"))
+	if pagedata.Figure != "" {
+		pagedata.Status = collection.Status(pagedata.Figure)
+		pagedata.Found = collection.Locations[pagedata.Figure]
+	}
+	renderTemplate(w, locationstpl, pagedata)
+}
+
+// Page listing what is kept in one location
+func locationHandler(w http.ResponseWriter, r *http.Request) {
+	pagedata, _, ok := locationsPage(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["location"]
+	for _, location := range pagedata.Locations {
+		if location.Name == name {
+			pagedata.Location = location
+		}
+	}
+	if pagedata.Location.Name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	pagedata.Title = "Storage: " + name
+	renderTemplate(w, locationstpl, pagedata)
+}
+
+// LocationChange puts a figure in a location, or takes it out with an empty location
+type LocationChange struct {
+	Figure   string `json:"figure"`
+	Location string `json:"location"`
+}
+
+// Stores a figure in a location, from the page form or a JSON body
+func setLocationHandler(w http.ResponseWriter, r *http.Request) {
+	var change LocationChange
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		change.Figure = r.FormValue("figure")
+		change.Location = r.FormValue("location")
+	}
+	change.Figure = strings.TrimSpace(change.Figure)
+	change.Location = strings.TrimSpace(change.Location)
+	if len(change.Location) > 64 || strings.ContainsAny(change.Location, "/\n") {
+		http.Error(w, "location names are up to 64 characters without slashes", http.StatusBadRequest)
+		return
+	}
+	notOnHand := false
+	err := updateCollection(requestUser(r), func(collection *Collection) error {
+		status := collection.Status(change.Figure)
+		if status != "owned" && status != "for_trade" {
+			notOnHand = true
+			return nil
+		}
+		if change.Location == "" {
+			delete(collection.Locations, change.Figure)
+			return nil
+		}
+		if collection.Locations == nil {
+			collection.Locations = make(map[string]string)
+		}
+		collection.Locations[change.Figure] = change.Location
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if notOnHand {
+		http.Error(w, change.Figure+" is not in your collection", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, change)
+		return
+	}
+	if change.Location == "" {
+		http.Redirect(w, r, "/locations", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/locations/"+url.PathEscape(change.Location), http.StatusSeeOther)
+}
+
+// API listing the caller's locations, or where one figure is with ?figure=
+func locationsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	collection, err := userCollection(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if figure := r.FormValue("figure"); figure != "" {
+		writeJSON(w, LocationChange{Figure: figure, Location: collection.Locations[figure]})
+		return
+	}
+	locations := storageLocations(collection)
+	if locations == nil {
+		locations = []StorageLocation{}
+	}
+	writeJSON(w, locations)
+}
+
+// Label for one location as an SVG file
+func locationLabelHandler(w http.ResponseWriter, r *http.Request) {
+	collection, err := userCollection(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	name := mux.Vars(r)["location"]
+	for _, location := range storageLocations(collection) {
+		if location.Name != name {
+			continue
+		}
+		label, err := labelSVG(location, locationURL(r, name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		fmt.Fprint(w, label)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Printable sheet with a label for every location
+func labelsHandler(w http.ResponseWriter, r *http.Request) {
+	collection, err := userCollection(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata LabelsPageData
+	pagedata.Title = "Storage Labels"
+	for _, location := range storageLocations(collection) {
+		label, err := labelSVG(location, locationURL(r, location.Name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		//Built from escaped text only
+		pagedata.Labels = append(pagedata.Labels, template.HTML(label))
+	}
+	renderTemplate(w, labelstpl, pagedata)
+}
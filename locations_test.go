@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStorageLocations(t *testing.T) {
+	collection := Collection{Locations: map[string]string{"Squire": "Shelf", "Knight": "Bin 2", "Archer": "Shelf"}}
+	want := []StorageLocation{{"Bin 2", []string{"Knight"}}, {"Shelf", []string{"Archer", "Squire"}}}
+	if got := storageLocations(collection); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := storageLocations(Collection{}); got != nil {
+		t.Errorf("no locations gave %+v", got)
+	}
+}
+
+func TestSetLocationHandler(t *testing.T) {
+	signIn(t)
+	if err := updateCollection("boss", func(collection *Collection) error {
+		collection.setStatus("Knight", "owned")
+		collection.setStatus("Squire", "for_trade")
+		collection.setStatus("Page", "wanted")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		body     string
+		want     int
+		location string
+	}{
+		{"owned", `{"figure": "Knight", "location": " Bin 2 "}`, http.StatusOK, "Bin 2"},
+		{"spare for trade", `{"figure": "Squire", "location": "Shelf"}`, http.StatusOK, "Shelf"},
+		{"wanted", `{"figure": "Page", "location": "Shelf"}`, http.StatusBadRequest, ""},
+		{"not in the collection", `{"figure": "Imp", "location": "Shelf"}`, http.StatusBadRequest, ""},
+		{"slash in the name", `{"figure": "Knight", "location": "Bin/3"}`, http.StatusBadRequest, "Bin 2"},
+		{"too long", fmt.Sprintf(`{"figure": "Knight", "location": "%s"}`, strings.Repeat("x", 65)), http.StatusBadRequest, "Bin 2"},
+		{"taken out", `{"figure": "Knight", "location": ""}`, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/locations", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer ldx_token")
+		w := httptest.NewRecorder()
+		authenticate(http.HandlerFunc(setLocationHandler)).ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+		collection, err := userCollection("boss")
+		if err != nil {
+			t.Fatal(err)
+		}
+		figure := strings.SplitN(strings.SplitN(test.body, `"figure": "`, 2)[1], `"`, 2)[0]
+		if location, stored := collection.Locations[figure]; location != test.location || stored != (test.location != "") {
+			t.Errorf("%s: %s is in %q", test.name, figure, location)
+		}
+	}
+}
+
+func TestLabelSVG(t *testing.T) {
+	var figures []string
+	for i := 1; i <= 10; i++ {
+		figures = append(figures, fmt.Sprintf("Figure %d", i))
+	}
+	tests := []struct {
+		name     string
+		location StorageLocation
+		has      []string
+		hasNot   []string
+	}{
+		{"one figure", StorageLocation{"Shelf", []string{"Knight"}}, []string{">Shelf<", ">1 figure<", ">Knight<"}, nil},
+		{"long names", StorageLocation{"A very long shelf name indeed", []string{strings.Repeat("Knight ", 10)}},
+			[]string{">A very long shelf…<", ">Knight Knight Knight Knight K…<"}, []string{"indeed"}},
+		{"just enough figures", StorageLocation{"Bin", figures[:8]}, []string{">8 figures<", ">Figure 8<"}, []string{"more"}},
+		{"too many figures", StorageLocation{"Bin", figures}, []string{">10 figures<", ">Figure 7<", ">and 3 more<"}, []string{">Figure 8<"}},
+		{"markup", StorageLocation{"<script>alert(1)</script>", []string{`Knight & "Squire"`}},
+			[]string{"&lt;script&gt;", "Knight &amp; &#34;Squire&#34;"}, []string{"<script>"}},
+	}
+	for _, test := range tests {
+		label, err := labelSVG(test.location, "https://example.com/locations/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range test.has {
+			if !strings.Contains(label, s) {
+				t.Errorf("%s: label lacks %q", test.name, s)
+			}
+		}
+		for _, s := range test.hasNot {
+			if strings.Contains(label, s) {
+				t.Errorf("%s: label has %q", test.name, s)
+			}
+		}
+	}
+}
+
+func TestLabelsHandlerEscapes(t *testing.T) {
+	signIn(t)
+	if err := loadTemplates(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateCollection("boss", func(collection *Collection) error {
+		collection.setStatus("Knight", "owned")
+		collection.Locations = map[string]string{"Knight": "<script>alert(1)</script>"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/locations/labels", nil)
+	r.Header.Set("Authorization", "Bearer ldx_token")
+	w := httptest.NewRecorder()
+	authenticate(http.HandlerFunc(labelsHandler)).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "<script>alert") || !strings.Contains(body, "&lt;script&gt;alert(1)") {
+		t.Errorf("location name not escaped on the label sheet:\n%s", body)
+	}
+}
@@ -2,43 +2,55 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-// Define Global Variables
-var checklist Checklist
-
-// Misc Globals
-var lightFactions []string = []string{"ARMY OF LEODYSSEUS", "ORDER OF EATHYRON", "CONVOCATION OF BASSYLIA", "XYLONA'S FLOCK"}
-var darkFactions []string = []string{"LEGION OF ARETHYR", "CONGREGATION OF NECRONOMINUS", "ILLYTHIA'S BROOD", "CIRCLE OF POXXUS"}
-var splinterFactions []string = []string{"SONS OF THE RED STAR", "HOUSE OF THE NOBLE BEAR"}
-var goblinRaces []string = []string{"GOBLIN", "GREATER GOBLIN", "SWALE GOBLIN", "WOODLAND GOBLIN (FUZZMUNK)", "GOBLINS"}
-var orcRaces []string = []string{"ORC", "HUMAN - HALF-ORC", "LICHEN ORC", "ORAPHIM", "ORC AND HUMAN", "SHADOW ORC", "UUBYR"}
-var elfRaces []string = []string{"ELF", "SHADOW ELF", "FAERIE ELF", "ELF - WHISPERLING", "FROST ELF", "WHISPERLING", "WOOD ELF"}
-var dwarfRaces []string = []string{"DWARF", "DWARVES", "DWARVEN SKELETON"}
-var vampireRaces []string = []string{"VAMPIRE", "UUBYR", "VARGG", "VOGYRR"}
-var undeadRaces []string = []string{"SKELETON", "ARAKKIGHAST", "GHOST", "GHOUL", "LICH", "POISON SKELETON", "TURPICULUS", "UMANGEIST", "UNDEAD HORSE", "UNDEAD ANGEL"}
-var anthroRaces []string = []string{"AVIAN", "BOARRIOR", "CENTAUR", "DRAGOSYR", "EAGLE", "FAUN", "ELDER FROST DEER", "JAGUALLIAN", "MINOTAUR", "MOOSE", "NORTHLANDS MINOTAUR", "SATYR", "SKORRIAN", "SWALE GOBLIN", "WOODLAND GOBLIN (FUZZMUNK)"}
-
-// Templates
-var tpl = template.Must(template.ParseFiles("static/index.html"))
-var hometpl = template.Must(template.ParseFiles("static/home.html"))
-var detailtpl = template.Must(template.ParseFiles("static/detail.html"))
-var drilldowntpl = template.Must(template.ParseFiles("static/drilldown.html"))
+// Templates, parsed at startup by loadTemplates
+var tpl *template.Template
+var hometpl *template.Template
+var detailtpl *template.Template
+var drilldowntpl *template.Template
+var comparetpl *template.Template
+var figuretpl *template.Template
+var searchestpl *template.Template
+var logintpl *template.Template
+var accounttpl *template.Template
+var collectiontpl *template.Template
+var profiletpl *template.Template
+var tradestpl *template.Template
+var ledgertpl *template.Template
+var locationstpl *template.Template
+var labelstpl *template.Template
+var pledgestpl *template.Template
+var pledgetpl *template.Template
+var upcomingtpl *template.Template
+var unreleasedtpl *template.Template
+var partstpl *template.Template
+var kitbashtpl *template.Template
+var recipetpl *template.Template
+var adminreleasestpl *template.Template
+var changestpl *template.Template
+var admintpl *template.Template
+var adminfiguretpl *template.Template
+var suggesttpl *template.Template
+var proposalstpl *template.Template
 
 // Struct just to hold figures
 type Checklist struct {
-	Figures []Figure `json:"figures"`
+	SchemaVersion int      `json:"schema_version,omitempty"`
+	Figures       []Figure `json:"figures"`
 }
 
 // Add a Figure to the Checklist
@@ -55,6 +67,44 @@ type Figure struct {
 	Release []string `json:"released"`
 	Url     string   `json:"url"`
 	Scale   string   `json:"scale"`
+	Image   string   `json:"image,omitempty"`
+	Parts   []Part   `json:"parts,omitempty"`
+}
+
+// Part is a piece a figure comes with, e.g. a helmet or a shield
+type Part struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Colors    []string `json:"colors,omitempty"`
+	Materials []string `json:"materials,omitempty"`
+}
+
+// Slug is the Figure name as used in URLs, e.g. "Heroic Paladin / Cleric" is "heroic-paladin-cleric"
+func (figure Figure) Slug() string {
+	var slug strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(figure.Name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			slug.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return slug.String()
+}
+
+// figureBySlug finds a Figure in a Checklist from its Slug
+func figureBySlug(lst Checklist, slug string) (Figure, bool) {
+	for _, figure := range lst.Figures {
+		if figure.Slug() == slug {
+			return figure, true
+		}
+	}
+	return Figure{}, false
 }
 
 // Data for the Home Page
@@ -99,18 +149,90 @@ type DetailPageData struct {
 	List3      map[string]int
 	List4Title string
 	List4      map[string]int
+	//Figures left out because they are not released, and the toggle for them
+	Hidden         int
+	ShowUnreleased bool
+	Path           string
 }
 
-// Parse JSON data in Figures and Checklist
-func loadDatabase() {
-	db, err := ioutil.ReadFile("figurechecklist.json")
-	if err != nil {
-		fmt.Println(err)
+// Data for a single Figure
+type FigurePageData struct {
+	Title   string
+	Figure  Figure
+	Similar []SimilarFigure
+}
+
+// Parse JSON data in Figures and Checklist, later files replace figures of the same name
+func loadDatabase() error {
+	start := time.Now()
+	paths := config.DataFiles
+	if len(paths) == 0 {
+		paths = []string{""}
 	}
-	err = json.Unmarshal(db, &checklist)
+	var merged Checklist
+	var info DatasetInfo
+	seen := make(map[string]int)
+	for _, path := range paths {
+		db, err := readDatabase(path)
+		if err != nil {
+			return err
+		}
+		var part Checklist
+		if err := json.Unmarshal(db, &part); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if path == "" {
+			path = "embedded"
+		} else if stat, err := os.Stat(path); err == nil && stat.ModTime().After(info.ModTime) {
+			info.ModTime = stat.ModTime()
+		}
+		info.Sources = append(info.Sources, path)
+		for _, problem := range validateChecklist(part) {
+			info.Errors = append(info.Errors, path+": "+problem)
+		}
+		for _, figure := range part.Figures {
+			if i, exists := seen[figure.Name]; exists {
+				merged.Figures[i] = figure
+				continue
+			}
+			seen[figure.Name] = len(merged.Figures)
+			merged.AddItem(figure)
+		}
+	}
+	info.Loaded = true
+	info.Valid = len(info.Errors) == 0
+	info.LoadedAt = time.Now()
+	info.SchemaVersion = schemaVersion
+	for _, problem := range info.Errors {
+		log.Printf("invalid data: %s", problem)
+	}
+
+	if err := repo.ImportFigures(merged); err != nil {
+		return err
+	}
+	//Figures edited through the repository count as part of the data
+	stored, err := repo.Figures(nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	info.Figures = len(stored.Figures)
+	info.Checksum = datasetChecksum(stored)
+	info.ReleasesChecksum = releasesChecksum()
+	datasetMu.Lock()
+	info.Reloading = datasetInfo.Reloading
+	//A reload must not take Last-Modified back, and changed data is new now
+	//however old its file is
+	if datasetInfo.Loaded {
+		if info.Checksum != datasetInfo.Checksum || info.ReleasesChecksum != datasetInfo.ReleasesChecksum {
+			info.ModTime = time.Now()
+		} else if datasetInfo.ModTime.After(info.ModTime) {
+			info.ModTime = datasetInfo.ModTime
+		}
 	}
+	datasetInfo = info
+	datasetMu.Unlock()
+	metrics.DatasetLoaded(info.Figures, time.Since(start))
+	return nil
 }
 
 // Sort a Checklist by Figure names
@@ -123,37 +245,189 @@ func sortChecklist(lst Checklist) Checklist {
 }
 
 func main() {
-	loadDatabase()
-	raceData(checklist)
-	factionData(checklist)
-	roleData(checklist)
-	releaseData(checklist)
-	scaleData(checklist)
-
-	//Page Server
-	//If there is a preconfigured port
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		os.Exit(buildCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(hashPasswordCommand(os.Args[2:]))
+	}
+	startup(flag.NewFlagSet("legionsdex", flag.ContinueOnError), os.Args[1:])
+	reloadOnHangup()
+	go generateImages(currentChecklist())
+	go checkSavedSearches(currentChecklist())
+
+	//Start Port Listener/Web Server
+	code := serve(config, newServer(config, newRouter()))
+	if err := repo.Close(); err != nil {
+		log.Printf("storage: %v", err)
+	}
+	os.Exit(code)
+}
+
+// startup resolves the configuration and loads templates, groups and figures
+func startup(fs *flag.FlagSet, args []string) {
+	var err error
+	if config, err = loadConfig(fs, args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		fatal(exitConfig, "%v", err)
+	}
+	log.Printf("effective configuration:\n%s", formatConfig(config))
+	if err := loadTemplates(config.TemplateDir); err != nil {
+		fatal(exitConfig, "templates: %v", err)
+	}
+	if err := loadTaxonomy(config.TaxonomyFile); err != nil {
+		fatal(exitConfig, "taxonomy: %v", err)
 	}
+	if repo, err = openRepository(config); err != nil {
+		fatal(exitConfig, "storage: %v", err)
+	}
+	if err := loadDatabase(); err != nil {
+		repo.Close()
+		fatal(exitConfig, "database: %v", err)
+	}
+	recordChanges(currentChecklist(), currentDatasetInfo())
+}
+
+// newRouter registers every page handler on a new Mux router
+func newRouter() *mux.Router {
 	//Mux Http Handler
-	router := mux.NewRouter()
+	router := mux.NewRouter().UseEncodedPath()
+	router.Use(decodeVars, instrument, compress)
+	router.NotFoundHandler = instrument(http.NotFoundHandler())
+	if config.Features.Metrics {
+		router.HandleFunc("/metrics", metricsHandler)
+	}
+	router.HandleFunc("/healthz", healthzHandler)
+	router.HandleFunc("/readyz", readyzHandler)
+	//Define Static Resources
+	router.PathPrefix("/static").Handler(staticHandler())
+	router.HandleFunc("/images/{size}/{figure}.jpg", imageHandler)
+	//Pages that look at who is signed in; the others skip the lookup
+	authed := router.NewRoute().Subrouter()
+	authed.Use(authenticate)
+	//Personal pages, which differ per user, are never cached and need a login
+	personal := authed.NewRoute().Subrouter()
+	personal.Use(requireLogin)
+	authed.HandleFunc("/unreleased", unreleasedHandler).Methods("GET")
+	authed.HandleFunc("/unreleased", unreleasedToggleHandler).Methods("POST")
+	registerAccounts(authed, personal)
+	if config.Features.SavedSearches {
+		personal.HandleFunc("/searches", searchesHandler).Methods("GET")
+		personal.HandleFunc("/searches", createSearchHandler).Methods("POST")
+		personal.HandleFunc("/searches/{id}/delete", deleteSearchHandler).Methods("POST")
+		personal.HandleFunc("/api/searches", searchesAPIHandler).Methods("GET")
+		personal.HandleFunc("/api/searches", createSearchHandler).Methods("POST")
+		personal.HandleFunc("/api/searches/{id}", deleteSearchHandler).Methods("DELETE")
+		personal.HandleFunc("/api/inbox", inboxAPIHandler).Methods("GET")
+	}
+	personal.HandleFunc("/collection", collectionHandler).Methods("GET")
+	personal.HandleFunc("/collection", setCollectionHandler).Methods("POST")
+	personal.HandleFunc("/collection/visibility", collectionVisibilityHandler).Methods("POST")
+	personal.HandleFunc("/api/collection", collectionAPIHandler).Methods("GET")
+	personal.HandleFunc("/api/collection", setCollectionHandler).Methods("POST")
+	personal.HandleFunc("/trades", tradesHandler).Methods("GET")
+	personal.HandleFunc("/api/trades", tradesAPIHandler).Methods("GET")
+	personal.HandleFunc("/ledger", ledgerHandler).Methods("GET")
+	personal.HandleFunc("/ledger", createPurchaseHandler).Methods("POST")
+	personal.HandleFunc("/ledger/{id}/delete", deletePurchaseHandler).Methods("POST")
+	personal.HandleFunc("/api/ledger", ledgerAPIHandler).Methods("GET")
+	personal.HandleFunc("/api/ledger", createPurchaseHandler).Methods("POST")
+	personal.HandleFunc("/api/ledger/report", ledgerReportAPIHandler).Methods("GET")
+	personal.HandleFunc("/api/ledger/{id}", deletePurchaseHandler).Methods("DELETE")
+	personal.HandleFunc("/locations", locationsHandler).Methods("GET")
+	personal.HandleFunc("/locations", setLocationHandler).Methods("POST")
+	personal.HandleFunc("/locations/{location}", locationHandler).Methods("GET")
+	personal.HandleFunc("/locations/{location}/label.svg", locationLabelHandler).Methods("GET")
+	personal.HandleFunc("/labels", labelsHandler).Methods("GET")
+	personal.HandleFunc("/api/locations", locationsAPIHandler).Methods("GET")
+	personal.HandleFunc("/api/locations", setLocationHandler).Methods("POST")
+	personal.HandleFunc("/pledges", pledgesHandler).Methods("GET")
+	personal.HandleFunc("/pledges", createPledgeHandler).Methods("POST")
+	personal.HandleFunc("/pledges/reconcile", reconcileHandler).Methods("GET")
+	personal.HandleFunc("/pledges/{id}", pledgeHandler).Methods("GET")
+	personal.HandleFunc("/pledges/{id}", editPledgeHandler).Methods("POST")
+	personal.HandleFunc("/pledges/{id}/delete", deletePledgeHandler).Methods("POST")
+	personal.HandleFunc("/pledges/{id}/reconcile", reconcilePledgeHandler).Methods("POST")
+	personal.HandleFunc("/api/pledges", pledgesAPIHandler).Methods("GET")
+	personal.HandleFunc("/api/pledges", createPledgeHandler).Methods("POST")
+	personal.HandleFunc("/api/pledges/{id}/reconcile", reconcilePledgeHandler).Methods("POST")
+	personal.HandleFunc("/kitbash", kitbashesHandler).Methods("GET")
+	personal.HandleFunc("/kitbash", createKitbashHandler).Methods("POST")
+	personal.HandleFunc("/kitbash/{id}", kitbashHandler).Methods("GET")
+	personal.HandleFunc("/kitbash/{id}", editKitbashHandler).Methods("POST")
+	personal.HandleFunc("/kitbash/{id}/delete", deleteKitbashHandler).Methods("POST")
+	personal.HandleFunc("/api/kitbash", kitbashesAPIHandler).Methods("GET")
+	personal.HandleFunc("/api/kitbash", createKitbashHandler).Methods("POST")
+	personal.HandleFunc("/api/kitbash/{id}", deleteKitbashHandler).Methods("DELETE")
+	authed.HandleFunc("/u/{name}", profileHandler).Methods("GET")
+	authed.HandleFunc("/recipe/{id}", recipeHandler).Methods("GET")
+	if config.Features.Suggest {
+		authed.HandleFunc("/suggest", suggestPickerHandler).Methods("GET")
+		authed.HandleFunc("/figure/{figure}/suggest", suggestHandler).Methods("GET")
+		authed.HandleFunc("/figure/{figure}/suggest", submitSuggestionHandler).Methods("POST")
+	}
+	if len(config.AdminUsers) > 0 {
+		registerAdmin(router)
+	}
+	if config.Features.WebhookReceiver {
+		router.HandleFunc("/hooks/test", webhookTestHandler).Methods("GET", "POST")
+	}
+
+	//Pages rendered from the dataset, which can be cached until it changes
+	pages := router.NewRoute().Subrouter()
+	pages.Use(conditionalGet)
+	registerPages(pages)
+	return router
+}
+
+// registerPages adds the directory, detail and drilldown pages
+func registerPages(router *mux.Router) {
 	//Request handlers
 	router.HandleFunc("/", homeHandler)
 	router.HandleFunc("/race/", raceDirHandler)
 	router.HandleFunc("/race/{race}", raceHandler)
-	router.HandleFunc("/races/{races}", racesHandler)
 	router.HandleFunc("/faction/", factionDirHandler)
 	router.HandleFunc("/faction/{faction}", factionHandler)
-	router.HandleFunc("/factions/{factions}", factionsHandler)
 	router.HandleFunc("/role/", roleDirHandler)
 	router.HandleFunc("/role/{role}", roleHandler)
 	router.HandleFunc("/release/", releaseDirHandler)
 	router.HandleFunc("/release/{release}", releaseHandler)
 	router.HandleFunc("/scale/", scaleDirHandler)
 	router.HandleFunc("/scale/{scale}", scaleHandler)
+	router.HandleFunc("/figure/{figure}", figureHandler)
+	router.HandleFunc("/api/figure/{figure}/similar", similarAPIHandler)
+	router.HandleFunc("/compare", compareHandler)
+	router.HandleFunc("/api/compare", compareAPIHandler)
+	router.HandleFunc("/api/releases", releasesAPIHandler)
+	router.HandleFunc("/upcoming", upcomingHandler)
+	router.HandleFunc("/calendar.ics", calendarHandler)
+	router.HandleFunc("/parts", partsHandler)
+	router.HandleFunc("/part/{part}", partHandler)
+	router.HandleFunc("/part/{parttype}/{part}", partHandler)
+	router.HandleFunc("/api/parts", partsAPIHandler)
+	router.HandleFunc("/api/figure/{figure}/parts", figurePartsAPIHandler)
+	if config.Features.Groups {
+		router.HandleFunc("/races/{races}", racesHandler)
+		router.HandleFunc("/factions/{factions}", factionsHandler)
+	}
+	if config.Features.Changes {
+		router.HandleFunc("/changes", changesHandler)
+		router.HandleFunc("/changes/figures.atom", figureFeedHandler)
+		router.HandleFunc("/changes/figures.rss", figureFeedHandler)
+		router.HandleFunc("/changes/releases.atom", releaseFeedHandler)
+		router.HandleFunc("/changes/releases.rss", releaseFeedHandler)
+	}
 
 	//Handling Combinations of Requests, stopping at only 2 deep
+	if config.Features.Drilldown {
+		registerDrilldowns(router)
+	}
+}
+
+// registerDrilldowns adds the routes combining two search terms
+func registerDrilldowns(router *mux.Router) {
 	router.HandleFunc("/race/{race}/faction/{faction}", drilldownHandler)
 	router.HandleFunc("/race/{race}/release/{release}", drilldownHandler)
 	router.HandleFunc("/race/{race}/role/{role}", drilldownHandler)
@@ -177,11 +451,21 @@ func main() {
 	router.HandleFunc("/scale/{scale}/race/{race}", drilldownHandler)
 	router.HandleFunc("/scale/{scale}/faction/{faction}", drilldownHandler)
 	router.HandleFunc("/scale/{scale}/role/{role}", drilldownHandler)
-	//Define Static Resources
-	fs := http.FileServer(http.Dir("./static"))
-	router.PathPrefix("/static").Handler(http.StripPrefix("/static/", fs))
-	//Start Port Listener/Web Server
-	http.ListenAndServe(":"+port, router)
+	router.HandleFunc("/scale/{scale}/release/{release}", drilldownHandler)
+}
+
+// decodeVars unescapes the route variables. Routes match the escaped path so
+// that a value with a slash, e.g. PALADIN%2FCLERIC, stays one path segment.
+func decodeVars(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for name, value := range vars {
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				vars[name] = unescaped
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // raceData is a map of the Races with a Count of total instances
@@ -322,23 +606,28 @@ func checklistByScale(lst Checklist, scale string) Checklist {
 // PAGE HANDLER FUNCTIONS
 // Main page and default handler.
 func homeHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	releasesOf := releaseData(checklist)
 	factionsOf := factionData(checklist)
 	racesOf := raceData(checklist)
 	rolesOf := roleData(checklist)
 	//scalesOf := scaleData(checklist)
 	//FACTION FUN
-	lightSide := groupSearch(checklist, "faction", lightFactions)
-	darkSide := groupSearch(checklist, "faction", darkFactions)
-	splinterSide := groupSearch(checklist, "faction", splinterFactions)
+	lightSide := groupSearch(checklist, "faction", taxonomy.Group("faction", "light"))
+	darkSide := groupSearch(checklist, "faction", taxonomy.Group("faction", "dark"))
+	splinterSide := groupSearch(checklist, "faction", taxonomy.Group("faction", "splinter"))
 	//RACE FUN
-	allGoblins := groupSearch(checklist, "race", goblinRaces)
-	allOrcs := groupSearch(checklist, "race", orcRaces)
-	allElves := groupSearch(checklist, "race", elfRaces)
-	allDwarves := groupSearch(checklist, "race", dwarfRaces)
-	allVampires := groupSearch(checklist, "race", vampireRaces)
-	allSkeletons := groupSearch(checklist, "race", undeadRaces)
-	allAnthros := groupSearch(checklist, "race", anthroRaces)
+	allGoblins := groupSearch(checklist, "race", taxonomy.Group("race", "goblin"))
+	allOrcs := groupSearch(checklist, "race", taxonomy.Group("race", "orc"))
+	allElves := groupSearch(checklist, "race", taxonomy.Group("race", "elf"))
+	allDwarves := groupSearch(checklist, "race", taxonomy.Group("race", "dwarf"))
+	allVampires := groupSearch(checklist, "race", taxonomy.Group("race", "vampire"))
+	allSkeletons := groupSearch(checklist, "race", taxonomy.Group("race", "undead"))
+	allAnthros := groupSearch(checklist, "race", taxonomy.Group("race", "anthro"))
 
 	var pagedata HomePageData
 	pagedata.FactionTotal = len(factionsOf)
@@ -357,25 +646,25 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.VampireTotal = len(allVampires.Figures)
 	pagedata.UndeadTotal = len(allSkeletons.Figures)
 
-	if err := hometpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, hometpl, pagedata)
 }
 
 // SECTION: FUNCTIONS BY RACE
 // Page listing directory of Races
 func raceDirHandler(w http.ResponseWriter, r *http.Request) {
 	//Get races from data
-	races := raceData(checklist)
+	races, err := browseCounts(r, "race", nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	//Sort races for display
 	//sortedRaces := SortMapByKeys(races)
 	//valueSortedRaces := SortMapByValue(races)
 	valuekeySortedRaces := SortMapByValueThenKey(races)
 
 	pagedata := &ListPageData{"race", strconv.Itoa(len(races)), races, valuekeySortedRaces}
-	if err := tpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, tpl, pagedata)
 }
 
 // Page listing figures and other data of a specified Race
@@ -384,7 +673,11 @@ func raceHandler(w http.ResponseWriter, r *http.Request) {
 	reqvars := mux.Vars(r)
 	race := reqvars["race"]
 	//Get races from data
-	chk := checklistByRace(checklist, race)
+	chk, hidden, err := browseFigures(r, Filter{"race": race})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 
 	rolesOfRace := roleData(chk)
 	factionsOfRace := factionData(chk)
@@ -397,6 +690,9 @@ func raceHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.Query = race
 	pagedata.Total = strconv.Itoa(len(chk.Figures))
 	pagedata.Checklist = chk
+	pagedata.Hidden = hidden
+	pagedata.ShowUnreleased = showUnreleased(r)
+	pagedata.Path = r.URL.EscapedPath()
 	pagedata.List1Title = "role"
 	pagedata.List1 = rolesOfRace
 	pagedata.List2Title = "faction"
@@ -406,34 +702,21 @@ func raceHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.List4Title = "scale"
 	pagedata.List4 = scalesOfRace
 
-	if err := detailtpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, detailtpl, pagedata)
 }
 
 // Page displaying information about figures from several pre-specified Races
 func racesHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	//parse request data
 	reqvars := mux.Vars(r)
 	races := reqvars["races"]
 	//Get races from data
-	var group []string
-	switch races {
-	case "goblin":
-		group = goblinRaces
-	case "elf":
-		group = elfRaces
-	case "dwarf":
-		group = dwarfRaces
-	case "vampire":
-		group = vampireRaces
-	case "undead":
-		group = undeadRaces
-	case "anthro":
-		group = anthroRaces
-	case "orc":
-		group = orcRaces
-	}
+	group := taxonomy.Group("race", races)
 	chk := groupSearch(checklist, "race", group)
 
 	rolesOfRace := roleData(chk)
@@ -458,23 +741,23 @@ func racesHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.List4Title = "scale"
 	pagedata.List4 = scalesOfRace
 
-	if err := drilldowntpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, drilldowntpl, pagedata)
 }
 
 // SECTION: FUNCTIONS BY FACTION
 // Page listing Factions
 func factionDirHandler(w http.ResponseWriter, r *http.Request) {
 	//Get factions from data
-	factions := factionData(checklist)
+	factions, err := browseCounts(r, "faction", nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	//Sort
 	valuekeySortedFactions := SortMapByValueThenKey(factions)
 	//Present page
 	pagedata := &ListPageData{"faction", strconv.Itoa(len(factions)), factions, valuekeySortedFactions}
-	if err := tpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, tpl, pagedata)
 }
 
 // Page displaying data for Figures of a Faction
@@ -483,7 +766,11 @@ func factionHandler(w http.ResponseWriter, r *http.Request) {
 	reqvars := mux.Vars(r)
 	faction := reqvars["faction"]
 	//Get factions from data
-	chk := checklistByFaction(checklist, faction)
+	chk, hidden, err := browseFigures(r, Filter{"faction": faction})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 
 	rolesOfFaction := roleData(chk)
 	racesOfFaction := raceData(chk)
@@ -496,6 +783,9 @@ func factionHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.Query = faction
 	pagedata.Total = strconv.Itoa(len(chk.Figures))
 	pagedata.Checklist = chk
+	pagedata.Hidden = hidden
+	pagedata.ShowUnreleased = showUnreleased(r)
+	pagedata.Path = r.URL.EscapedPath()
 	pagedata.List1Title = "role"
 	pagedata.List1 = rolesOfFaction
 	pagedata.List2Title = "race"
@@ -505,26 +795,21 @@ func factionHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.List4Title = "scale"
 	pagedata.List4 = scalesofFaction
 
-	if err := detailtpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, detailtpl, pagedata)
 }
 
 // Page displaying information of several pre-specified Factions
 func factionsHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	//parse request data
 	reqvars := mux.Vars(r)
 	factions := reqvars["factions"]
 	//Get factions from data
-	var group []string
-	switch factions {
-	case "light":
-		group = lightFactions
-	case "dark":
-		group = darkFactions
-	case "splinter":
-		group = splinterFactions
-	}
+	group := taxonomy.Group("faction", factions)
 	chk := groupSearch(checklist, "faction", group)
 	//chk := checklistByFaction(checklist, faction)
 
@@ -548,22 +833,22 @@ func factionsHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.List4Title = "scale"
 	pagedata.List4 = scalesOfFaction
 
-	if err := drilldowntpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, drilldowntpl, pagedata)
 }
 
 // Page listing all Roles
 func roleDirHandler(w http.ResponseWriter, r *http.Request) {
 	//Get roles from data
-	roles := roleData(checklist)
+	roles, err := browseCounts(r, "role", nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	//Sort
 	valuekeySortedRoles := SortMapByValueThenKey(roles)
 	//Present page
 	pagedata := &ListPageData{"role", strconv.Itoa(len(roles)), roles, valuekeySortedRoles}
-	if err := tpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, tpl, pagedata)
 }
 
 // Page showing information about figure of a given Role
@@ -572,7 +857,11 @@ func roleHandler(w http.ResponseWriter, r *http.Request) {
 	reqvars := mux.Vars(r)
 	role := reqvars["role"]
 	//Get factions from data
-	chk := checklistByRole(checklist, role)
+	chk, hidden, err := browseFigures(r, Filter{"role": role})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 
 	factionsOfRole := factionData(chk)
 	racesOfRole := raceData(chk)
@@ -585,6 +874,9 @@ func roleHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.Type = "role"
 	pagedata.Query = role
 	pagedata.Checklist = chk
+	pagedata.Hidden = hidden
+	pagedata.ShowUnreleased = showUnreleased(r)
+	pagedata.Path = r.URL.EscapedPath()
 	pagedata.List1Title = "race"
 	pagedata.List1 = racesOfRole
 	pagedata.List2Title = "faction"
@@ -594,22 +886,22 @@ func roleHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.List4Title = "scale"
 	pagedata.List4 = scalesOfRole
 
-	if err := detailtpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, detailtpl, pagedata)
 }
 
 // Page listing all Scales
 func scaleDirHandler(w http.ResponseWriter, r *http.Request) {
 	//Get scales from data
-	scales := scaleData(checklist)
+	scales, err := browseCounts(r, "scale", nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	//Sort
 	valuekeySortedScales := SortMapByValueThenKey(scales)
 	//Present page
 	pagedata := &ListPageData{"scale", strconv.Itoa(len(scales)), scales, valuekeySortedScales}
-	if err := tpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, tpl, pagedata)
 }
 
 // Page showing information about figure of a given Role
@@ -618,7 +910,11 @@ func scaleHandler(w http.ResponseWriter, r *http.Request) {
 	reqvars := mux.Vars(r)
 	scale := reqvars["scale"]
 	//Get factions from data
-	chk := checklistByScale(checklist, scale)
+	chk, hidden, err := browseFigures(r, Filter{"scale": scale})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 
 	factionsOfScale := factionData(chk)
 	racesOfScale := raceData(chk)
@@ -631,6 +927,9 @@ func scaleHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.Type = "scale"
 	pagedata.Query = scale
 	pagedata.Checklist = chk
+	pagedata.Hidden = hidden
+	pagedata.ShowUnreleased = showUnreleased(r)
+	pagedata.Path = r.URL.EscapedPath()
 	pagedata.List1Title = "race"
 	pagedata.List1 = racesOfScale
 	pagedata.List2Title = "role"
@@ -640,22 +939,22 @@ func scaleHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.List4Title = "release"
 	pagedata.List4 = releasesOfScale
 
-	if err := detailtpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, detailtpl, pagedata)
 }
 
 // Page listing all Releases
 func releaseDirHandler(w http.ResponseWriter, r *http.Request) {
 	//Get releases from data
-	releases := releaseData(checklist)
+	releases, err := browseCounts(r, "release", nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	//Sort
 	valuekeySortedReleases := SortMapByValueThenKey(releases)
 	//Present page
 	pagedata := &ListPageData{"release", strconv.Itoa(len(releases)), releases, valuekeySortedReleases}
-	if err := tpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
-	}
+	renderTemplate(w, tpl, pagedata)
 }
 
 // Page showing Figure data for a Release
@@ -664,7 +963,11 @@ func releaseHandler(w http.ResponseWriter, r *http.Request) {
 	reqvars := mux.Vars(r)
 	release := reqvars["release"]
 	//Get factions from data
-	chk := checklistByRelease(checklist, release)
+	chk, hidden, err := browseFigures(r, Filter{"release": release})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 
 	//TODO: Get other data sets
 	factionsOfRelease := factionData(chk)
@@ -678,6 +981,9 @@ func releaseHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.Query = release
 	pagedata.Total = strconv.Itoa(len(chk.Figures))
 	pagedata.Checklist = chk
+	pagedata.Hidden = hidden
+	pagedata.ShowUnreleased = showUnreleased(r)
+	pagedata.Path = r.URL.EscapedPath()
 	pagedata.List1Title = "race"
 	pagedata.List1 = racesOfRelease
 	pagedata.List2Title = "role"
@@ -687,9 +993,39 @@ func releaseHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.List4Title = "scale"
 	pagedata.List4 = scalesOfRelease
 
-	if err := detailtpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
+	renderTemplate(w, detailtpl, pagedata)
+}
+
+// SECTION: FIGURES
+// Page showing a single Figure and those most like it. An unreleased figure
+// has its page, as /upcoming links to it, but is only suggested as similar
+// to visitors browsing unreleased figures.
+func figureHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
 	}
+	//parse request data
+	reqvars := mux.Vars(r)
+	figure, found := figureBySlug(checklist, reqvars["figure"])
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	browsed, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+
+	var pagedata FigurePageData
+	pagedata.Title = figure.Name
+	pagedata.Figure = figure
+	pagedata.Similar = similarFigures(browsed, figure, config.SimilarityWeights, config.SimilarCount)
+
+	renderTemplate(w, figuretpl, pagedata)
 }
 
 // DRILLDOWN: Searching by 2 parameters
@@ -703,40 +1039,45 @@ func drilldownHandler(w http.ResponseWriter, r *http.Request) {
 	role := reqvars["role"]
 	scale := reqvars["scale"]
 
-	//Create new checklists
-	chk := checklist
+	//Narrow the figures by every value given
+	filter := make(Filter)
 	titlePart := "Drilldown: "
 	if faction != "" {
-		chk = checklistByFaction(chk, faction)
+		filter["faction"] = faction
 		titlePart += strings.ToTitle(faction) + " Faction; "
 	} else {
 		remainingStats = append(remainingStats, "faction")
 	}
 	if race != "" {
-		chk = checklistByRace(chk, race)
+		filter["race"] = race
 		titlePart += strings.ToTitle(race) + " Race; "
 	} else {
 		remainingStats = append(remainingStats, "race")
 	}
 
 	if release != "" {
-		chk = checklistByRelease(chk, release)
+		filter["release"] = release
 		titlePart += strings.ToTitle(release) + " Release; "
 	} else {
 		remainingStats = append(remainingStats, "release")
 	}
 	if role != "" {
-		chk = checklistByRole(chk, role)
+		filter["role"] = role
 		titlePart += strings.ToTitle(role) + " Role; "
 	} else {
 		remainingStats = append(remainingStats, "role")
 	}
 	if scale != "" {
-		chk = checklistByScale(chk, scale)
+		filter["scale"] = scale
 		titlePart += strings.ToTitle(role) + " Scale; "
 	} else {
 		remainingStats = append(remainingStats, "scale")
 	}
+	chk, hidden, err := browseFigures(r, filter)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	releasesOf := releaseData(chk)
 	factionsOf := factionData(chk)
 	racesOf := raceData(chk)
@@ -748,6 +1089,9 @@ func drilldownHandler(w http.ResponseWriter, r *http.Request) {
 	pagedata.Query = r.URL.Path
 	pagedata.Total = strconv.Itoa(len(chk.Figures))
 	pagedata.Checklist = chk
+	pagedata.Hidden = hidden
+	pagedata.ShowUnreleased = showUnreleased(r)
+	pagedata.Path = r.URL.EscapedPath()
 
 	//TODO: Straighten out which tertiary lists are displayed
 
@@ -777,9 +1121,44 @@ func drilldownHandler(w http.ResponseWriter, r *http.Request) {
 	case "scale":
 		pagedata.List3 = factionsOf
 	}
-	if err := drilldowntpl.Execute(w, pagedata); err != nil {
-		fmt.Println(err)
+	renderTemplate(w, drilldowntpl, pagedata)
+}
+
+// Facet types a Checklist can be searched and counted by
+var facetTypes = []string{"faction", "race", "role", "release", "scale"}
+
+// facetData gets the values with count of any facet type from a Checklist
+func facetData(lst Checklist, searchType string) map[string]int {
+	switch searchType {
+	case "faction":
+		return factionData(lst)
+	case "race":
+		return raceData(lst)
+	case "role":
+		return roleData(lst)
+	case "release":
+		return releaseData(lst)
+	case "scale":
+		return scaleData(lst)
+	}
+	return map[string]int{}
+}
+
+// checklistByFacet creates a new checklist limited to a single value of any facet type
+func checklistByFacet(lst Checklist, searchType string, value string) Checklist {
+	switch searchType {
+	case "faction":
+		return checklistByFaction(lst, value)
+	case "race":
+		return checklistByRace(lst, value)
+	case "role":
+		return checklistByRole(lst, value)
+	case "release":
+		return checklistByRelease(lst, value)
+	case "scale":
+		return checklistByScale(lst, value)
 	}
+	return Checklist{}
 }
 
 // Generic Checklist Search for a group of something
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// How many facet values are exported by /metrics
+const topFacetValues = 25
+
+// How many facet values are counted at most, so the counters stay bounded
+const maxFacetValues = 2000
+
+// routeStats holds the request counters and latency histogram of one route template
+type routeStats struct {
+	requests map[int]uint64 // by status code
+	buckets  []uint64
+	sum      float64
+	count    uint64
+}
+
+// Metrics collects the counters exported on /metrics
+type Metrics struct {
+	mu           sync.Mutex
+	routes       map[string]*routeStats
+	renderErrors map[string]uint64
+	facets       map[[2]string]uint64
+	figures      int
+	loadSeconds  float64
+	loadedAt     time.Time
+}
+
+// Process wide metrics
+var metrics = &Metrics{
+	routes:       make(map[string]*routeStats),
+	renderErrors: make(map[string]uint64),
+	facets:       make(map[[2]string]uint64),
+}
+
+// ObserveRequest records a finished request against its route template
+func (m *Metrics) ObserveRequest(route string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, exists := m.routes[route]
+	if !exists {
+		stats = &routeStats{requests: make(map[int]uint64), buckets: make([]uint64, len(latencyBuckets))}
+		m.routes[route] = stats
+	}
+	seconds := elapsed.Seconds()
+	stats.requests[status] += 1
+	stats.sum += seconds
+	stats.count += 1
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			stats.buckets[i] += 1
+		}
+	}
+}
+
+// Facet values of the loaded figures, rebuilt when the dataset changes
+var knownFacets struct {
+	sync.Mutex
+	checksum string
+	values   map[[2]string]bool
+}
+
+// knownFacetValue reports whether the figures have a facet value
+func knownFacetValue(facet string, value string) bool {
+	checksum := currentDatasetInfo().Checksum
+	knownFacets.Lock()
+	defer knownFacets.Unlock()
+	if knownFacets.values == nil || knownFacets.checksum != checksum {
+		knownFacets.values = make(map[[2]string]bool)
+		checklist := currentChecklist()
+		for _, searchType := range facetTypes {
+			for known := range facetData(checklist, searchType) {
+				knownFacets.values[[2]string{searchType, known}] = true
+			}
+		}
+		knownFacets.checksum = checksum
+	}
+	return knownFacets.values[[2]string{facet, value}]
+}
+
+// ObserveFacets counts the facet values named in a request's route variables.
+// Other variables, such as record ids, and values the figures do not have
+// are left out.
+func (m *Metrics) ObserveFacets(vars map[string]string) {
+	var observed [][2]string
+	for _, facet := range facetTypes {
+		if value, exists := vars[facet]; exists && knownFacetValue(facet, value) {
+			observed = append(observed, [2]string{facet, value})
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range observed {
+		if _, exists := m.facets[key]; exists || len(m.facets) < maxFacetValues {
+			m.facets[key] += 1
+		}
+	}
+}
+
+// RenderError counts a failed template execution
+func (m *Metrics) RenderError(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.renderErrors[name] += 1
+}
+
+// DatasetLoaded records the size of a freshly loaded dataset and how long loading took
+func (m *Metrics) DatasetLoaded(figures int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.figures = figures
+	m.loadSeconds = elapsed.Seconds()
+	m.loadedAt = time.Now()
+}
+
+// Write writes all metrics in the Prometheus text exposition format
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	routes := make([]string, 0, len(m.routes))
+	for route := range m.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(w, "# HELP legionsdex_http_requests_total HTTP requests by route template and status code.")
+	fmt.Fprintln(w, "# TYPE legionsdex_http_requests_total counter")
+	for _, route := range routes {
+		codes := make([]int, 0, len(m.routes[route].requests))
+		for code := range m.routes[route].requests {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "legionsdex_http_requests_total{route=%s,code=\"%d\"} %d\n", quoteLabel(route), code, m.routes[route].requests[code])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP legionsdex_http_request_duration_seconds HTTP request latency by route template.")
+	fmt.Fprintln(w, "# TYPE legionsdex_http_request_duration_seconds histogram")
+	for _, route := range routes {
+		stats := m.routes[route]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "legionsdex_http_request_duration_seconds_bucket{route=%s,le=\"%g\"} %d\n", quoteLabel(route), le, stats.buckets[i])
+		}
+		fmt.Fprintf(w, "legionsdex_http_request_duration_seconds_bucket{route=%s,le=\"+Inf\"} %d\n", quoteLabel(route), stats.count)
+		fmt.Fprintf(w, "legionsdex_http_request_duration_seconds_sum{route=%s} %g\n", quoteLabel(route), stats.sum)
+		fmt.Fprintf(w, "legionsdex_http_request_duration_seconds_count{route=%s} %d\n", quoteLabel(route), stats.count)
+	}
+
+	fmt.Fprintln(w, "# HELP legionsdex_template_render_errors_total Failed template executions by template.")
+	fmt.Fprintln(w, "# TYPE legionsdex_template_render_errors_total counter")
+	for _, name := range SortMapByKeys(uint64Map(m.renderErrors)) {
+		fmt.Fprintf(w, "legionsdex_template_render_errors_total{template=%s} %d\n", quoteLabel(name), m.renderErrors[name])
+	}
+
+	fmt.Fprintln(w, "# HELP legionsdex_dataset_figures Figures in the loaded dataset.")
+	fmt.Fprintln(w, "# TYPE legionsdex_dataset_figures gauge")
+	fmt.Fprintf(w, "legionsdex_dataset_figures %d\n", m.figures)
+	fmt.Fprintln(w, "# HELP legionsdex_dataset_load_seconds Time taken to load the dataset.")
+	fmt.Fprintln(w, "# TYPE legionsdex_dataset_load_seconds gauge")
+	fmt.Fprintf(w, "legionsdex_dataset_load_seconds %g\n", m.loadSeconds)
+	fmt.Fprintln(w, "# HELP legionsdex_dataset_loaded_timestamp_seconds Unix time the dataset was loaded.")
+	fmt.Fprintln(w, "# TYPE legionsdex_dataset_loaded_timestamp_seconds gauge")
+	fmt.Fprintf(w, "legionsdex_dataset_loaded_timestamp_seconds %d\n", m.loadedAt.Unix())
+
+	//Only the most requested values, so the number of series stays bounded
+	keys := make([][2]string, 0, len(m.facets))
+	for key := range m.facets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m.facets[keys[i]] == m.facets[keys[j]] {
+			return keys[i][0]+keys[i][1] < keys[j][0]+keys[j][1]
+		}
+		return m.facets[keys[i]] > m.facets[keys[j]]
+	})
+	if len(keys) > topFacetValues {
+		keys = keys[:topFacetValues]
+	}
+	fmt.Fprintf(w, "# HELP legionsdex_facet_requests_total Requests naming a facet value, top %d only.\n", topFacetValues)
+	fmt.Fprintln(w, "# TYPE legionsdex_facet_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "legionsdex_facet_requests_total{facet=%s,value=%s} %d\n", quoteLabel(key[0]), quoteLabel(key[1]), m.facets[key])
+	}
+}
+
+// quoteLabel escapes a Prometheus label value
+func quoteLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+// uint64Map converts counters so they can be sorted with the map helpers
+func uint64Map(m map[string]uint64) map[string]int {
+	out := make(map[string]int, len(m))
+	for k, v := range m {
+		out[k] = int(v)
+	}
+	return out
+}
+
+// Serves the metrics in Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Write(w)
+}
+
+// renderTemplate executes a page template, logging and counting failures
+func renderTemplate(w http.ResponseWriter, t *template.Template, data interface{}) {
+	if err := t.Execute(w, data); err != nil {
+		metrics.RenderError(t.Name())
+		log.Printf("render %s: %v", t.Name(), err)
+	}
+}
+
+// statusRecorder remembers the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// accessLogEntry is one line of the JSON access log
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Route      string  `json:"route"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Remote     string  `json:"remote"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	Referer    string  `json:"referer,omitempty"`
+}
+
+// Destination of the access log
+var accessLog = json.NewEncoder(os.Stdout)
+var accessLogMu sync.Mutex
+
+// routeTemplate names the matched route, e.g. /race/{race}
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unmatched"
+}
+
+// instrument is mux middleware recording metrics and the access log for each request
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := routeTemplate(r)
+
+		if config.Features.Metrics {
+			metrics.ObserveRequest(route, rec.status, elapsed)
+			if vars := mux.Vars(r); len(vars) > 0 && rec.status < 400 {
+				metrics.ObserveFacets(vars)
+			}
+		}
+		if config.Features.AccessLog {
+			accessLogMu.Lock()
+			accessLog.Encode(accessLogEntry{
+				Time:       start.UTC().Format(time.RFC3339Nano),
+				Method:     r.Method,
+				Path:       r.URL.RequestURI(),
+				Route:      route,
+				Status:     rec.status,
+				Bytes:      rec.bytes,
+				DurationMs: float64(elapsed.Microseconds()) / 1000,
+				Remote:     r.RemoteAddr,
+				UserAgent:  r.UserAgent(),
+				Referer:    r.Referer(),
+			})
+			accessLogMu.Unlock()
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// setChecksum marks the stored figures as the loaded dataset
+func setChecksum() {
+	datasetMu.Lock()
+	datasetInfo.Checksum = datasetChecksum(currentChecklist())
+	datasetMu.Unlock()
+}
+
+func TestObserveFacets(t *testing.T) {
+	datasetMu.Lock()
+	savedInfo := datasetInfo
+	datasetMu.Unlock()
+	defer func() {
+		datasetMu.Lock()
+		datasetInfo = savedInfo
+		datasetMu.Unlock()
+	}()
+	useTestRepository(t, Figure{Name: "Knight", Faction: "ORDER", Race: "HUMAN", Role: "KNIGHT"})
+	setChecksum()
+
+	m := &Metrics{facets: make(map[[2]string]uint64)}
+	m.ObserveFacets(map[string]string{"race": "HUMAN", "role": "KNIGHT", "id": "abc"})
+	m.ObserveFacets(map[string]string{"race": "ELF"})
+	m.ObserveFacets(map[string]string{"race": "HUMAN"})
+	want := map[[2]string]uint64{{"race", "HUMAN"}: 2, {"role", "KNIGHT"}: 1}
+	if fmt.Sprint(m.facets) != fmt.Sprint(want) {
+		t.Errorf("counted %v, want %v", m.facets, want)
+	}
+
+	//A value becomes known once the figures that have it are loaded
+	if err := repo.ImportFigures(Checklist{Figures: []Figure{{Name: "Knight", Faction: "ORDER", Race: "HUMAN", Role: "KNIGHT"}, {Name: "Archer", Faction: "ORDER", Race: "ELF", Role: "ARCHER"}}}); err != nil {
+		t.Fatal(err)
+	}
+	setChecksum()
+	if !knownFacetValue("race", "ELF") {
+		t.Error("ELF not known after loading an elf")
+	}
+
+	//When full, only values already counted go on counting
+	for i := len(m.facets); i < maxFacetValues; i++ {
+		m.facets[[2]string{"faction", fmt.Sprint(i)}] = 1
+	}
+	m.ObserveFacets(map[string]string{"race": "ELF", "role": "KNIGHT"})
+	if _, counted := m.facets[[2]string{"race", "ELF"}]; counted || len(m.facets) != maxFacetValues {
+		t.Errorf("%d values counted, want at most %d", len(m.facets), maxFacetValues)
+	}
+	if m.facets[[2]string{"role", "KNIGHT"}] != 2 {
+		t.Errorf("KNIGHT counted %d times, want 2", m.facets[[2]string{"role", "KNIGHT"}])
+	}
+}
+
+func TestWriteTopFacets(t *testing.T) {
+	m := &Metrics{routes: make(map[string]*routeStats), renderErrors: make(map[string]uint64), facets: make(map[[2]string]uint64)}
+	for i := 0; i < topFacetValues+5; i++ {
+		m.facets[[2]string{"race", fmt.Sprintf("RACE %02d", i)}] = uint64(i + 1)
+	}
+	var out strings.Builder
+	m.Write(&out)
+	lines := strings.Count(out.String(), "legionsdex_facet_requests_total{")
+	if lines != topFacetValues {
+		t.Errorf("%d facet values written, want %d", lines, topFacetValues)
+	}
+	if !strings.Contains(out.String(), `value="RACE 29"} 30`) || strings.Contains(out.String(), `value="RACE 04"`) {
+		t.Errorf("not the most requested values:\n%s", out.String())
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The dataset scraped from the official site has no parts, so they are filled
+// in by hand: admins on a figure's edit form, visitors by suggesting an edit,
+// or a dataset giving figures a "parts" list of {name, type, colors,
+// materials}. Until then the parts pages say so.
+
+// Kinds of part a figure can come with
+var partTypes = []string{"helmet", "torso", "arms", "legs", "cape", "weapon", "shield"}
+
+// String writes a part the way the figure form takes it, e.g.
+// "helmet: Great Helm | gold, black | metal"
+func (part Part) String() string {
+	line := part.Type + ": " + part.Name
+	if len(part.Colors) > 0 || len(part.Materials) > 0 {
+		line += " | " + strings.Join(part.Colors, ", ")
+	}
+	if len(part.Materials) > 0 {
+		line += " | " + strings.Join(part.Materials, ", ")
+	}
+	return line
+}
+
+// partTags reads a comma separated list of tags, which are kept in lower case
+func partTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// parsePart reads a part written as by Part.String
+func parsePart(line string) Part {
+	var part Part
+	if i := strings.Index(line, ":"); i >= 0 {
+		part.Type = strings.ToLower(strings.TrimSpace(line[:i]))
+		line = line[i+1:]
+	}
+	fields := strings.Split(line, "|")
+	part.Name = strings.TrimSpace(fields[0])
+	if len(fields) > 1 {
+		part.Colors = partTags(fields[1])
+	}
+	if len(fields) > 2 {
+		part.Materials = partTags(strings.Join(fields[2:], ","))
+	}
+	return part
+}
+
+// partsText writes a figure's parts one per line
+func partsText(parts []Part) string {
+	lines := make([]string, 0, len(parts))
+	for _, part := range parts {
+		lines = append(lines, part.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validateParts checks the parts of a figure
+func validateParts(figure Figure) []string {
+	var problems []string
+	for _, part := range figure.Parts {
+		if part.Name == "" {
+			problems = append(problems, fmt.Sprintf("%s: a part has no name", figure.Name))
+		}
+		if !containsString(partTypes, part.Type) {
+			problems = append(problems, fmt.Sprintf("%s: %s is not a part type, use one of %s", figure.Name, part.Type, strings.Join(partTypes, ", ")))
+		}
+	}
+	return problems
+}
+
+// partKey identifies a part across figures, whatever its spelling
+func partKey(part Part) string {
+	return part.Type + "\x00" + strings.ToLower(part.Name)
+}
+
+// CatalogPart is a part and the figures that come with it. Colors and
+// materials are those of every copy.
+type CatalogPart struct {
+	Part    Part
+	Figures Checklist
+}
+
+// PartQuery narrows the parts catalog; empty fields match anything
+type PartQuery struct {
+	Text     string
+	Name     string
+	Type     string
+	Color    string
+	Material string
+}
+
+// matches reports whether a part is what the query asks for
+func (query PartQuery) matches(part Part) bool {
+	if query.Name != "" && !strings.EqualFold(part.Name, query.Name) {
+		return false
+	}
+	if query.Type != "" && part.Type != query.Type {
+		return false
+	}
+	if query.Color != "" && !containsString(part.Colors, strings.ToLower(query.Color)) {
+		return false
+	}
+	if query.Material != "" && !containsString(part.Materials, strings.ToLower(query.Material)) {
+		return false
+	}
+	if query.Text == "" {
+		return true
+	}
+	text := strings.ToLower(query.Text)
+	values := []string{part.Name, part.Type}
+	values = append(values, part.Colors...)
+	values = append(values, part.Materials...)
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// partsCatalog lists the parts matching a query, by type and then name
+func partsCatalog(checklist Checklist, query PartQuery) []CatalogPart {
+	var catalog []CatalogPart
+	index := make(map[string]int)
+	for _, figure := range checklist.Figures {
+		for _, part := range figure.Parts {
+			if !query.matches(part) {
+				continue
+			}
+			i, exists := index[partKey(part)]
+			if !exists {
+				i = len(catalog)
+				index[partKey(part)] = i
+				catalog = append(catalog, CatalogPart{Part: Part{Name: part.Name, Type: part.Type}})
+			}
+			entry := &catalog[i]
+			for _, color := range part.Colors {
+				if !containsString(entry.Part.Colors, color) {
+					entry.Part.Colors = append(entry.Part.Colors, color)
+				}
+			}
+			for _, material := range part.Materials {
+				if !containsString(entry.Part.Materials, material) {
+					entry.Part.Materials = append(entry.Part.Materials, material)
+				}
+			}
+			if len(entry.Figures.Figures) == 0 || entry.Figures.Figures[len(entry.Figures.Figures)-1].Name != figure.Name {
+				entry.Figures.AddItem(figure)
+			}
+		}
+	}
+	order := make(map[string]int)
+	for i, partType := range partTypes {
+		order[partType] = i
+	}
+	sort.SliceStable(catalog, func(i, j int) bool {
+		a, b := catalog[i].Part, catalog[j].Part
+		if a.Type != b.Type {
+			return order[a.Type] < order[b.Type]
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	return catalog
+}
+
+// partTagCounts counts the figures' parts per color or per material
+func partTagCounts(checklist Checklist, tags func(Part) []string) map[string]int {
+	counts := make(map[string]int)
+	for _, figure := range checklist.Figures {
+		for _, part := range figure.Parts {
+			for _, tag := range tags(part) {
+				counts[tag]++
+			}
+		}
+	}
+	return counts
+}
+
+// partNames lists the names of every part as each figure spells it, for
+// building the part pages figures link to
+func partNames(checklist Checklist) []string {
+	var names []string
+	for _, figure := range checklist.Figures {
+		for _, part := range figure.Parts {
+			if !containsString(names, part.Name) {
+				names = append(names, part.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// listedPartTypes lists the part types some figure comes with, in type order
+func listedPartTypes(checklist Checklist) []string {
+	var types []string
+	for _, partType := range partTypes {
+		if len(partsCatalog(checklist, PartQuery{Type: partType})) > 0 {
+			types = append(types, partType)
+		}
+	}
+	return types
+}
+
+// figuresWithPartType keeps only the parts of one type on every figure, so
+// partNames lists the parts of that type
+func figuresWithPartType(checklist Checklist, partType string) Checklist {
+	var narrowed Checklist
+	for _, figure := range checklist.Figures {
+		var parts []Part
+		for _, part := range figure.Parts {
+			if part.Type == partType {
+				parts = append(parts, part)
+			}
+		}
+		figure.Parts = parts
+		narrowed.AddItem(figure)
+	}
+	return narrowed
+}
+
+// Data for the parts pages
+type PartsPageData struct {
+	Title     string
+	Query     PartQuery
+	Parts     []CatalogPart
+	Types     []string
+	Colors    []string
+	Materials []string
+	//How many figures have their parts listed at all
+	Listed int
+}
+
+// Page searching the parts figures come with
+func partsHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata PartsPageData
+	pagedata.Title = "Parts"
+	pagedata.Query = PartQuery{
+		Text:     strings.TrimSpace(r.FormValue("q")),
+		Type:     r.FormValue("type"),
+		Color:    r.FormValue("color"),
+		Material: r.FormValue("material"),
+	}
+	pagedata.Parts = partsCatalog(checklist, pagedata.Query)
+	pagedata.Types = partTypes
+	pagedata.Colors = SortMapByKeys(partTagCounts(checklist, func(part Part) []string { return part.Colors }))
+	pagedata.Materials = SortMapByKeys(partTagCounts(checklist, func(part Part) []string { return part.Materials }))
+	for _, figure := range checklist.Figures {
+		if len(figure.Parts) > 0 {
+			pagedata.Listed++
+		}
+	}
+	renderTemplate(w, partstpl, pagedata)
+}
+
+// Page listing the figures that come with a part of one type. Without a
+// type, as old links have it, it lists every part of the name.
+func partHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	vars := mux.Vars(r)
+	var pagedata PartsPageData
+	pagedata.Query = PartQuery{Name: vars["part"], Type: vars["parttype"]}
+	pagedata.Parts = partsCatalog(checklist, pagedata.Query)
+	if len(pagedata.Parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	pagedata.Title = "Part: " + pagedata.Parts[0].Part.Name
+	if pagedata.Query.Type == "" {
+		pagedata.Title = "Parts named " + pagedata.Query.Name
+	}
+	renderTemplate(w, partstpl, pagedata)
+}
+
+// API searching parts, with the same parameters as the parts page
+func partsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	type partResult struct {
+		Part
+		Figures []string `json:"figures"`
+	}
+	results := []partResult{}
+	query := PartQuery{Text: r.FormValue("q"), Name: r.FormValue("name"), Type: r.FormValue("type"), Color: r.FormValue("color"), Material: r.FormValue("material")}
+	for _, entry := range partsCatalog(checklist, query) {
+		results = append(results, partResult{entry.Part, figureNames(entry.Figures)})
+	}
+	writeJSON(w, results)
+}
+
+// API listing the parts a figure comes with
+func figurePartsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	figure, found := figureBySlug(checklist, mux.Vars(r)["figure"])
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	parts := figure.Parts
+	if parts == nil {
+		parts = []Part{}
+	}
+	writeJSON(w, parts)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParsePart(t *testing.T) {
+	tests := []struct {
+		line string
+		part Part
+		text string
+	}{
+		{"helmet: Great Helm | gold, black | metal", Part{Name: "Great Helm", Type: "helmet", Colors: []string{"gold", "black"}, Materials: []string{"metal"}}, ""},
+		{"Shield: Kite Shield", Part{Name: "Kite Shield", Type: "shield"}, "shield: Kite Shield"},
+		{"cape: Cloak | Red, red ,, green", Part{Name: "Cloak", Type: "cape", Colors: []string{"red", "green"}}, "cape: Cloak | red, green"},
+		{"weapon: Axe | | wood | metal", Part{Name: "Axe", Type: "weapon", Materials: []string{"wood", "metal"}}, "weapon: Axe |  | wood, metal"},
+		{"  torso :  Breastplate  ", Part{Name: "Breastplate", Type: "torso"}, "torso: Breastplate"},
+	}
+	for _, test := range tests {
+		part := parsePart(test.line)
+		if !reflect.DeepEqual(part, test.part) {
+			t.Errorf("parsePart(%q) = %+v, want %+v", test.line, part, test.part)
+		}
+		want := test.text
+		if want == "" {
+			want = test.line
+		}
+		if part.String() != want {
+			t.Errorf("%+v written as %q, want %q", part, part.String(), want)
+		}
+		//What String writes reads back the same
+		if again := parsePart(part.String()); !reflect.DeepEqual(again, part) {
+			t.Errorf("%q reads back as %+v", part.String(), again)
+		}
+	}
+}
+
+func TestPartQueryMatches(t *testing.T) {
+	helm := Part{Name: "Great Helm", Type: "helmet", Colors: []string{"gold"}, Materials: []string{"metal"}}
+	tests := []struct {
+		query PartQuery
+		want  bool
+	}{
+		{PartQuery{}, true},
+		{PartQuery{Name: "great helm"}, true},
+		{PartQuery{Name: "Great"}, false},
+		{PartQuery{Type: "helmet"}, true},
+		{PartQuery{Type: "shield"}, false},
+		{PartQuery{Color: "GOLD"}, true},
+		{PartQuery{Color: "black"}, false},
+		{PartQuery{Material: "Metal"}, true},
+		{PartQuery{Text: "helm"}, true},
+		{PartQuery{Text: "GOL"}, true},
+		{PartQuery{Text: "wood"}, false},
+		{PartQuery{Type: "helmet", Text: "wood"}, false},
+	}
+	for _, test := range tests {
+		if got := test.query.matches(helm); got != test.want {
+			t.Errorf("%+v matches = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+// partsChecklist has a helmet and a shield of the same name, and a part
+// spelled two ways
+var partsChecklist = Checklist{Figures: []Figure{
+	{Name: "Knight", Parts: []Part{
+		{Name: "Lion", Type: "shield", Colors: []string{"gold"}},
+		{Name: "Great Helm", Type: "helmet", Colors: []string{"silver"}, Materials: []string{"metal"}},
+	}},
+	{Name: "Squire", Parts: []Part{
+		{Name: "great helm", Type: "helmet", Colors: []string{"black", "silver"}},
+		{Name: "Lion", Type: "helmet"},
+	}},
+}}
+
+func TestPartsCatalog(t *testing.T) {
+	catalog := partsCatalog(partsChecklist, PartQuery{})
+	var got []string
+	for _, entry := range catalog {
+		got = append(got, entry.Part.Type+": "+entry.Part.Name+" "+strings.Join(figureNames(entry.Figures), ","))
+	}
+	want := []string{"helmet: Great Helm Knight,Squire", "helmet: Lion Squire", "shield: Lion Knight"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("catalog %v, want %v", got, want)
+	}
+	if helm := catalog[0].Part; !reflect.DeepEqual(helm.Colors, []string{"silver", "black"}) || !reflect.DeepEqual(helm.Materials, []string{"metal"}) {
+		t.Errorf("merged helm %+v", helm)
+	}
+}
+
+func TestPartHandler(t *testing.T) {
+	useTestRepository(t, partsChecklist.Figures...)
+	if err := loadTemplates(""); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		vars  map[string]string
+		code  int
+		title string
+	}{
+		{map[string]string{"parttype": "shield", "part": "Lion"}, http.StatusOK, "Part: Lion"},
+		{map[string]string{"parttype": "helmet", "part": "great helm"}, http.StatusOK, "Part: Great Helm"},
+		{map[string]string{"parttype": "cape", "part": "Lion"}, http.StatusNotFound, ""},
+		{map[string]string{"part": "lion"}, http.StatusOK, "Parts named lion"},
+		{map[string]string{"part": "Griffin"}, http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/part/x", nil), test.vars)
+		w := httptest.NewRecorder()
+		partHandler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%v: got %d, want %d", test.vars, w.Code, test.code)
+			continue
+		}
+		if test.title != "" && !strings.Contains(w.Body.String(), "<h2>"+test.title+"</h2>") {
+			t.Errorf("%v: page not titled %q", test.vars, test.title)
+		}
+	}
+}
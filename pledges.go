@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Stored document of every account's crowdfunding pledges
+const pledgesDocument = "pledges.json"
+
+// Statuses a pledge moves through
+var paymentStatuses = []string{"unpaid", "partial", "paid", "refunded"}
+var shippingStatuses = []string{"pending", "shipped", "received"}
+
+// A pledge item line like "2 x Adamonn"
+var itemLine = regexp.MustCompile(`^(\d+)\s*[x×]\s*(.+)$`)
+
+// PledgeItem is something ordered in a pledge: a figure of the campaign, a
+// figure added on from elsewhere, or an add-on that is not a figure
+type PledgeItem struct {
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+	Figure   bool   `json:"figure"`
+	AddOn    bool   `json:"add_on"`
+}
+
+// Pledge is an account's order in a crowdfunding campaign, which is a release
+type Pledge struct {
+	ID         string       `json:"id"`
+	User       string       `json:"user"`
+	Campaign   string       `json:"campaign"`
+	Backer     string       `json:"backer,omitempty"`
+	Items      []PledgeItem `json:"items"`
+	Total      float64      `json:"total,omitempty"`
+	Currency   string       `json:"currency,omitempty"`
+	Payment    string       `json:"payment"`
+	Shipping   string       `json:"shipping"`
+	Notes      string       `json:"notes,omitempty"`
+	Created    time.Time    `json:"created"`
+	Updated    time.Time    `json:"updated"`
+	Reconciled time.Time    `json:"reconciled,omitempty"`
+}
+
+// Count is how many things were ordered
+func (pledge Pledge) Count() int {
+	count := 0
+	for _, item := range pledge.Items {
+		count += item.Quantity
+	}
+	return count
+}
+
+// ItemLines writes the items back the way the form takes them
+func (pledge Pledge) ItemLines() string {
+	var lines []string
+	for _, item := range pledge.Items {
+		lines = append(lines, fmt.Sprintf("%d x %s", item.Quantity, item.Name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Figures lists the figures the pledge brings
+func (pledge Pledge) Figures() []string {
+	var figures []string
+	for _, item := range pledge.Items {
+		if item.Figure {
+			figures = append(figures, item.Name)
+		}
+	}
+	return figures
+}
+
+// NeedsReconciling reports whether the pledge arrived but its figures were not
+// marked owned yet
+func (pledge Pledge) NeedsReconciling() bool {
+	return pledge.Shipping == "received" && pledge.Reconciled.IsZero()
+}
+
+// parseItems reads pledge items, one per line as "2 x Name" or just "Name",
+// telling figures of the campaign from add-ons
+func parseItems(lines []string, campaign string, checklist Checklist) ([]PledgeItem, error) {
+	figures := make(map[string]Figure)
+	for _, figure := range checklist.Figures {
+		figures[strings.ToLower(figure.Name)] = figure
+	}
+	var items []PledgeItem
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		item := PledgeItem{Name: line, Quantity: 1}
+		if match := itemLine.FindStringSubmatch(line); match != nil {
+			quantity, err := strconv.Atoi(match[1])
+			if err != nil || quantity < 1 || quantity > 1000 {
+				return nil, fmt.Errorf("%s: the quantity must be between 1 and 1000", line)
+			}
+			item.Quantity = quantity
+			item.Name = strings.TrimSpace(match[2])
+		}
+		item.AddOn = true
+		if figure, exists := figures[strings.ToLower(item.Name)]; exists {
+			item.Name = figure.Name
+			item.Figure = true
+			item.AddOn = !containsString(figure.Release, campaign)
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("a pledge needs at least one item")
+	}
+	return items, nil
+}
+
+// pledgeFromRequest reads and checks a pledge from the page form or a JSON
+// body, where items is a list of lines too
+func pledgeFromRequest(r *http.Request) (Pledge, error) {
+	var pledge Pledge
+	var lines []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Pledge
+			Items []string `json:"items"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return pledge, err
+		}
+		pledge, lines = body.Pledge, body.Items
+	} else {
+		pledge.Campaign = r.FormValue("campaign")
+		pledge.Backer = r.FormValue("backer")
+		pledge.Currency = r.FormValue("currency")
+		pledge.Payment = r.FormValue("payment")
+		pledge.Shipping = r.FormValue("shipping")
+		pledge.Notes = r.FormValue("notes")
+		lines = strings.Split(r.FormValue("items"), "\n")
+		if total := strings.TrimSpace(r.FormValue("total")); total != "" {
+			parsed, err := strconv.ParseFloat(total, 64)
+			if err != nil {
+				return pledge, fmt.Errorf("the total must be a number")
+			}
+			pledge.Total = parsed
+		}
+	}
+	pledge.Campaign = strings.TrimSpace(pledge.Campaign)
+	pledge.Backer = strings.TrimSpace(pledge.Backer)
+	pledge.Currency = strings.ToUpper(strings.TrimSpace(pledge.Currency))
+	pledge.Notes = strings.TrimSpace(pledge.Notes)
+	if pledge.Payment == "" {
+		pledge.Payment = "unpaid"
+	}
+	if pledge.Shipping == "" {
+		pledge.Shipping = "pending"
+	}
+	if _, err := repo.Release(pledge.Campaign); err == ErrNotFound {
+		return pledge, fmt.Errorf("no campaign or release named %s", pledge.Campaign)
+	} else if err != nil {
+		return pledge, err
+	}
+	if !containsString(paymentStatuses, pledge.Payment) {
+		return pledge, fmt.Errorf("the payment status must be one of %s", strings.Join(paymentStatuses, ", "))
+	}
+	if !containsString(shippingStatuses, pledge.Shipping) {
+		return pledge, fmt.Errorf("the shipping status must be one of %s", strings.Join(shippingStatuses, ", "))
+	}
+	if pledge.Total < 0 || math.IsNaN(pledge.Total) || math.IsInf(pledge.Total, 0) {
+		return pledge, fmt.Errorf("the total cannot be negative")
+	}
+	if pledge.Currency != "" && !currencyCode.MatchString(pledge.Currency) {
+		return pledge, fmt.Errorf("the currency must be a three letter code like USD")
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		return pledge, err
+	}
+	pledge.Items, err = parseItems(lines, pledge.Campaign, checklist)
+	return pledge, err
+}
+
+// userPledges lists an account's pledges by campaign
+func userPledges(user string) ([]Pledge, error) {
+	var pledges, mine []Pledge
+	if err := readDocument(pledgesDocument, &pledges); err != nil {
+		return nil, err
+	}
+	for _, pledge := range pledges {
+		if pledge.User == user {
+			mine = append(mine, pledge)
+		}
+	}
+	sort.SliceStable(mine, func(i, j int) bool {
+		return mine[i].Campaign < mine[j].Campaign
+	})
+	return mine, nil
+}
+
+// userPledge finds one of the caller's pledges by the route's id
+func userPledge(w http.ResponseWriter, r *http.Request) (Pledge, bool) {
+	pledges, err := userPledges(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return Pledge{}, false
+	}
+	for _, pledge := range pledges {
+		if pledge.ID == mux.Vars(r)["id"] {
+			return pledge, true
+		}
+	}
+	http.NotFound(w, r)
+	return Pledge{}, false
+}
+
+// Data for the pledge pages
+type PledgesPageData struct {
+	Title     string
+	User      string
+	CSRF      string
+	Pledges   []Pledge
+	Pledge    Pledge
+	Items     string
+	Reconcile bool
+	Campaigns []Release
+	Payment   []string
+	Shipping  []string
+	Status    map[string]string
+	Slugs     map[string]string
+	Problems  []string
+}
+
+// renderPledges fills in what every pledge page needs and shows one of them
+func renderPledges(w http.ResponseWriter, r *http.Request, tpl *template.Template, pagedata PledgesPageData) {
+	campaigns, err := repo.Releases()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	sort.Slice(campaigns, func(i, j int) bool {
+		return campaigns[i].Name < campaigns[j].Name
+	})
+	collection, err := userCollection(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	pagedata.User = requestUser(r)
+	pagedata.CSRF = requestCSRF(r)
+	pagedata.Campaigns = campaigns
+	pagedata.Payment = paymentStatuses
+	pagedata.Shipping = shippingStatuses
+	pagedata.Status = make(map[string]string)
+	pagedata.Slugs = make(map[string]string)
+	for _, figure := range checklist.Figures {
+		pagedata.Slugs[figure.Name] = figure.Slug()
+		pagedata.Status[figure.Name] = collection.Status(figure.Name)
+	}
+	if len(pagedata.Problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTemplate(w, tpl, pagedata)
+}
+
+// Page listing the caller's pledges by campaign
+func pledgesHandler(w http.ResponseWriter, r *http.Request) {
+	pledges, err := userPledges(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	renderPledges(w, r, pledgestpl, PledgesPageData{Title: "Pledges", Pledges: pledges})
+}
+
+// Page listing pledges that arrived but whose figures are not marked owned yet
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	pledges, err := userPledges(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata PledgesPageData
+	pagedata.Title = "Reconcile Pledges"
+	pagedata.Reconcile = true
+	for _, pledge := range pledges {
+		if pledge.NeedsReconciling() {
+			pagedata.Pledges = append(pagedata.Pledges, pledge)
+		}
+	}
+	renderPledges(w, r, pledgestpl, pagedata)
+}
+
+// Records a pledge
+func createPledgeHandler(w http.ResponseWriter, r *http.Request) {
+	pledge, err := pledgeFromRequest(r)
+	api := strings.HasPrefix(r.URL.Path, "/api/")
+	if err != nil && api {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		pledges, _ := userPledges(requestUser(r))
+		renderPledges(w, r, pledgestpl, PledgesPageData{Title: "Pledges", Pledges: pledges, Pledge: pledge, Items: r.FormValue("items"), Problems: []string{err.Error()}})
+		return
+	}
+	pledge.ID = newID()
+	pledge.User = requestUser(r)
+	pledge.Created = time.Now()
+	pledge.Updated = pledge.Created
+	var pledges []Pledge
+	err = updateDocument(pledgesDocument, &pledges, func() error {
+		pledges = append(pledges, pledge)
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if api {
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, pledge)
+		return
+	}
+	http.Redirect(w, r, "/pledges/"+pledge.ID, http.StatusSeeOther)
+}
+
+// Page showing and editing one pledge
+func pledgeHandler(w http.ResponseWriter, r *http.Request) {
+	pledge, found := userPledge(w, r)
+	if !found {
+		return
+	}
+	renderPledges(w, r, pledgetpl, PledgesPageData{Title: "Pledge: " + pledge.Campaign, Pledge: pledge})
+}
+
+// updatePledge changes one of the caller's pledges
+func updatePledge(r *http.Request, change func(pledge *Pledge)) error {
+	var pledges []Pledge
+	return updateDocument(pledgesDocument, &pledges, func() error {
+		for i := range pledges {
+			if pledges[i].ID == mux.Vars(r)["id"] && pledges[i].User == requestUser(r) {
+				change(&pledges[i])
+				pledges[i].Updated = time.Now()
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// Saves changes to a pledge, such as its payment and shipping status
+func editPledgeHandler(w http.ResponseWriter, r *http.Request) {
+	current, found := userPledge(w, r)
+	if !found {
+		return
+	}
+	edited, err := pledgeFromRequest(r)
+	if err != nil {
+		edited.ID = current.ID
+		renderPledges(w, r, pledgetpl, PledgesPageData{Title: "Pledge: " + current.Campaign, Pledge: edited, Items: r.FormValue("items"), Problems: []string{err.Error()}})
+		return
+	}
+	err = updatePledge(r, func(pledge *Pledge) {
+		pledge.Campaign = edited.Campaign
+		pledge.Backer = edited.Backer
+		pledge.Items = edited.Items
+		pledge.Total = edited.Total
+		pledge.Currency = edited.Currency
+		pledge.Payment = edited.Payment
+		//A pledge no longer received is reconciled again when it arrives
+		if edited.Shipping != "received" {
+			pledge.Reconciled = time.Time{}
+		}
+		pledge.Shipping = edited.Shipping
+		pledge.Notes = edited.Notes
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/pledges/"+current.ID, http.StatusSeeOther)
+}
+
+// Deletes a pledge
+func deletePledgeHandler(w http.ResponseWriter, r *http.Request) {
+	var pledges []Pledge
+	found := false
+	err := updateDocument(pledgesDocument, &pledges, func() error {
+		for i := range pledges {
+			if pledges[i].ID == mux.Vars(r)["id"] && pledges[i].User == requestUser(r) {
+				pledges = append(pledges[:i], pledges[i+1:]...)
+				found = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/pledges", http.StatusSeeOther)
+}
+
+// Marks a received pledge's figures owned. Figures already owned or up for
+// trade are left as they are.
+func reconcilePledgeHandler(w http.ResponseWriter, r *http.Request) {
+	pledge, found := userPledge(w, r)
+	if !found {
+		return
+	}
+	if pledge.Shipping != "received" {
+		http.Error(w, "the pledge has not been received yet", http.StatusConflict)
+		return
+	}
+	err := updateCollection(pledge.User, func(collection *Collection) error {
+		for _, figure := range pledge.Figures() {
+			if status := collection.Status(figure); status != "owned" && status != "for_trade" {
+				collection.setStatus(figure, "owned")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	err = updatePledge(r, func(pledge *Pledge) {
+		pledge.Reconciled = time.Now()
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		pledge, _ = userPledge(w, r)
+		writeJSON(w, pledge)
+		return
+	}
+	http.Redirect(w, r, "/pledges/reconcile", http.StatusSeeOther)
+}
+
+// API listing the caller's pledges
+func pledgesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	pledges, err := userPledges(requestUser(r))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if pledges == nil {
+		pledges = []Pledge{}
+	}
+	writeJSON(w, pledges)
+}
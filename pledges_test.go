@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseItems(t *testing.T) {
+	checklist := Checklist{Figures: []Figure{
+		{Name: "Adamonn", Release: []string{"ILLYTHIA"}},
+		{Name: "Sir Ucczajk", Release: []string{"WAVE 1"}},
+	}}
+	tests := []struct {
+		name  string
+		lines []string
+		items []PledgeItem
+		ok    bool
+	}{
+		{"quantity", []string{"2 x Adamonn"}, []PledgeItem{{Name: "Adamonn", Quantity: 2, Figure: true}}, true},
+		{"times sign without spaces", []string{"3×Adamonn"}, []PledgeItem{{Name: "Adamonn", Quantity: 3, Figure: true}}, true},
+		{"bare name", []string{"Adamonn"}, []PledgeItem{{Name: "Adamonn", Quantity: 1, Figure: true}}, true},
+		{"case of the figure name", []string{"  adamonn  "}, []PledgeItem{{Name: "Adamonn", Quantity: 1, Figure: true}}, true},
+		{"figure from another release", []string{"sir ucczajk"}, []PledgeItem{{Name: "Sir Ucczajk", Quantity: 1, Figure: true, AddOn: true}}, true},
+		{"add-on that is not a figure", []string{"1 x Weapons Pack", "", "Adamonn"}, []PledgeItem{{Name: "Weapons Pack", Quantity: 1, AddOn: true}, {Name: "Adamonn", Quantity: 1, Figure: true}}, true},
+		{"largest quantity", []string{"1000 x Adamonn"}, []PledgeItem{{Name: "Adamonn", Quantity: 1000, Figure: true}}, true},
+		{"quantity of zero", []string{"0 x Adamonn"}, nil, false},
+		{"quantity too large", []string{"1001 x Adamonn"}, nil, false},
+		{"nothing", []string{"", "  "}, nil, false},
+	}
+	for _, test := range tests {
+		items, err := parseItems(test.lines, "ILLYTHIA", checklist)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(items, test.items) {
+			t.Errorf("%s: got %+v, want %+v", test.name, items, test.items)
+		}
+	}
+}
+
+// storePledge saves a pledge as the only one, for the handlers to find
+func storePledge(t *testing.T, pledge Pledge) {
+	var pledges []Pledge
+	if err := updateDocument(pledgesDocument, &pledges, func() error {
+		pledges = []Pledge{pledge}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pledgeRequest calls a pledge handler as boss, by API token
+func pledgeRequest(handler http.HandlerFunc, method string, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer ldx_token")
+	r = mux.SetURLVars(r, map[string]string{"id": "p1"})
+	w := httptest.NewRecorder()
+	authenticate(handler).ServeHTTP(w, r)
+	return w
+}
+
+func TestReconcilePledge(t *testing.T) {
+	signIn(t)
+	pledge := Pledge{ID: "p1", User: "boss", Campaign: "ILLYTHIA", Shipping: "shipped", Items: []PledgeItem{
+		{Name: "Adamonn", Quantity: 1, Figure: true},
+		{Name: "Knight", Quantity: 1, Figure: true},
+		{Name: "Weapons Pack", Quantity: 1, AddOn: true},
+	}}
+	storePledge(t, pledge)
+	if err := updateCollection("boss", func(collection *Collection) error {
+		collection.setStatus("Knight", "for_trade")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := pledgeRequest(reconcilePledgeHandler, "POST", "/api/pledges/p1/reconcile", nil); w.Code != http.StatusConflict {
+		t.Errorf("reconciling a pledge not received: got %d, want 409", w.Code)
+	}
+
+	pledge.Shipping = "received"
+	storePledge(t, pledge)
+	if w := pledgeRequest(reconcilePledgeHandler, "POST", "/api/pledges/p1/reconcile", nil); w.Code != http.StatusOK {
+		t.Fatalf("reconciling: got %d, %s", w.Code, w.Body)
+	}
+	collection, err := userCollection("boss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for figure, want := range map[string]string{"Adamonn": "owned", "Knight": "for_trade", "Weapons Pack": ""} {
+		if status := collection.Status(figure); status != want {
+			t.Errorf("%s is %q, want %q", figure, status, want)
+		}
+	}
+	pledges, err := userPledges("boss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pledges) != 1 || pledges[0].Reconciled.IsZero() || pledges[0].NeedsReconciling() {
+		t.Errorf("pledge not marked reconciled: %+v", pledges)
+	}
+}
+
+func TestEditPledgeClearsReconciled(t *testing.T) {
+	signIn(t)
+	if err := repo.ImportFigures(Checklist{Figures: []Figure{{Name: "Adamonn", Release: []string{"ILLYTHIA"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	reconciled := time.Now()
+	storePledge(t, Pledge{ID: "p1", User: "boss", Campaign: "ILLYTHIA", Shipping: "received", Payment: "paid", Reconciled: reconciled,
+		Items: []PledgeItem{{Name: "Adamonn", Quantity: 1, Figure: true}}})
+	tests := []struct {
+		shipping   string
+		reconciled bool
+	}{
+		{"received", true},
+		{"shipped", false},
+		{"received", false},
+	}
+	for _, test := range tests {
+		form := url.Values{"campaign": {"ILLYTHIA"}, "items": {"Adamonn"}, "payment": {"paid"}, "shipping": {test.shipping}}
+		if w := pledgeRequest(editPledgeHandler, "POST", "/pledges/p1", form); w.Code != http.StatusSeeOther {
+			t.Fatalf("editing: got %d, %s", w.Code, w.Body)
+		}
+		pledges, err := userPledges("boss")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reconciled := !pledges[0].Reconciled.IsZero(); reconciled != test.reconciled {
+			t.Errorf("shipping %s: reconciled %v, want %v", test.shipping, reconciled, test.reconciled)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Lifecycle of a release, in order
+var releaseStatuses = []string{"announced", "pre-order", "in production", "shipped"}
+
+// Cookie remembering that a visitor browses unreleased figures too
+const unreleasedCookie = "legionsdex_unreleased"
+
+// Released reports whether a release has shipped
+func (release Release) Released() bool {
+	return release.Status == "" || release.Status == "shipped"
+}
+
+// CampaignName is the campaign a release belongs to, itself if none is given
+func (release Release) CampaignName() string {
+	if release.Campaign != "" {
+		return release.Campaign
+	}
+	return release.Name
+}
+
+// releasesChecksum identifies the stored release records, so cached pages
+// change when a release does
+func releasesChecksum() string {
+	releases, err := repo.Releases()
+	if err != nil {
+		log.Printf("storage: %v", err)
+		return ""
+	}
+	raw, _ := json.Marshal(releases)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// releasesEdited notes a change to the release records
+func releasesEdited() {
+	sum := releasesChecksum()
+	datasetMu.Lock()
+	datasetInfo.ReleasesChecksum = sum
+	datasetInfo.ModTime = time.Now()
+	datasetMu.Unlock()
+}
+
+// showUnreleased reports whether the visitor asked to browse unreleased
+// figures, by cookie or for one page with ?unreleased=1
+func showUnreleased(r *http.Request) bool {
+	if query := r.URL.Query().Get("unreleased"); query != "" {
+		return query == "1"
+	}
+	cookie, err := r.Cookie(unreleasedCookie)
+	return err == nil && cookie.Value == "1"
+}
+
+// unreleasedFigure reports whether none of a figure's releases has shipped yet
+func unreleasedFigure(figure Figure, unreleased map[string]bool) bool {
+	if len(figure.Release) == 0 {
+		return false
+	}
+	for _, release := range figure.Release {
+		if !unreleased[release] {
+			return false
+		}
+	}
+	return true
+}
+
+// unreleasedReleases names the releases that have not shipped
+func unreleasedReleases() (map[string]bool, error) {
+	releases, err := repo.Releases()
+	if err != nil {
+		return nil, err
+	}
+	unreleased := make(map[string]bool)
+	for _, release := range releases {
+		if !release.Released() {
+			unreleased[release.Name] = true
+		}
+	}
+	return unreleased, nil
+}
+
+// browseFigures is repo.Figures for the browsing pages, which leave out
+// figures that have not been released unless the visitor asked for them.
+// It also says how many figures were left out.
+func browseFigures(r *http.Request, filter Filter) (Checklist, int, error) {
+	lst, err := repo.Figures(filter)
+	if err != nil || showUnreleased(r) {
+		return lst, 0, err
+	}
+	unreleased, err := unreleasedReleases()
+	if err != nil || len(unreleased) == 0 {
+		return lst, 0, err
+	}
+	var released Checklist
+	for _, figure := range lst.Figures {
+		if !unreleasedFigure(figure, unreleased) {
+			released.AddItem(figure)
+		}
+	}
+	return released, len(lst.Figures) - len(released.Figures), nil
+}
+
+// browseCounts is repo.FacetCounts for the browsing pages
+func browseCounts(r *http.Request, searchType string, filter Filter) (map[string]int, error) {
+	if showUnreleased(r) {
+		return repo.FacetCounts(searchType, filter)
+	}
+	lst, _, err := browseFigures(r, filter)
+	if err != nil {
+		return nil, err
+	}
+	return facetData(lst, searchType), nil
+}
+
+// Data for the page confirming the unreleased figures toggle
+type UnreleasedPageData struct {
+	Title string
+	Show  bool
+	Next  string
+	CSRF  string
+}
+
+// Asks to confirm showing or hiding unreleased figures. The browsing pages
+// are cached for everyone, so they link here rather than carry a CSRF token.
+func unreleasedHandler(w http.ResponseWriter, r *http.Request) {
+	var pagedata UnreleasedPageData
+	pagedata.Show = r.FormValue("show") == "1"
+	pagedata.Title = "Hide Unreleased Figures"
+	if pagedata.Show {
+		pagedata.Title = "Show Unreleased Figures"
+	}
+	pagedata.Next = localRedirect(r.FormValue("next"), "/")
+	pagedata.CSRF = visitorCSRF(w, r)
+	w.Header().Set("Cache-Control", "private, no-store")
+	renderTemplate(w, unreleasedtpl, pagedata)
+}
+
+// Shows or hides unreleased figures on the browsing pages, then goes back
+func unreleasedToggleHandler(w http.ResponseWriter, r *http.Request) {
+	if !validVisitorCSRF(r) {
+		http.Error(w, "missing or invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	cookie := &http.Cookie{Name: unreleasedCookie, Value: "1", Path: "/", MaxAge: 365 * 24 * 60 * 60, SameSite: http.SameSiteLaxMode}
+	if r.FormValue("show") != "1" {
+		cookie.Value = ""
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, localRedirect(r.FormValue("next"), "/"), http.StatusSeeOther)
+}
+
+// UpcomingRelease is an unreleased release and its figures
+type UpcomingRelease struct {
+	Release   Release
+	Checklist Checklist
+}
+
+// UpcomingCampaign groups the upcoming releases of one campaign
+type UpcomingCampaign struct {
+	Name     string
+	Releases []UpcomingRelease
+}
+
+// Data for the upcoming page
+type UpcomingPageData struct {
+	Title     string
+	Campaigns []UpcomingCampaign
+}
+
+// Page listing announced but unshipped figures by campaign
+func upcomingHandler(w http.ResponseWriter, r *http.Request) {
+	releases, err := repo.Releases()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	//Soonest expected first, unknown dates last
+	sort.SliceStable(releases, func(i, j int) bool {
+		a, b := releases[i].ExpectedShip, releases[j].ExpectedShip
+		return a != "" && (b == "" || a < b)
+	})
+	var pagedata UpcomingPageData
+	pagedata.Title = "Upcoming Figures"
+	campaigns := make(map[string]int)
+	for _, release := range releases {
+		if release.Released() {
+			continue
+		}
+		chk, err := repo.Figures(Filter{"release": release.Name})
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		i, exists := campaigns[release.CampaignName()]
+		if !exists {
+			i = len(pagedata.Campaigns)
+			campaigns[release.CampaignName()] = i
+			pagedata.Campaigns = append(pagedata.Campaigns, UpcomingCampaign{Name: release.CampaignName()})
+		}
+		pagedata.Campaigns[i].Releases = append(pagedata.Campaigns[i].Releases, UpcomingRelease{release, chk})
+	}
+	renderTemplate(w, upcomingtpl, pagedata)
+}
+
+// releaseFromForm reads a release's lifecycle from the admin form
+func releaseFromForm(r *http.Request, release Release) (Release, []string) {
+	release.Description = strings.TrimSpace(r.FormValue("description"))
+	release.Status = r.FormValue("status")
+	release.Campaign = strings.TrimSpace(r.FormValue("campaign"))
+	var problems []string
+	if release.Status != "" && !containsString(releaseStatuses, release.Status) {
+		problems = append(problems, fmt.Sprintf("the status must be one of %s", strings.Join(releaseStatuses, ", ")))
+	}
+	for _, date := range []struct {
+		field string
+		into  *string
+	}{
+		{"announced", &release.Announced},
+		{"preorder_start", &release.PreorderStart},
+		{"preorder_end", &release.PreorderEnd},
+		{"expected_ship", &release.ExpectedShip},
+		{"shipped", &release.Shipped},
+	} {
+		*date.into = strings.TrimSpace(r.FormValue(date.field))
+		if _, err := time.Parse("2006-01-02", *date.into); *date.into != "" && err != nil {
+			problems = append(problems, date.field+": dates look like 2006-01-02")
+		}
+	}
+	if release.PreorderStart != "" && release.PreorderEnd != "" && release.PreorderEnd < release.PreorderStart {
+		problems = append(problems, "the pre-order ends before it starts")
+	}
+	return release, problems
+}
+
+// Data for the release admin pages
+type AdminReleasesPageData struct {
+	Title    string
+	User     string
+	Releases []Release
+	Release  Release
+	Statuses []string
+	Problems []string
+}
+
+// Admin page listing releases and their lifecycle
+func adminReleasesHandler(w http.ResponseWriter, r *http.Request) {
+	releases, err := repo.Releases()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	renderTemplate(w, adminreleasestpl, AdminReleasesPageData{Title: "Releases", User: adminUser(r), Releases: releases, Statuses: releaseStatuses})
+}
+
+// Admin form for a release's lifecycle
+func adminReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	release, err := repo.Release(mux.Vars(r)["release"])
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	renderTemplate(w, adminreleasestpl, AdminReleasesPageData{Title: "Release: " + release.Name, User: adminUser(r), Release: release, Statuses: releaseStatuses})
+}
+
+// Saves a release's lifecycle
+func saveReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	release, err := repo.Release(mux.Vars(r)["release"])
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	before := release
+	release, problems := releaseFromForm(r, release)
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, adminreleasestpl, AdminReleasesPageData{Title: "Release: " + release.Name, User: adminUser(r), Release: release, Statuses: releaseStatuses, Problems: problems})
+		return
+	}
+	if len((ReleaseChange{Before: before, After: release}).Fields()) == 0 {
+		http.Redirect(w, r, "/admin/releases", http.StatusSeeOther)
+		return
+	}
+	entry := AuditEntry{Author: adminUser(r), Action: "release", Summary: "Edited release " + release.Name}
+	entry.Release = &ReleaseChange{Before: before, After: release}
+	entry, err = commitRelease(entry)
+	var stale validationError
+	if errors.As(err, &stale) {
+		w.WriteHeader(http.StatusConflict)
+		renderTemplate(w, adminreleasestpl, AdminReleasesPageData{Title: "Release: " + release.Name, User: adminUser(r), Release: release, Statuses: releaseStatuses, Problems: stale})
+		return
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	log.Printf("admin: %s set release %s to %q", adminUser(r), release.Name, release.Status)
+	http.Redirect(w, r, "/admin/audit#"+entry.ID, http.StatusSeeOther)
+}
+
+// ReleaseChange is a release's lifecycle before and after an admin edit
+type ReleaseChange struct {
+	Before Release `json:"before"`
+	After  Release `json:"after"`
+}
+
+// Fields lists the lifecycle fields the change makes
+func (change ReleaseChange) Fields() []FieldChange {
+	var fields []FieldChange
+	was, is := releaseFields(change.Before), releaseFields(change.After)
+	for _, field := range releaseFieldOrder {
+		if was[field] != is[field] {
+			fields = append(fields, FieldChange{Field: field, Before: was[field], After: is[field]})
+		}
+	}
+	return fields
+}
+
+// Lifecycle fields of a release, in the order the form has them
+var releaseFieldOrder = []string{"description", "status", "campaign", "announced", "preorder_start", "preorder_end", "expected_ship", "shipped"}
+
+// releaseFields writes out a release's lifecycle fields by name
+func releaseFields(release Release) map[string]string {
+	return map[string]string{
+		"description":    release.Description,
+		"status":         release.Status,
+		"campaign":       release.Campaign,
+		"announced":      release.Announced,
+		"preorder_start": release.PreorderStart,
+		"preorder_end":   release.PreorderEnd,
+		"expected_ship":  release.ExpectedShip,
+		"shipped":        release.Shipped,
+	}
+}
+
+// commitRelease saves a release edit through the audit log, after checking
+// the release is still as the edit expects
+func commitRelease(entry AuditEntry) (AuditEntry, error) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	entry.ID = newID()
+	entry.Time = time.Now()
+	change := entry.Release
+	change.Before.Figures, change.After.Figures = 0, 0
+	if len(change.Fields()) == 0 {
+		return entry, validationError{"nothing to change"}
+	}
+	current, err := repo.Release(change.After.Name)
+	if err != nil && err != ErrNotFound {
+		return entry, err
+	}
+	current.Figures = 0
+	if len((ReleaseChange{Before: change.Before, After: current}).Fields()) > 0 {
+		return entry, validationError{change.After.Name + ": changed since, reload and try again"}
+	}
+	err = recordAudit(&entry, func() error {
+		if err := repo.SaveRelease(change.After); err != nil {
+			return err
+		}
+		releasesEdited()
+		return nil
+	})
+	return entry, err
+}
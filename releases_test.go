@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestCommitRelease(t *testing.T) {
+	useTestRepository(t, Figure{Name: "Knight", Release: []string{"WAVE 1"}})
+	before, err := repo.Release("WAVE 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := before
+	after.Status = "pre-order"
+	after.ExpectedShip = "2026-12-01"
+
+	entry, err := commitRelease(AuditEntry{Author: "boss", Release: &ReleaseChange{Before: before, After: after}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := repo.Release("WAVE 1"); saved.Status != "pre-order" {
+		t.Errorf("release not saved: %+v", saved)
+	}
+	entries, err := auditEntries()
+	if err != nil || len(entries) != 1 || entries[0].ID != entry.ID || entries[0].Pending || entries[0].Release == nil {
+		t.Fatalf("audit log %+v, %v, want the release edit", entries, err)
+	}
+	if fields := entries[0].Release.Fields(); len(fields) != 2 || fields[0].Field != "status" || fields[1].Field != "expected_ship" {
+		t.Errorf("recorded fields %+v", fields)
+	}
+
+	//An edit made from the old release is refused
+	stale := before
+	stale.Status = "shipped"
+	if _, err := commitRelease(AuditEntry{Author: "boss", Release: &ReleaseChange{Before: before, After: stale}}); err == nil {
+		t.Error("edit of a changed release saved")
+	}
+	if saved, _ := repo.Release("WAVE 1"); saved.Status != "pre-order" {
+		t.Errorf("stale edit applied: %+v", saved)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned for a figure, release or document that is not stored
+var ErrNotFound = errors.New("not found")
+
+// Filter selects figures by facet, e.g. {"race": "ELF", "scale": "1.0"}.
+// A figure matches when it has every value.
+type Filter map[string]string
+
+// Release is a wave, convention exclusive or campaign figures came out in
+type Release struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Figures     int    `json:"figures"`
+	//Where it is in its lifecycle, one of releaseStatuses; empty for releases
+	//nobody has described, which are taken to have shipped
+	Status string `json:"status,omitempty"`
+	//Crowdfunding campaign the release is part of, if any
+	Campaign string `json:"campaign,omitempty"`
+	//Dates as 2006-01-02, empty when not known
+	Announced     string `json:"announced,omitempty"`
+	PreorderStart string `json:"preorder_start,omitempty"`
+	PreorderEnd   string `json:"preorder_end,omitempty"`
+	ExpectedShip  string `json:"expected_ship,omitempty"`
+	Shipped       string `json:"shipped,omitempty"`
+}
+
+// Repository keeps the figures, releases and user data. Handlers only reach
+// stored data through it, so the backing store can be swapped in the config.
+type Repository interface {
+	// Figures lists the figures matching a filter in name order, all of them for an empty filter
+	Figures(filter Filter) (Checklist, error)
+	// FacetCounts counts the figures matching a filter per value of a facet type
+	FacetCounts(searchType string, filter Filter) (map[string]int, error)
+	Figure(name string) (Figure, error)
+	SaveFigure(figure Figure) error
+	DeleteFigure(name string) error
+	// ImportFigures replaces the figures read from the data files. Figures
+	// saved or deleted through the repository keep their changes.
+	ImportFigures(lst Checklist) error
+
+	Releases() ([]Release, error)
+	Release(name string) (Release, error)
+	SaveRelease(release Release) error
+	DeleteRelease(name string) error
+
+	// LoadDocument reads a stored JSON document into v, leaving v untouched when there is none
+	LoadDocument(name string, v interface{}) error
+	SaveDocument(name string, v interface{}) error
+
+	Close() error
+}
+
+// The repository every handler uses, opened at startup
+var repo Repository
+
+// openRepository opens the storage backend named in the config
+func openRepository(cfg Config) (Repository, error) {
+	switch cfg.Storage {
+	case "", "json":
+		return openJSONRepository(cfg.DataDir)
+	case "sqlite":
+		return openSQLRepository(filepath.Join(cfg.DataDir, "legionsdex.db"))
+	}
+	return nil, fmt.Errorf("unknown storage %q, use json or sqlite", cfg.Storage)
+}
+
+// checkFilter rejects filters on something that is not a facet type
+func checkFilter(filter Filter) error {
+	for searchType := range filter {
+		known := false
+		for _, facet := range facetTypes {
+			if searchType == facet {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown facet %q", searchType)
+		}
+	}
+	return nil
+}
+
+// matchesFilter reports whether a figure has every value of a filter
+func matchesFilter(figure Figure, filter Filter) bool {
+	for searchType, want := range filter {
+		found := false
+		for _, value := range facetValues(figure, searchType) {
+			if value == want {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeReleases adds figure counts to stored releases, and a bare release for
+// every release value that has no stored record
+func mergeReleases(stored []Release, counts map[string]int) []Release {
+	var releases []Release
+	seen := make(map[string]bool)
+	for _, release := range stored {
+		release.Figures = counts[release.Name]
+		releases = append(releases, release)
+		seen[release.Name] = true
+	}
+	for name, count := range counts {
+		if !seen[name] {
+			releases = append(releases, Release{Name: name, Figures: count})
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Name < releases[j].Name
+	})
+	return releases
+}
+
+// storageError answers a request the repository failed to serve
+func storageError(w http.ResponseWriter, err error) {
+	log.Printf("storage: %v", err)
+	http.Error(w, "storage unavailable", http.StatusInternalServerError)
+}
+
+// API listing the releases with their figure counts
+func releasesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	releases, err := repo.Releases()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	writeJSON(w, releases)
+}
+
+// Stored documents of the JSON repository
+const figureEditsDocument = "figure-edits.json"
+const releasesDocument = "releases.json"
+
+// jsonRepository keeps figures in memory and everything else as JSON files in
+// the data directory. Saved and deleted figures are kept in figure-edits.json,
+// a deleted figure as null, and laid over the imported ones.
+type jsonRepository struct {
+	dir      string
+	mu       sync.RWMutex
+	imported Checklist
+	edits    map[string]*Figure
+	releases []Release
+	current  []Figure
+}
+
+// openJSONRepository reads the stored edits and releases from a data directory
+func openJSONRepository(dir string) (*jsonRepository, error) {
+	r := &jsonRepository{dir: dir, edits: make(map[string]*Figure)}
+	if err := r.LoadDocument(figureEditsDocument, &r.edits); err != nil {
+		return nil, err
+	}
+	if err := r.LoadDocument(releasesDocument, &r.releases); err != nil {
+		return nil, err
+	}
+	r.apply()
+	return r, nil
+}
+
+// apply lays the edits over the imported figures; callers hold the write lock
+func (r *jsonRepository) apply() {
+	current := make([]Figure, 0, len(r.imported.Figures)+len(r.edits))
+	seen := make(map[string]bool)
+	for _, figure := range r.imported.Figures {
+		seen[figure.Name] = true
+		if edit, edited := r.edits[figure.Name]; edited {
+			if edit != nil {
+				current = append(current, *edit)
+			}
+			continue
+		}
+		current = append(current, figure)
+	}
+	for name, edit := range r.edits {
+		if !seen[name] && edit != nil {
+			current = append(current, *edit)
+		}
+	}
+	sort.Slice(current, func(i, j int) bool {
+		return current[i].Name < current[j].Name
+	})
+	r.current = current
+}
+
+func (r *jsonRepository) Figures(filter Filter) (Checklist, error) {
+	var lst Checklist
+	if err := checkFilter(filter); err != nil {
+		return lst, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, figure := range r.current {
+		if matchesFilter(figure, filter) {
+			lst.AddItem(figure)
+		}
+	}
+	return lst, nil
+}
+
+func (r *jsonRepository) FacetCounts(searchType string, filter Filter) (map[string]int, error) {
+	if err := checkFilter(Filter{searchType: ""}); err != nil {
+		return nil, err
+	}
+	lst, err := r.Figures(filter)
+	if err != nil {
+		return nil, err
+	}
+	return facetData(lst, searchType), nil
+}
+
+func (r *jsonRepository) Figure(name string) (Figure, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, figure := range r.current {
+		if figure.Name == name {
+			return figure, nil
+		}
+	}
+	return Figure{}, ErrNotFound
+}
+
+func (r *jsonRepository) SaveFigure(figure Figure) error {
+	if figure.Name == "" {
+		return fmt.Errorf("figure has no name")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.saveEdit(figure.Name, &figure)
+}
+
+func (r *jsonRepository) DeleteFigure(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := false
+	for _, figure := range r.current {
+		if figure.Name == name {
+			found = true
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return r.saveEdit(name, nil)
+}
+
+// saveEdit writes the edits with one figure changed, nil for deleted, and
+// only then puts them in place, so a failed write leaves the figures as they
+// are on disk. Callers hold the write lock.
+func (r *jsonRepository) saveEdit(name string, figure *Figure) error {
+	edits := make(map[string]*Figure, len(r.edits)+1)
+	for editName, edit := range r.edits {
+		edits[editName] = edit
+	}
+	edits[name] = figure
+	if err := r.SaveDocument(figureEditsDocument, edits); err != nil {
+		return err
+	}
+	r.edits = edits
+	r.apply()
+	return nil
+}
+
+// saveReleases writes the releases and only then puts them in place; callers
+// hold the write lock
+func (r *jsonRepository) saveReleases(releases []Release) error {
+	if err := r.SaveDocument(releasesDocument, releases); err != nil {
+		return err
+	}
+	r.releases = releases
+	return nil
+}
+
+func (r *jsonRepository) ImportFigures(lst Checklist) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.imported = lst
+	r.apply()
+	return nil
+}
+
+func (r *jsonRepository) Releases() ([]Release, error) {
+	counts, err := r.FacetCounts("release", nil)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return mergeReleases(r.releases, counts), nil
+}
+
+func (r *jsonRepository) Release(name string) (Release, error) {
+	releases, err := r.Releases()
+	if err != nil {
+		return Release{}, err
+	}
+	for _, release := range releases {
+		if release.Name == name {
+			return release, nil
+		}
+	}
+	return Release{}, ErrNotFound
+}
+
+func (r *jsonRepository) SaveRelease(release Release) error {
+	if release.Name == "" {
+		return fmt.Errorf("release has no name")
+	}
+	release.Figures = 0
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	releases := append([]Release(nil), r.releases...)
+	for i := range releases {
+		if releases[i].Name == release.Name {
+			releases[i] = release
+			return r.saveReleases(releases)
+		}
+	}
+	return r.saveReleases(append(releases, release))
+}
+
+func (r *jsonRepository) DeleteRelease(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.releases {
+		if r.releases[i].Name == name {
+			releases := append([]Release(nil), r.releases[:i]...)
+			return r.saveReleases(append(releases, r.releases[i+1:]...))
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *jsonRepository) LoadDocument(name string, v interface{}) error {
+	raw, err := os.ReadFile(filepath.Join(r.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// SaveDocument replaces the old file only once the new one is complete
+func (r *jsonRepository) SaveDocument(name string, v interface{}) error {
+	raw, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(r.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(raw)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (r *jsonRepository) Close() error {
+	return nil
+}
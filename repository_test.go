@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONRepositoryFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	r, err := openJSONRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ImportFigures(Checklist{Figures: []Figure{{Name: "Knight"}}})
+	if err := r.SaveRelease(Release{Name: "WAVE 1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//A file where the data directory should be makes every write fail
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.dir = filepath.Join(blocked, "data")
+
+	tests := []struct {
+		name   string
+		change func() error
+	}{
+		{"save figure", func() error { return r.SaveFigure(Figure{Name: "Squire"}) }},
+		{"edit figure", func() error { return r.SaveFigure(Figure{Name: "Knight", Faction: "CHANGED"}) }},
+		{"delete figure", func() error { return r.DeleteFigure("Knight") }},
+		{"save release", func() error { return r.SaveRelease(Release{Name: "WAVE 2"}) }},
+		{"delete release", func() error { return r.DeleteRelease("WAVE 1") }},
+	}
+	for _, test := range tests {
+		if err := test.change(); err == nil {
+			t.Errorf("%s: no error from a failed write", test.name)
+		}
+	}
+
+	lst, _ := r.Figures(nil)
+	if len(lst.Figures) != 1 || lst.Figures[0].Name != "Knight" || lst.Figures[0].Faction != "" {
+		t.Errorf("figures changed by failed writes: %+v", lst.Figures)
+	}
+	if len(r.releases) != 1 || r.releases[0].Name != "WAVE 1" {
+		t.Errorf("releases changed by failed writes: %+v", r.releases)
+	}
+}
+
+// useTestRepository points the repository at an empty JSON one in a temporary
+// directory, holding the given figures
+func useTestRepository(t *testing.T, figures ...Figure) *jsonRepository {
+	r, err := openJSONRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ImportFigures(Checklist{Figures: figures})
+	repo = r
+	authCache = authIndex{}
+	return r
+}
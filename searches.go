@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Stored documents for saved searches and the hits they have found
+const searchesDocument = "searches.json"
+const inboxDocument = "inbox.json"
+
+// Most inbox items kept per user, the oldest are dropped beyond it
+const maxInboxItems = 200
+
+// SavedSearch is a set of facet filters and an optional text query kept by a user
+type SavedSearch struct {
+	ID      string            `json:"id"`
+	User    string            `json:"user"`
+	Name    string            `json:"name"`
+	Filters map[string]string `json:"filters,omitempty"`
+	Query   string            `json:"query,omitempty"`
+	Created time.Time         `json:"created"`
+	Matches []string          `json:"matches"`
+}
+
+// InboxItem is a figure that newly matched a saved search
+type InboxItem struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	SearchID   string    `json:"search_id"`
+	SearchName string    `json:"search_name"`
+	Figure     string    `json:"figure"`
+	Found      time.Time `json:"found"`
+	Delivered  bool      `json:"delivered"`
+}
+
+// Data for the saved searches page
+type SearchesPageData struct {
+	Title    string
+	User     string
+	CSRF     string
+	Searches []SavedSearch
+	Counts   map[string]int
+	Inbox    []InboxItem
+	Options  map[string][]string
+}
+
+// matchesSearch reports whether a figure has every filtered value and contains the query
+func matchesSearch(figure Figure, search SavedSearch) bool {
+	for searchType, want := range search.Filters {
+		found := false
+		for _, value := range facetValues(figure, searchType) {
+			if strings.EqualFold(value, want) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if search.Query == "" {
+		return true
+	}
+	query := strings.ToLower(search.Query)
+	if strings.Contains(strings.ToLower(figure.Name), query) {
+		return true
+	}
+	for _, searchType := range facetTypes {
+		for _, value := range facetValues(figure, searchType) {
+			if strings.Contains(strings.ToLower(value), query) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checklistBySearch creates a new checklist limited to figures matching a saved search
+func checklistBySearch(lst Checklist, search SavedSearch) Checklist {
+	var matches Checklist
+	for _, figure := range lst.Figures {
+		if matchesSearch(figure, search) {
+			matches.AddItem(figure)
+		}
+	}
+	return sortChecklist(matches)
+}
+
+// figureNames lists the names in a Checklist
+func figureNames(lst Checklist) []string {
+	names := make([]string, 0, len(lst.Figures))
+	for _, figure := range lst.Figures {
+		names = append(names, figure.Name)
+	}
+	return names
+}
+
+// checkSavedSearches runs every saved search against freshly loaded figures and
+// records figures that did not match before in the owner's inbox
+func checkSavedSearches(lst Checklist) {
+	if !config.Features.SavedSearches {
+		return
+	}
+	var searches []SavedSearch
+	var inbox []InboxItem
+	var found []InboxItem
+	err := updateDocument(searchesDocument, &searches, func() error {
+		now := time.Now()
+		for i := range searches {
+			known := make(map[string]bool)
+			for _, name := range searches[i].Matches {
+				known[name] = true
+			}
+			matches := figureNames(checklistBySearch(lst, searches[i]))
+			for _, name := range matches {
+				if !known[name] {
+					found = append(found, InboxItem{ID: newID(), User: searches[i].User, SearchID: searches[i].ID, SearchName: searches[i].Name, Figure: name, Found: now})
+				}
+			}
+			searches[i].Matches = matches
+		}
+		return nil
+	})
+	if err == nil && len(found) > 0 {
+		err = updateDocument(inboxDocument, &inbox, func() error {
+			inbox = trimInbox(append(inbox, found...), maxInboxItems)
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("saved searches: %v", err)
+		return
+	}
+	if len(found) > 0 {
+		log.Printf("saved searches: %d new matches", len(found))
+	}
+	go deliverInbox()
+}
+
+// trimInbox keeps the newest limit items of each user, in their order
+func trimInbox(inbox []InboxItem, limit int) []InboxItem {
+	kept := make(map[string]int)
+	keep := make([]bool, len(inbox))
+	for i := len(inbox) - 1; i >= 0; i-- {
+		if kept[inbox[i].User] < limit {
+			kept[inbox[i].User]++
+			keep[i] = true
+		}
+	}
+	var trimmed []InboxItem
+	for i, item := range inbox {
+		if keep[i] {
+			trimmed = append(trimmed, item)
+		}
+	}
+	return trimmed
+}
+
+// WebhookPayload is posted to the webhook for new matches of one saved search
+type WebhookPayload struct {
+	User    string   `json:"user"`
+	Search  string   `json:"search"`
+	Name    string   `json:"name"`
+	Figures []Figure `json:"figures"`
+}
+
+// Only one delivery runs at a time
+var deliverMu sync.Mutex
+
+// deliverInbox posts undelivered inbox items to the webhook, one request per
+// saved search, and marks them delivered when the receiver accepts them
+func deliverInbox() {
+	if config.WebhookURL == "" {
+		return
+	}
+	deliverMu.Lock()
+	defer deliverMu.Unlock()
+
+	var inbox []InboxItem
+	if err := readDocument(inboxDocument, &inbox); err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+	checklist := currentChecklist()
+	payloads := make(map[string]*WebhookPayload)
+	//The inbox items each payload carries, so only those are marked delivered
+	items := make(map[string][]string)
+	var order []string
+	for _, item := range inbox {
+		if item.Delivered {
+			continue
+		}
+		payload, exists := payloads[item.SearchID]
+		if !exists {
+			payload = &WebhookPayload{User: item.User, Search: item.SearchID, Name: item.SearchName}
+			payloads[item.SearchID] = payload
+			order = append(order, item.SearchID)
+		}
+		items[item.SearchID] = append(items[item.SearchID], item.ID)
+		for _, figure := range checklist.Figures {
+			if figure.Name == item.Figure {
+				payload.Figures = append(payload.Figures, figure)
+			}
+		}
+	}
+
+	delivered := make(map[string]bool)
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, id := range order {
+		body, _ := json.Marshal(payloads[id])
+		resp, err := client.Post(config.WebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("webhook: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("webhook: %s answered %s", config.WebhookURL, resp.Status)
+			continue
+		}
+		for _, item := range items[id] {
+			delivered[item] = true
+		}
+	}
+	if len(delivered) == 0 {
+		return
+	}
+	err := updateDocument(inboxDocument, &inbox, func() error {
+		for i := range inbox {
+			if delivered[inbox[i].ID] {
+				inbox[i].Delivered = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("webhook: %v", err)
+	}
+}
+
+// searchFromRequest builds a saved search from form or JSON input
+func searchFromRequest(r *http.Request, user string) (SavedSearch, error) {
+	search := SavedSearch{Filters: make(map[string]string)}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+			return search, err
+		}
+	} else {
+		search.Name = r.FormValue("name")
+		search.Query = r.FormValue("query")
+		for _, searchType := range facetTypes {
+			if value := strings.TrimSpace(r.FormValue(searchType)); value != "" {
+				search.Filters[searchType] = value
+			}
+		}
+	}
+	if err := checkFilter(Filter(search.Filters)); err != nil {
+		return search, err
+	}
+	search.Query = strings.TrimSpace(search.Query)
+	if len(search.Filters) == 0 && search.Query == "" {
+		return search, fmt.Errorf("a saved search needs a filter or a query")
+	}
+	if search.Name == "" {
+		var parts []string
+		for _, searchType := range facetTypes {
+			if value, exists := search.Filters[searchType]; exists {
+				parts = append(parts, value)
+			}
+		}
+		if search.Query != "" {
+			parts = append(parts, `"`+search.Query+`"`)
+		}
+		search.Name = strings.Join(parts, " ")
+	}
+	search.ID = newID()
+	search.User = user
+	search.Created = time.Now()
+	//Only figures added from now on are news
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		return search, err
+	}
+	search.Matches = figureNames(checklistBySearch(checklist, search))
+	return search, nil
+}
+
+// userSearches lists one user's saved searches and inbox, newest hits first
+func userSearches(user string) ([]SavedSearch, []InboxItem, error) {
+	var searches, mine []SavedSearch
+	var inbox, myInbox []InboxItem
+	if err := readDocument(searchesDocument, &searches); err != nil {
+		return nil, nil, err
+	}
+	if err := readDocument(inboxDocument, &inbox); err != nil {
+		return nil, nil, err
+	}
+	for _, search := range searches {
+		if search.User == user {
+			mine = append(mine, search)
+		}
+	}
+	for i := len(inbox) - 1; i >= 0; i-- {
+		if inbox[i].User == user {
+			myInbox = append(myInbox, inbox[i])
+		}
+	}
+	return mine, myInbox, nil
+}
+
+// Page listing the caller's saved searches and inbox
+func searchesHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata SearchesPageData
+	pagedata.Title = "Saved Searches"
+	pagedata.User = requestUser(r)
+	pagedata.CSRF = requestCSRF(r)
+	pagedata.Options = make(map[string][]string)
+	for _, searchType := range facetTypes {
+		pagedata.Options[searchType] = SortMapByKeys(facetData(checklist, searchType))
+	}
+	if pagedata.User != "" {
+		searches, inbox, err := userSearches(pagedata.User)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pagedata.Searches = searches
+		pagedata.Inbox = inbox
+		pagedata.Counts = make(map[string]int)
+		for _, search := range searches {
+			pagedata.Counts[search.ID] = len(checklistBySearch(checklist, search).Figures)
+		}
+	}
+	renderTemplate(w, searchestpl, pagedata)
+}
+
+// Creates a saved search from the page form or a JSON body
+func createSearchHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		http.Error(w, "no user", http.StatusUnauthorized)
+		return
+	}
+	search, err := searchFromRequest(r, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var searches []SavedSearch
+	err = updateDocument(searchesDocument, &searches, func() error {
+		searches = append(searches, search)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, search)
+		return
+	}
+	http.Redirect(w, r, "/searches", http.StatusSeeOther)
+}
+
+// Deletes one of the caller's saved searches
+func deleteSearchHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	id := mux.Vars(r)["id"]
+	var searches []SavedSearch
+	found := false
+	err := updateDocument(searchesDocument, &searches, func() error {
+		for i, search := range searches {
+			if search.ID == id && search.User == user {
+				searches = append(searches[:i], searches[i+1:]...)
+				found = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/searches", http.StatusSeeOther)
+}
+
+// API listing the caller's saved searches
+func searchesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	searches, _, err := userSearches(requestUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, searches)
+}
+
+// API listing the caller's inbox
+func inboxAPIHandler(w http.ResponseWriter, r *http.Request) {
+	_, inbox, err := userSearches(requestUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, inbox)
+}
+
+// Payloads received by the local test receiver, newest last
+var testHooks []json.RawMessage
+var testHooksMu sync.Mutex
+
+// Local webhook receiver for trying out delivery: POST stores and logs a
+// payload, GET lists the last few received
+func webhookTestHandler(w http.ResponseWriter, r *http.Request) {
+	testHooksMu.Lock()
+	defer testHooksMu.Unlock()
+	if r.Method == http.MethodPost {
+		var payload json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("test webhook received: %s", payload)
+		testHooks = append(testHooks, payload)
+		if len(testHooks) > 20 {
+			testHooks = testHooks[len(testHooks)-20:]
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, testHooks)
+}
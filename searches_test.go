@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCheckSavedSearches(t *testing.T) {
+	saved := config.Features.SavedSearches
+	config.Features.SavedSearches = true
+	defer func() { config.Features.SavedSearches = saved }()
+
+	knight := Figure{Name: "Knight", Faction: "ORDER"}
+	squire := Figure{Name: "Squire", Faction: "ORDER"}
+	imp := Figure{Name: "Imp", Faction: "CHAOS"}
+	useTestRepository(t)
+	searches := []SavedSearch{
+		{ID: "order", User: "boss", Name: "Order", Filters: map[string]string{"faction": "order"}, Matches: []string{"Knight"}},
+		{ID: "chaos", User: "other", Name: "Chaos", Filters: map[string]string{"faction": "CHAOS"}},
+	}
+	if err := updateDocument(searchesDocument, &searches, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	checkSavedSearches(Checklist{Figures: []Figure{knight, squire, imp}})
+	var inbox []InboxItem
+	if err := readDocument(inboxDocument, &inbox); err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, item := range inbox {
+		found = append(found, item.SearchID+": "+item.Figure)
+	}
+	if want := []string{"order: Squire", "chaos: Imp"}; !reflect.DeepEqual(found, want) {
+		t.Errorf("inbox has %v, want %v", found, want)
+	}
+
+	//Matches are remembered, so the same figures are not found again
+	checkSavedSearches(Checklist{Figures: []Figure{knight, squire, imp}})
+	if err := readDocument(inboxDocument, &inbox); err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 2 {
+		t.Errorf("inbox has %d items after checking again, want 2", len(inbox))
+	}
+}
+
+func TestTrimInbox(t *testing.T) {
+	var inbox []InboxItem
+	for i := 0; i < 4; i++ {
+		inbox = append(inbox, InboxItem{ID: fmt.Sprint("boss", i), User: "boss"}, InboxItem{ID: fmt.Sprint("other", i), User: "other"})
+	}
+	var ids []string
+	for _, item := range trimInbox(inbox, 2) {
+		ids = append(ids, item.ID)
+	}
+	if want := []string{"boss2", "other2", "boss3", "other3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("kept %v, want %v", ids, want)
+	}
+}
+
+func TestDeliverInbox(t *testing.T) {
+	useTestRepository(t, Figure{Name: "Knight"}, Figure{Name: "Imp"})
+	//The receiver refuses payloads for the chaos search
+	var received []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		received = append(received, payload.Search)
+		if payload.Search == "chaos" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+	saved := config.WebhookURL
+	config.WebhookURL = receiver.URL
+	defer func() { config.WebhookURL = saved }()
+
+	inbox := []InboxItem{
+		{ID: "1", User: "boss", SearchID: "order", Figure: "Knight"},
+		{ID: "2", User: "other", SearchID: "chaos", Figure: "Imp"},
+		{ID: "3", User: "boss", SearchID: "order", Figure: "Squire", Delivered: true},
+	}
+	if err := updateDocument(inboxDocument, &inbox, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	deliverInbox()
+	if want := []string{"order", "chaos"}; !reflect.DeepEqual(received, want) {
+		t.Errorf("received payloads for %v, want %v", received, want)
+	}
+	if err := readDocument(inboxDocument, &inbox); err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(map[string]bool)
+	for _, item := range inbox {
+		delivered[item.ID] = item.Delivered
+	}
+	if want := map[string]bool{"1": true, "2": false, "3": true}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("delivered %v, want %v", delivered, want)
+	}
+}
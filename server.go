@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Process exit codes
+const (
+	exitOK      = 0
+	exitConfig  = 2 // bad configuration, templates or data
+	exitListen  = 3 // could not open the listener
+	exitServe   = 4 // the server stopped with an error
+	exitTimeout = 5 // requests were still running when the drain timeout ran out
+)
+
+// fatal logs a startup error and exits with the given code
+func fatal(code int, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "legionsdex: "+format+"\n", args...)
+	os.Exit(code)
+}
+
+// newServer wraps the handler in an http.Server with the configured timeouts
+func newServer(cfg Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		IdleTimeout:  cfg.IdleTimeout.Duration,
+	}
+}
+
+// listen opens the Unix socket when one is configured, otherwise the TCP address
+func listen(cfg Config) (net.Listener, error) {
+	if cfg.Socket != "" {
+		//Clear a socket left behind by an unclean exit, but not one another
+		//instance is still serving on
+		if info, err := os.Lstat(cfg.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout("unix", cfg.Socket, time.Second); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use by another server", cfg.Socket)
+			}
+			os.Remove(cfg.Socket)
+		}
+		return net.Listen("unix", cfg.Socket)
+	}
+	return net.Listen("tcp", cfg.Addr)
+}
+
+// serve runs the server until SIGINT or SIGTERM, then drains open requests.
+// It returns the exit code instead of exiting, so the caller can clean up.
+func serve(cfg Config, srv *http.Server) int {
+	ln, err := listen(cfg)
+	if err != nil {
+		//Returned rather than fatal, so main still closes the repository
+		fmt.Fprintf(os.Stderr, "legionsdex: cannot listen: %v\n", err)
+		return exitListen
+	}
+	if cfg.Socket != "" {
+		defer os.Remove(cfg.Socket)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if cfg.TLSCert != "" {
+			log.Printf("serving https on %s", ln.Addr())
+			errc <- srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+		} else {
+			log.Printf("serving http on %s", ln.Addr())
+			errc <- srv.Serve(ln)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-errc:
+		log.Printf("server stopped: %v", err)
+		return exitServe
+	case sig := <-stop:
+		log.Printf("received %s, draining connections for up to %s", sig, cfg.DrainTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout.Duration)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+		return exitTimeout
+	}
+	if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("server stopped: %v", err)
+		return exitServe
+	}
+	log.Printf("shutdown complete")
+	return exitOK
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenSocket(t *testing.T) {
+	cfg := Config{Socket: filepath.Join(t.TempDir(), "ldx.sock")}
+	running, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+
+	//A second server must not take the socket from one still serving
+	if ln, err := listen(cfg); err == nil {
+		ln.Close()
+		t.Fatal("listened on a socket in use")
+	}
+	conn, err := net.Dial("unix", cfg.Socket)
+	if err != nil {
+		t.Fatalf("running server lost its socket: %v", err)
+	}
+	conn.Close()
+
+	//A socket left behind by a server that has gone is cleared
+	running.(*net.UnixListener).SetUnlinkOnClose(false)
+	running.Close()
+	ln, err := listen(cfg)
+	if err != nil {
+		t.Fatalf("stale socket not cleared: %v", err)
+	}
+	ln.Close()
+}
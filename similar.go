@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// SimilarityWeights sets how much a shared value of each facet type counts
+type SimilarityWeights map[string]float64
+
+// Set applies a comma separated list like "race=2,scale=0.5"
+func (weights SimilarityWeights) Set(list string) error {
+	for _, item := range splitList(list) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%q is not facet=weight", item)
+		}
+		weight, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", kv[0], err)
+		}
+		if err := checkWeight(kv[0], weight); err != nil {
+			return err
+		}
+		weights[kv[0]] = weight
+	}
+	return nil
+}
+
+// check refuses weights of unknown facet types or below zero, as Set does
+func (weights SimilarityWeights) check() error {
+	var names []string
+	for searchType := range weights {
+		names = append(names, searchType)
+	}
+	sort.Strings(names)
+	for _, searchType := range names {
+		if err := checkWeight(searchType, weights[searchType]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWeight refuses a weight for anything but a facet type, or one below zero
+func checkWeight(searchType string, weight float64) error {
+	if !containsString(facetTypes, searchType) {
+		return fmt.Errorf("%s is not a facet, use one of %s", searchType, strings.Join(facetTypes, ", "))
+	}
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return fmt.Errorf("%s: weight must be a number from 0 up", searchType)
+	}
+	return nil
+}
+
+// SimilarFigure is a figure with its similarity score and what it shares
+type SimilarFigure struct {
+	Figure Figure   `json:"figure"`
+	Score  float64  `json:"score"`
+	Shared []string `json:"shared"`
+}
+
+// facetValues lists a figure's values of a facet type
+func facetValues(figure Figure, searchType string) []string {
+	switch searchType {
+	case "faction":
+		return []string{figure.Faction}
+	case "race":
+		return []string{figure.Race}
+	case "role":
+		return []string{figure.Role}
+	case "release":
+		return figure.Release
+	case "scale":
+		return []string{figure.Scale}
+	}
+	return nil
+}
+
+// similarFigures scores every other figure against one, best first. A shared
+// value scores its facet weight times its rarity, log(figures / figures with
+// the value), so a shared "DRAGOSYR" race counts far more than a shared "1.0" scale.
+func similarFigures(lst Checklist, target Figure, weights SimilarityWeights, limit int) []SimilarFigure {
+	total := float64(len(lst.Figures))
+	rarity := make(map[string]map[string]float64)
+	for searchType := range weights {
+		rarity[searchType] = make(map[string]float64)
+		for value, count := range facetData(lst, searchType) {
+			rarity[searchType][value] = math.Log(total / float64(count))
+		}
+	}
+
+	var similar []SimilarFigure
+	for _, figure := range lst.Figures {
+		if figure.Name == target.Name {
+			continue
+		}
+		candidate := SimilarFigure{Figure: figure}
+		for _, searchType := range facetTypes {
+			weight := weights[searchType]
+			if weight == 0 {
+				continue
+			}
+			for _, value := range facetValues(target, searchType) {
+				for _, other := range facetValues(figure, searchType) {
+					if value == other {
+						candidate.Score += weight * rarity[searchType][value]
+						candidate.Shared = append(candidate.Shared, searchType+": "+value)
+					}
+				}
+			}
+		}
+		if candidate.Score > 0 {
+			similar = append(similar, candidate)
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		if similar[i].Score == similar[j].Score {
+			return similar[i].Figure.Name < similar[j].Figure.Name
+		}
+		return similar[i].Score > similar[j].Score
+	})
+	if limit > 0 && len(similar) > limit {
+		similar = similar[:limit]
+	}
+	return similar
+}
+
+// similarLimit reads ?n= from a request, falling back to the configured count
+func similarLimit(r *http.Request) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && n > 0 {
+		return n
+	}
+	return config.SimilarCount
+}
+
+// API listing the figures most similar to one figure
+func similarAPIHandler(w http.ResponseWriter, r *http.Request) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	figure, found := figureBySlug(checklist, mux.Vars(r)["figure"])
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	browsed, _, err := browseFigures(r, nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	writeJSON(w, similarFigures(browsed, figure, config.SimilarityWeights, similarLimit(r)))
+}
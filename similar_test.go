@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimilarFigures(t *testing.T) {
+	target := Figure{Name: "Target", Race: "DRAGOSYR", Scale: "1.0", Faction: "ORDER"}
+	checklist := Checklist{Figures: []Figure{
+		{Name: "Common C", Race: "HUMAN", Scale: "1.0", Faction: "CHAOS"},
+		target,
+		{Name: "Common A", Race: "HUMAN", Scale: "1.0", Faction: "CHAOS"},
+		{Name: "Rare", Race: "DRAGOSYR", Scale: "2.0", Faction: "CHAOS"},
+		{Name: "Common B", Race: "HUMAN", Scale: "1.0", Faction: "CHAOS"},
+		{Name: "Stranger", Race: "ELF", Scale: "2.0", Faction: "ORDER"},
+	}}
+	weights := SimilarityWeights{"race": 1, "scale": 1}
+	tests := []struct {
+		name    string
+		weights SimilarityWeights
+		limit   int
+		want    []string
+	}{
+		{"rare shared value first, ties by name", weights, 0, []string{"Rare", "Common A", "Common B", "Common C"}},
+		{"limit", weights, 2, []string{"Rare", "Common A"}},
+		{"zero weight facets are ignored", SimilarityWeights{"race": 1, "scale": 0}, 0, []string{"Rare"}},
+		{"weights change the order", SimilarityWeights{"race": 1, "scale": 10}, 0, []string{"Common A", "Common B", "Common C", "Rare"}},
+		{"no weights", SimilarityWeights{}, 0, nil},
+	}
+	for _, test := range tests {
+		var names []string
+		for _, similar := range similarFigures(checklist, target, test.weights, test.limit) {
+			names = append(names, similar.Figure.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, names, test.want)
+		}
+	}
+
+	similar := similarFigures(checklist, target, weights, 1)
+	if want := []string{"race: DRAGOSYR"}; len(similar) != 1 || !reflect.DeepEqual(similar[0].Shared, want) {
+		t.Errorf("got %+v, want Rare sharing %v", similar, want)
+	}
+}
+
+func TestSimilarityWeightsSet(t *testing.T) {
+	tests := []struct {
+		list string
+		ok   bool
+	}{
+		{"race=2,scale=0.5", true},
+		{"release=0", true},
+		{"rase=2", false},
+		{"race=-1", false},
+		{"race=NaN", false},
+		{"race", false},
+		{"race=heavy", false},
+	}
+	for _, test := range tests {
+		weights := SimilarityWeights{}
+		if err := weights.Set(test.list); (err == nil) != test.ok {
+			t.Errorf("Set(%q): error %v", test.list, err)
+		}
+	}
+	if err := (SimilarityWeights{"race": 1, "rase": 2}).check(); err == nil {
+		t.Error("check accepted an unknown facet")
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Schema changes, applied in order. The database's user_version is the
+// number of migrations it has had; only ever add to the end.
+var sqlMigrations = []string{
+	//1: figures, their releases, release records and stored documents
+	`CREATE TABLE figures (
+		name     TEXT PRIMARY KEY,
+		faction  TEXT NOT NULL DEFAULT '',
+		race     TEXT NOT NULL DEFAULT '',
+		role     TEXT NOT NULL DEFAULT '',
+		scale    TEXT NOT NULL DEFAULT '',
+		url      TEXT NOT NULL DEFAULT '',
+		image    TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL DEFAULT 0,
+		edited   INTEGER NOT NULL DEFAULT 0,
+		deleted  INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX figures_faction ON figures (faction);
+	CREATE INDEX figures_race ON figures (race);
+	CREATE INDEX figures_role ON figures (role);
+	CREATE INDEX figures_scale ON figures (scale);
+	CREATE TABLE figure_releases (
+		figure   TEXT NOT NULL REFERENCES figures (name) ON DELETE CASCADE,
+		release  TEXT NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (figure, release)
+	);
+	CREATE INDEX figure_releases_release ON figure_releases (release);
+	CREATE TABLE releases (
+		name        TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE documents (
+		name    TEXT PRIMARY KEY,
+		body    TEXT NOT NULL,
+		updated TEXT NOT NULL
+	);`,
+	//2: release lifecycle status, campaign and dates
+	`ALTER TABLE releases ADD COLUMN status TEXT NOT NULL DEFAULT '';
+	ALTER TABLE releases ADD COLUMN campaign TEXT NOT NULL DEFAULT '';
+	ALTER TABLE releases ADD COLUMN announced TEXT NOT NULL DEFAULT '';
+	ALTER TABLE releases ADD COLUMN preorder_start TEXT NOT NULL DEFAULT '';
+	ALTER TABLE releases ADD COLUMN preorder_end TEXT NOT NULL DEFAULT '';
+	ALTER TABLE releases ADD COLUMN expected_ship TEXT NOT NULL DEFAULT '';
+	ALTER TABLE releases ADD COLUMN shipped TEXT NOT NULL DEFAULT '';`,
+	//3: parts figures come with, tags separated by commas
+	`CREATE TABLE figure_parts (
+		figure    TEXT NOT NULL REFERENCES figures (name) ON DELETE CASCADE,
+		position  INTEGER NOT NULL DEFAULT 0,
+		name      TEXT NOT NULL,
+		type      TEXT NOT NULL,
+		colors    TEXT NOT NULL DEFAULT '',
+		materials TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (figure, position)
+	);
+	CREATE INDEX figure_parts_name ON figure_parts (name COLLATE NOCASE);`,
+}
+
+// Columns of the single valued facet types
+var sqlFacetColumns = map[string]string{
+	"faction": "f.faction",
+	"race":    "f.race",
+	"role":    "f.role",
+	"scale":   "f.scale",
+}
+
+// sqlRepository keeps everything in an embedded SQLite database. Figures
+// saved or deleted through the repository are flagged as edited, and a
+// deleted one stays as a flagged row, so an import leaves them alone.
+type sqlRepository struct {
+	db *sql.DB
+}
+
+// openSQLRepository opens or creates a database and brings its schema up to date
+func openSQLRepository(file string) (*sqlRepository, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+file+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	//One connection, so writers never find the database locked
+	db.SetMaxOpenConns(1)
+	r := &sqlRepository{db: db}
+	if err := r.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return r, nil
+}
+
+// migrate applies the migrations the database has not had yet
+func (r *sqlRepository) migrate() error {
+	var version int
+	if err := r.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("schema version %d is newer than supported version %d", version, len(sqlMigrations))
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, err := r.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("storage: applied migration %d", i+1)
+	}
+	return nil
+}
+
+// where turns a filter into a condition on figures f, with its arguments
+func (r *sqlRepository) where(filter Filter) (string, []interface{}, error) {
+	if err := checkFilter(filter); err != nil {
+		return "", nil, err
+	}
+	conditions := []string{"f.deleted = 0"}
+	var args []interface{}
+	for _, searchType := range facetTypes {
+		value, exists := filter[searchType]
+		if !exists {
+			continue
+		}
+		if searchType == "release" {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM figure_releases m WHERE m.figure = f.name AND m.release = ?)")
+		} else {
+			conditions = append(conditions, sqlFacetColumns[searchType]+" = ?")
+		}
+		args = append(args, value)
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// query lists the figures meeting a condition, in name order
+func (r *sqlRepository) query(where string, args []interface{}) (Checklist, error) {
+	var lst Checklist
+	rows, err := r.db.Query("SELECT f.name, f.faction, f.race, f.role, f.scale, f.url, f.image FROM figures f WHERE "+where+" ORDER BY f.name", args...)
+	if err != nil {
+		return lst, err
+	}
+	index := make(map[string]int)
+	for rows.Next() {
+		var figure Figure
+		if err := rows.Scan(&figure.Name, &figure.Faction, &figure.Race, &figure.Role, &figure.Scale, &figure.Url, &figure.Image); err != nil {
+			rows.Close()
+			return lst, err
+		}
+		index[figure.Name] = len(lst.Figures)
+		lst.AddItem(figure)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return lst, err
+	}
+
+	rows, err = r.db.Query("SELECT r.figure, r.release FROM figure_releases r JOIN figures f ON f.name = r.figure WHERE "+where+" ORDER BY r.figure, r.position", args...)
+	if err != nil {
+		return lst, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, release string
+		if err := rows.Scan(&name, &release); err != nil {
+			return lst, err
+		}
+		if i, exists := index[name]; exists {
+			lst.Figures[i].Release = append(lst.Figures[i].Release, release)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return lst, err
+	}
+
+	parts, err := r.db.Query("SELECT p.figure, p.name, p.type, p.colors, p.materials FROM figure_parts p JOIN figures f ON f.name = p.figure WHERE "+where+" ORDER BY p.figure, p.position", args...)
+	if err != nil {
+		return lst, err
+	}
+	defer parts.Close()
+	for parts.Next() {
+		var name, colors, materials string
+		var part Part
+		if err := parts.Scan(&name, &part.Name, &part.Type, &colors, &materials); err != nil {
+			return lst, err
+		}
+		part.Colors = partTags(colors)
+		part.Materials = partTags(materials)
+		if i, exists := index[name]; exists {
+			lst.Figures[i].Parts = append(lst.Figures[i].Parts, part)
+		}
+	}
+	return lst, parts.Err()
+}
+
+func (r *sqlRepository) Figures(filter Filter) (Checklist, error) {
+	where, args, err := r.where(filter)
+	if err != nil {
+		return Checklist{}, err
+	}
+	return r.query(where, args)
+}
+
+func (r *sqlRepository) FacetCounts(searchType string, filter Filter) (map[string]int, error) {
+	where, args, err := r.where(filter)
+	if err != nil {
+		return nil, err
+	}
+	var query string
+	if searchType == "release" {
+		query = "SELECT r.release, COUNT(*) FROM figure_releases r JOIN figures f ON f.name = r.figure WHERE " + where + " GROUP BY r.release"
+	} else if column, exists := sqlFacetColumns[searchType]; exists {
+		query = "SELECT " + column + ", COUNT(*) FROM figures f WHERE " + where + " GROUP BY " + column
+	} else {
+		return nil, fmt.Errorf("unknown facet %q", searchType)
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var value string
+		var count int
+		if err := rows.Scan(&value, &count); err != nil {
+			return nil, err
+		}
+		counts[value] = count
+	}
+	return counts, rows.Err()
+}
+
+func (r *sqlRepository) Figure(name string) (Figure, error) {
+	lst, err := r.query("f.deleted = 0 AND f.name = ?", []interface{}{name})
+	if err != nil {
+		return Figure{}, err
+	}
+	if len(lst.Figures) == 0 {
+		return Figure{}, ErrNotFound
+	}
+	return lst.Figures[0], nil
+}
+
+// insertReleases stores a figure's releases in their order
+func insertReleases(tx *sql.Tx, figure Figure) error {
+	for i, release := range figure.Release {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO figure_releases (figure, release, position) VALUES (?, ?, ?)", figure.Name, release, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertParts stores a figure's parts in their order
+func insertParts(tx *sql.Tx, figure Figure) error {
+	for i, part := range figure.Parts {
+		if _, err := tx.Exec("INSERT INTO figure_parts (figure, position, name, type, colors, materials) VALUES (?, ?, ?, ?, ?, ?)",
+			figure.Name, i, part.Name, part.Type, strings.Join(part.Colors, ","), strings.Join(part.Materials, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlRepository) SaveFigure(figure Figure) error {
+	if figure.Name == "" {
+		return fmt.Errorf("figure has no name")
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO figures (name, faction, race, role, scale, url, image, position, edited)
+		VALUES (?, ?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(position) + 1, 0) FROM figures), 1)
+		ON CONFLICT (name) DO UPDATE SET faction = excluded.faction, race = excluded.race, role = excluded.role,
+			scale = excluded.scale, url = excluded.url, image = excluded.image, edited = 1, deleted = 0`,
+		figure.Name, figure.Faction, figure.Race, figure.Role, figure.Scale, figure.Url, figure.Image)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM figure_releases WHERE figure = ?", figure.Name); err != nil {
+		return err
+	}
+	if err := insertReleases(tx, figure); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM figure_parts WHERE figure = ?", figure.Name); err != nil {
+		return err
+	}
+	if err := insertParts(tx, figure); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlRepository) DeleteFigure(name string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE figures SET edited = 1, deleted = 1 WHERE name = ? AND deleted = 0", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM figure_releases WHERE figure = ?", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM figure_parts WHERE figure = ?", name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlRepository) ImportFigures(lst Checklist) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM figures WHERE edited = 0"); err != nil {
+		return err
+	}
+	for i, figure := range lst.Figures {
+		res, err := tx.Exec(`INSERT INTO figures (name, faction, race, role, scale, url, image, position)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (name) DO NOTHING`,
+			figure.Name, figure.Faction, figure.Race, figure.Role, figure.Scale, figure.Url, figure.Image, i)
+		if err != nil {
+			return err
+		}
+		//Edited figures keep their own releases and parts
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := insertReleases(tx, figure); err != nil {
+			return err
+		}
+		if err := insertParts(tx, figure); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *sqlRepository) Releases() ([]Release, error) {
+	counts, err := r.FacetCounts("release", nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.Query("SELECT name, description, status, campaign, announced, preorder_start, preorder_end, expected_ship, shipped FROM releases")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stored []Release
+	for rows.Next() {
+		var release Release
+		if err := rows.Scan(&release.Name, &release.Description, &release.Status, &release.Campaign, &release.Announced,
+			&release.PreorderStart, &release.PreorderEnd, &release.ExpectedShip, &release.Shipped); err != nil {
+			return nil, err
+		}
+		stored = append(stored, release)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return mergeReleases(stored, counts), nil
+}
+
+func (r *sqlRepository) Release(name string) (Release, error) {
+	releases, err := r.Releases()
+	if err != nil {
+		return Release{}, err
+	}
+	for _, release := range releases {
+		if release.Name == name {
+			return release, nil
+		}
+	}
+	return Release{}, ErrNotFound
+}
+
+func (r *sqlRepository) SaveRelease(release Release) error {
+	if release.Name == "" {
+		return fmt.Errorf("release has no name")
+	}
+	_, err := r.db.Exec(`INSERT INTO releases (name, description, status, campaign, announced, preorder_start, preorder_end, expected_ship, shipped)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET description = excluded.description, status = excluded.status, campaign = excluded.campaign,
+		announced = excluded.announced, preorder_start = excluded.preorder_start, preorder_end = excluded.preorder_end,
+		expected_ship = excluded.expected_ship, shipped = excluded.shipped`,
+		release.Name, release.Description, release.Status, release.Campaign, release.Announced,
+		release.PreorderStart, release.PreorderEnd, release.ExpectedShip, release.Shipped)
+	return err
+}
+
+func (r *sqlRepository) DeleteRelease(name string) error {
+	res, err := r.db.Exec("DELETE FROM releases WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *sqlRepository) LoadDocument(name string, v interface{}) error {
+	var body string
+	err := r.db.QueryRow("SELECT body FROM documents WHERE name = ?", name).Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(body), v)
+}
+
+func (r *sqlRepository) SaveDocument(name string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec("INSERT INTO documents (name, body, updated) VALUES (?, ?, ?) ON CONFLICT (name) DO UPDATE SET body = excluded.body, updated = excluded.updated",
+		name, string(body), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (r *sqlRepository) Close() error {
+	return r.db.Close()
+}
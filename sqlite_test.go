@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// userVersion reads a database's user_version
+func userVersion(t *testing.T, db *sql.DB) int {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrations(t *testing.T) {
+	tests := []struct {
+		name string
+		from int
+	}{
+		{"fresh database", 0},
+		{"after the first migration", 1},
+		{"before parts", 2},
+		{"up to date", len(sqlMigrations)},
+	}
+	for _, test := range tests {
+		file := filepath.Join(t.TempDir(), "legionsdex.db")
+		db, err := sql.Open("sqlite", "file:"+file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < test.from; i++ {
+			if _, err := db.Exec(sqlMigrations[i]); err != nil {
+				t.Fatalf("%s: migration %d: %v", test.name, i+1, err)
+			}
+		}
+		if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", test.from)); err != nil {
+			t.Fatal(err)
+		}
+		if test.from > 0 {
+			if _, err := db.Exec("INSERT INTO figures (name, faction) VALUES ('Knight', 'ORDER')"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		r, err := openSQLRepository(file)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if version := userVersion(t, r.db); version != len(sqlMigrations) {
+			t.Errorf("%s: user_version %d, want %d", test.name, version, len(sqlMigrations))
+		}
+		if test.from > 0 {
+			figure, err := r.Figure("Knight")
+			if err != nil || figure.Faction != "ORDER" {
+				t.Errorf("%s: figure lost in migration: %+v, %v", test.name, figure, err)
+			}
+		}
+		figure := Figure{Name: "Squire", Parts: []Part{{Name: "Great Helm", Type: "helmet", Colors: []string{"gold"}}}}
+		if err := r.SaveFigure(figure); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if saved, err := r.Figure("Squire"); err != nil || len(saved.Parts) != 1 {
+			t.Errorf("%s: parts not saved: %+v, %v", test.name, saved, err)
+		}
+		r.Close()
+	}
+}
+
+func TestMigrationsNewerSchema(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "legionsdex.db")
+	db, err := sql.Open("sqlite", "file:"+file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(sqlMigrations)+1)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if r, err := openSQLRepository(file); err == nil {
+		r.Close()
+		t.Error("opened a database from a newer version")
+	}
+}
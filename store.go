@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// Serialises read-modify-write cycles of stored documents
+var storeMu sync.Mutex
+
+// updateDocument loads a document, lets change modify it and saves it, all
+// under the store lock
+func updateDocument(name string, v interface{}, change func() error) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if err := repo.LoadDocument(name, v); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	return repo.SaveDocument(name, v)
+}
+
+// readDocument loads a document under the store lock
+func readDocument(name string, v interface{}) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	return repo.LoadDocument(name, v)
+}
+
+// newID makes a random identifier for stored records
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
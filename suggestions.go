@@ -0,0 +1,386 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Stored document of suggested edits
+const proposalsDocument = "proposals.json"
+
+// Proposal is an edit to a figure suggested by a visitor, waiting for a moderator
+type Proposal struct {
+	ID        string    `json:"id"`
+	Submitter string    `json:"submitter"`
+	Submitted time.Time `json:"submitted"`
+	Note      string    `json:"note,omitempty"`
+	//The figure as the submitter saw it, and as they would have it
+	Before Figure `json:"before"`
+	After  Figure `json:"after"`
+
+	Status    string    `json:"status"`
+	Moderator string    `json:"moderator,omitempty"`
+	Decided   time.Time `json:"decided,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	AuditID   string    `json:"audit_id,omitempty"`
+}
+
+// Fields lists what the proposal changes
+func (proposal Proposal) Fields() []FieldChange {
+	return AuditChange{Before: &proposal.Before, After: &proposal.After}.Fields()
+}
+
+// applyProposal makes the fields a proposal changes on the figure as it is
+// now, so edits made since the proposal was submitted are kept
+func applyProposal(current Figure, proposal Proposal) Figure {
+	applied := current
+	if proposal.Before.Name != proposal.After.Name {
+		applied.Name = proposal.After.Name
+	}
+	for _, field := range []struct{ into, before, after *string }{
+		{&applied.Faction, &proposal.Before.Faction, &proposal.After.Faction},
+		{&applied.Race, &proposal.Before.Race, &proposal.After.Race},
+		{&applied.Role, &proposal.Before.Role, &proposal.After.Role},
+		{&applied.Scale, &proposal.Before.Scale, &proposal.After.Scale},
+		{&applied.Url, &proposal.Before.Url, &proposal.After.Url},
+		{&applied.Image, &proposal.Before.Image, &proposal.After.Image},
+	} {
+		if *field.before != *field.after {
+			*field.into = *field.after
+		}
+	}
+	if strings.Join(proposal.Before.Release, "\n") != strings.Join(proposal.After.Release, "\n") {
+		applied.Release = proposal.After.Release
+	}
+	if partsText(proposal.Before.Parts) != partsText(proposal.After.Parts) {
+		applied.Parts = proposal.After.Parts
+	}
+	return applied
+}
+
+// Data for the public suggestion pages
+type SuggestPageData struct {
+	Title     string
+	Type      string
+	Value     string
+	Checklist Checklist
+	Figure    Figure
+	Released  string
+	Parts     string
+	Submitter string
+	CSRF      string
+	Note      string
+	Problems  []string
+	Submitted bool
+}
+
+// Data for the moderation queue
+type ProposalsPageData struct {
+	Title     string
+	User      string
+	Pending   []Proposal
+	Decided   []Proposal
+	Problems  []string
+	Slugs     map[string]string
+	Conflicts map[string]bool
+}
+
+// Page picking a figure of a facet value to suggest an edit to
+func suggestPickerHandler(w http.ResponseWriter, r *http.Request) {
+	var pagedata SuggestPageData
+	pagedata.Type = r.FormValue("type")
+	pagedata.Value = r.FormValue("value")
+	checklist, err := repo.Figures(nil)
+	if pagedata.Type != "" && pagedata.Value != "" {
+		checklist, err = repo.Figures(Filter{pagedata.Type: pagedata.Value})
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	pagedata.Title = "Suggest an Edit"
+	if pagedata.Value != "" {
+		pagedata.Title += ": " + strings.ToTitle(pagedata.Value)
+	}
+	pagedata.Checklist = checklist
+	renderTemplate(w, suggesttpl, pagedata)
+}
+
+// suggestFigure finds the figure named by the route's slug
+func suggestFigure(w http.ResponseWriter, r *http.Request) (Figure, bool) {
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return Figure{}, false
+	}
+	figure, found := figureBySlug(checklist, mux.Vars(r)["figure"])
+	if !found {
+		http.NotFound(w, r)
+	}
+	return figure, found
+}
+
+// Largest suggestion form accepted, the figure fields and a note
+const maxSuggestionBytes = 64 << 10
+
+// How many suggestions one address can make in suggestWindow
+const maxSuggestions = 10
+const suggestWindow = time.Hour
+
+// Recent suggestions per remote address, for the rate limit
+var suggestMu sync.Mutex
+var suggestTimes = make(map[string][]time.Time)
+
+// allowSuggestion reports whether an address may make another suggestion,
+// and counts it if so
+func allowSuggestion(addr string, now time.Time) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	suggestMu.Lock()
+	defer suggestMu.Unlock()
+	var recent []time.Time
+	for _, t := range suggestTimes[addr] {
+		if now.Sub(t) < suggestWindow {
+			recent = append(recent, t)
+		}
+	}
+	//Forget addresses that have gone quiet, so the map stays small
+	for other, times := range suggestTimes {
+		if len(times) > 0 && now.Sub(times[len(times)-1]) >= suggestWindow {
+			delete(suggestTimes, other)
+		}
+	}
+	if len(recent) >= maxSuggestions {
+		suggestTimes[addr] = recent
+		return false
+	}
+	suggestTimes[addr] = append(recent, now)
+	return true
+}
+
+// guestName marks the name a signed out visitor gives, so it cannot pass for
+// an account; account names have no spaces or colons
+func guestName(name string) string {
+	name = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(name), "guest:"))
+	if name == "" {
+		return "anonymous"
+	}
+	if runes := []rune(name); len(runes) > 40 {
+		name = string(runes[:40])
+	}
+	return "guest: " + name
+}
+
+// Form suggesting an edit to a figure
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	figure, found := suggestFigure(w, r)
+	if !found {
+		return
+	}
+	var pagedata SuggestPageData
+	pagedata.Title = "Suggest an Edit: " + figure.Name
+	pagedata.Figure = figure
+	pagedata.Released = strings.Join(figure.Release, "\n")
+	pagedata.Parts = partsText(figure.Parts)
+	pagedata.Submitter = requestUser(r)
+	pagedata.CSRF = requestCSRF(r)
+	renderTemplate(w, suggesttpl, pagedata)
+}
+
+// Stores a suggested edit for moderation
+func submitSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	before, found := suggestFigure(w, r)
+	if !found {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSuggestionBytes)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "suggestion too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	proposal := Proposal{
+		ID:        newID(),
+		Submitter: guestName(r.FormValue("submitter")),
+		Submitted: time.Now(),
+		Note:      strings.TrimSpace(r.FormValue("note")),
+		Before:    before,
+		After:     figureFromForm(r),
+		Status:    "pending",
+	}
+	//Signed in visitors are credited by account, as long as the form came from this site
+	if requestUser(r) != "" && validCSRF(r) {
+		proposal.Submitter = requestUser(r)
+	}
+	var pagedata SuggestPageData
+	pagedata.Title = "Suggest an Edit: " + before.Name
+	pagedata.Figure = proposal.After
+	pagedata.Released = strings.Join(proposal.After.Release, "\n")
+	pagedata.Parts = partsText(proposal.After.Parts)
+	pagedata.Submitter = proposal.Submitter
+	pagedata.CSRF = requestCSRF(r)
+	if pagedata.CSRF == "" {
+		pagedata.Submitter = strings.TrimSpace(r.FormValue("submitter"))
+	}
+	pagedata.Note = proposal.Note
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	pagedata.Problems = validateFigure(proposal.After, figuresAfter(checklist, []AuditChange{{Before: &before, After: &proposal.After}}))
+	if len(proposal.Fields()) == 0 {
+		pagedata.Problems = append(pagedata.Problems, "nothing was changed")
+	}
+	if len(proposal.Note) > 2000 {
+		pagedata.Problems = append(pagedata.Problems, "the note is too long")
+	}
+	if len(pagedata.Problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, suggesttpl, pagedata)
+		return
+	}
+	if !allowSuggestion(r.RemoteAddr, time.Now()) {
+		http.Error(w, "too many suggestions, try again later", http.StatusTooManyRequests)
+		return
+	}
+	var proposals []Proposal
+	err = updateDocument(proposalsDocument, &proposals, func() error {
+		proposals = append(proposals, proposal)
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	pagedata.Submitted = true
+	renderTemplate(w, suggesttpl, pagedata)
+}
+
+// renderProposals shows the moderation queue with any problems to report
+func renderProposals(w http.ResponseWriter, r *http.Request, problems []string) {
+	var proposals []Proposal
+	if err := readDocument(proposalsDocument, &proposals); err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata ProposalsPageData
+	pagedata.Title = "Suggested Edits"
+	pagedata.User = adminUser(r)
+	pagedata.Problems = problems
+	pagedata.Slugs = make(map[string]string)
+	pagedata.Conflicts = make(map[string]bool)
+	for _, proposal := range proposals {
+		if proposal.Status != "pending" {
+			pagedata.Decided = append(pagedata.Decided, proposal)
+			continue
+		}
+		pagedata.Pending = append(pagedata.Pending, proposal)
+		current, err := repo.Figure(proposal.Before.Name)
+		if err == nil {
+			pagedata.Slugs[proposal.ID] = current.Slug()
+		}
+		//Edited or deleted since it was suggested
+		pagedata.Conflicts[proposal.ID] = err != nil || !sameFigure(&current, &proposal.Before)
+	}
+	sort.SliceStable(pagedata.Decided, func(i, j int) bool {
+		return pagedata.Decided[i].Decided.After(pagedata.Decided[j].Decided)
+	})
+	if len(pagedata.Decided) > 20 {
+		pagedata.Decided = pagedata.Decided[:20]
+	}
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTemplate(w, proposalstpl, pagedata)
+}
+
+// Moderation queue of suggested edits
+func proposalsHandler(w http.ResponseWriter, r *http.Request) {
+	renderProposals(w, r, nil)
+}
+
+// decideProposal marks a pending proposal approved or rejected, letting apply
+// change the figures first for an approval
+func decideProposal(w http.ResponseWriter, r *http.Request, status string, apply func(Proposal) (string, []string)) {
+	id := mux.Vars(r)["id"]
+	var proposals []Proposal
+	if err := readDocument(proposalsDocument, &proposals); err != nil {
+		storageError(w, err)
+		return
+	}
+	var proposal *Proposal
+	for i := range proposals {
+		if proposals[i].ID == id && proposals[i].Status == "pending" {
+			proposal = &proposals[i]
+		}
+	}
+	if proposal == nil {
+		http.NotFound(w, r)
+		return
+	}
+	auditID := ""
+	if apply != nil {
+		var problems []string
+		if auditID, problems = apply(*proposal); len(problems) > 0 {
+			renderProposals(w, r, problems)
+			return
+		}
+	}
+	var stored []Proposal
+	err := updateDocument(proposalsDocument, &stored, func() error {
+		for i := range stored {
+			if stored[i].ID == id {
+				stored[i].Status = status
+				stored[i].Moderator = adminUser(r)
+				stored[i].Decided = time.Now()
+				stored[i].Reason = strings.TrimSpace(r.FormValue("reason"))
+				stored[i].AuditID = auditID
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/proposals", http.StatusSeeOther)
+}
+
+// Applies a suggested edit, crediting its submitter in the audit log
+func approveProposalHandler(w http.ResponseWriter, r *http.Request) {
+	decideProposal(w, r, "approved", func(proposal Proposal) (string, []string) {
+		current, err := repo.Figure(proposal.Before.Name)
+		if err != nil {
+			return "", []string{proposal.Before.Name + ": no longer exists"}
+		}
+		after := applyProposal(current, proposal)
+		entry := AuditEntry{
+			Author:    adminUser(r),
+			Action:    "suggestion",
+			Summary:   "Edited " + current.Name + ", suggested by " + proposal.Submitter,
+			Changes:   []AuditChange{{Before: &current, After: &after}},
+			Submitter: proposal.Submitter,
+			Proposal:  proposal.ID,
+		}
+		entry, err = commitChanges(entry)
+		if problems, invalid := err.(validationError); invalid {
+			return "", problems
+		}
+		if err != nil {
+			return "", []string{err.Error()}
+		}
+		return entry.ID, nil
+	})
+}
+
+// Turns a suggested edit down
+func rejectProposalHandler(w http.ResponseWriter, r *http.Request) {
+	decideProposal(w, r, "rejected", nil)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuestName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", "anonymous"},
+		{"  ", "anonymous"},
+		{"boss", "guest: boss"},
+		{" Jo Smith ", "guest: Jo Smith"},
+		{"guest: boss", "guest: boss"},
+		{"guest:", "anonymous"},
+		{strings.Repeat("x", 50), "guest: " + strings.Repeat("x", 40)},
+	}
+	for _, test := range tests {
+		if got := guestName(test.name); got != test.want {
+			t.Errorf("guestName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAllowSuggestion(t *testing.T) {
+	now := time.Now()
+	for i := 0; i < maxSuggestions; i++ {
+		if !allowSuggestion("192.0.2.1:4000", now) {
+			t.Fatalf("suggestion %d refused", i+1)
+		}
+	}
+	if allowSuggestion("192.0.2.1:4001", now) {
+		t.Error("suggestion over the limit allowed from another port of the same address")
+	}
+	if !allowSuggestion("192.0.2.2:4000", now) {
+		t.Error("another address refused")
+	}
+	if !allowSuggestion("192.0.2.1:4000", now.Add(suggestWindow)) {
+		t.Error("suggestion refused once the window has passed")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+)
+
+// TradeMatch is a possible trade with one partner
+type TradeMatch struct {
+	Partner string `json:"partner"`
+	//Figures the caller has for trade that the partner wants, and the reverse
+	Give      []string `json:"give"`
+	Get       []string `json:"get"`
+	GiveValue float64  `json:"give_value"`
+	GetValue  float64  `json:"get_value"`
+	//Whether figures were dropped to even the values out
+	Balanced bool `json:"balanced"`
+}
+
+// Score ranks partners: mutual figures first, then everything on offer
+func (match TradeMatch) Score() int {
+	give, get := len(match.Give), len(match.Get)
+	if give < get {
+		return give*1000 + get
+	}
+	return get*1000 + give
+}
+
+// Difference is how far apart the values of both sides are
+func (match TradeMatch) Difference() float64 {
+	return math.Abs(match.GiveValue - match.GetValue)
+}
+
+// tradeValue is what a figure is worth by the giver's record, else the receiver's
+func tradeValue(figure string, giver Collection, receiver Collection) float64 {
+	if value, recorded := giver.Values[figure]; recorded {
+		return value
+	}
+	return receiver.Values[figure]
+}
+
+// sumValues adds up what figures are worth going from giver to receiver
+func sumValues(figures []string, giver Collection, receiver Collection) float64 {
+	total := 0.0
+	for _, figure := range figures {
+		total += tradeValue(figure, giver, receiver)
+	}
+	return total
+}
+
+// matchTrade finds what two collections could swap, or false if the trade is
+// not mutual
+func matchTrade(mine Collection, theirs Collection, balance bool) (TradeMatch, bool) {
+	match := TradeMatch{Partner: theirs.User}
+	for _, figure := range mine.ForTrade {
+		if containsString(theirs.Wanted, figure) {
+			match.Give = append(match.Give, figure)
+		}
+	}
+	for _, figure := range theirs.ForTrade {
+		if containsString(mine.Wanted, figure) {
+			match.Get = append(match.Get, figure)
+		}
+	}
+	if len(match.Give) == 0 || len(match.Get) == 0 {
+		return match, false
+	}
+	match.GiveValue = sumValues(match.Give, mine, theirs)
+	match.GetValue = sumValues(match.Get, theirs, mine)
+	if balance {
+		balanceTrade(&match, mine, theirs)
+	}
+	return match, true
+}
+
+// balanceTrade drops figures from the richer side while that brings the
+// values closer, keeping at least one figure on each side
+func balanceTrade(match *TradeMatch, mine Collection, theirs Collection) {
+	for {
+		side, total, giver, receiver := &match.Give, &match.GiveValue, mine, theirs
+		if match.GetValue > match.GiveValue {
+			side, total, giver, receiver = &match.Get, &match.GetValue, theirs, mine
+		}
+		if len(*side) < 2 {
+			return
+		}
+		//Dropping a figure worth value from the richer side leaves a gap of |gap - value|
+		gap := match.Difference()
+		best, bestGap := -1, gap
+		for i, figure := range *side {
+			value := tradeValue(figure, giver, receiver)
+			if value > 0 && math.Abs(gap-value) < bestGap {
+				best, bestGap = i, math.Abs(gap-value)
+			}
+		}
+		if best < 0 {
+			return
+		}
+		*total -= tradeValue((*side)[best], giver, receiver)
+		*side = append((*side)[:best:best], (*side)[best+1:]...)
+		match.Balanced = true
+	}
+}
+
+// tradeMatches ranks every partner sharing a public profile by how much they
+// and user could swap
+func tradeMatches(user string, balance bool) ([]TradeMatch, error) {
+	var collections map[string]*Collection
+	if err := readDocument(collectionsDocument, &collections); err != nil {
+		return nil, err
+	}
+	mine, exists := collections[accountKey(user)]
+	if !exists {
+		return nil, nil
+	}
+	var matches []TradeMatch
+	for key, theirs := range collections {
+		if key == accountKey(user) || !theirs.Public {
+			continue
+		}
+		if match, mutual := matchTrade(*mine, *theirs, balance); mutual {
+			matches = append(matches, match)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score() != matches[j].Score() {
+			return matches[i].Score() > matches[j].Score()
+		}
+		if matches[i].Difference() != matches[j].Difference() {
+			return matches[i].Difference() < matches[j].Difference()
+		}
+		return matches[i].Partner < matches[j].Partner
+	})
+	return matches, nil
+}
+
+// Data for the trade matcher page
+type TradesPageData struct {
+	Title   string
+	User    string
+	Balance bool
+	Matches []TradeMatch
+	Slugs   map[string]string
+}
+
+// Page ranking trade partners for the caller
+func tradesHandler(w http.ResponseWriter, r *http.Request) {
+	balance := r.FormValue("balance") != ""
+	matches, err := tradeMatches(requestUser(r), balance)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	checklist, err := repo.Figures(nil)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	var pagedata TradesPageData
+	pagedata.Title = "Trade Matches"
+	pagedata.User = requestUser(r)
+	pagedata.Balance = balance
+	pagedata.Matches = matches
+	pagedata.Slugs = make(map[string]string)
+	for _, figure := range checklist.Figures {
+		pagedata.Slugs[figure.Name] = figure.Slug()
+	}
+	renderTemplate(w, tradestpl, pagedata)
+}
+
+// API ranking trade partners for the caller
+func tradesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	matches, err := tradeMatches(requestUser(r), r.FormValue("balance") != "")
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if matches == nil {
+		matches = []TradeMatch{}
+	}
+	writeJSON(w, matches)
+}
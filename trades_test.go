@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchTrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		mine     Collection
+		theirs   Collection
+		balance  bool
+		ok       bool
+		give     []string
+		get      []string
+		balanced bool
+	}{
+		{"not mutual",
+			Collection{ForTrade: []string{"Knight"}},
+			Collection{Wanted: []string{"Knight"}},
+			false, false, []string{"Knight"}, nil, false},
+		{"unbalanced when not asked",
+			Collection{ForTrade: []string{"Knight", "Squire"}, Wanted: []string{"Page"}, Values: map[string]float64{"Knight": 10, "Squire": 10}},
+			Collection{ForTrade: []string{"Page"}, Wanted: []string{"Knight", "Squire"}, Values: map[string]float64{"Page": 10}},
+			false, true, []string{"Knight", "Squire"}, []string{"Page"}, false},
+		{"richer side drops a figure",
+			Collection{ForTrade: []string{"Knight", "Squire"}, Wanted: []string{"Page"}, Values: map[string]float64{"Knight": 10, "Squire": 10}},
+			Collection{ForTrade: []string{"Page"}, Wanted: []string{"Knight", "Squire"}, Values: map[string]float64{"Page": 10}},
+			true, true, []string{"Squire"}, []string{"Page"}, true},
+		{"receiver's value when the giver has none",
+			Collection{ForTrade: []string{"Page"}, Wanted: []string{"Knight", "Squire"}},
+			Collection{ForTrade: []string{"Knight", "Squire"}, Wanted: []string{"Page"}, Values: map[string]float64{"Page": 10}},
+			true, true, []string{"Page"}, []string{"Knight", "Squire"}, false},
+		{"drops only what brings values closer",
+			Collection{ForTrade: []string{"Knight", "Squire"}, Wanted: []string{"Page"}, Values: map[string]float64{"Knight": 10, "Squire": 10}},
+			Collection{ForTrade: []string{"Page"}, Wanted: []string{"Knight", "Squire"}, Values: map[string]float64{"Page": 15}},
+			true, true, []string{"Knight", "Squire"}, []string{"Page"}, false},
+		{"keeps one figure on each side",
+			Collection{ForTrade: []string{"Knight"}, Wanted: []string{"Page", "Squire"}, Values: map[string]float64{"Knight": 50}},
+			Collection{ForTrade: []string{"Page", "Squire"}, Wanted: []string{"Knight"}, Values: map[string]float64{"Page": 10, "Squire": 10}},
+			true, true, []string{"Knight"}, []string{"Page", "Squire"}, false},
+		{"no values recorded",
+			Collection{ForTrade: []string{"Knight", "Squire"}, Wanted: []string{"Page"}},
+			Collection{ForTrade: []string{"Page"}, Wanted: []string{"Knight", "Squire"}},
+			true, true, []string{"Knight", "Squire"}, []string{"Page"}, false},
+	}
+	for _, test := range tests {
+		match, ok := matchTrade(test.mine, test.theirs, test.balance)
+		if ok != test.ok {
+			t.Errorf("%s: ok %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !reflect.DeepEqual(match.Give, test.give) || !reflect.DeepEqual(match.Get, test.get) || match.Balanced != test.balanced {
+			t.Errorf("%s: give %v, get %v, balanced %v", test.name, match.Give, match.Get, match.Balanced)
+		}
+		if ok && (match.GiveValue != sumValues(match.Give, test.mine, test.theirs) || match.GetValue != sumValues(match.Get, test.theirs, test.mine)) {
+			t.Errorf("%s: values %v and %v do not add up", test.name, match.GiveValue, match.GetValue)
+		}
+	}
+}